@@ -0,0 +1,170 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// accessLog writes the requests forwarded by the HTTP proxy to the file
+// of http-proxy.access-log. The file is opened on the first write and
+// reopened when the option changes or the config is reloaded.
+type accessLog struct {
+	mu   sync.Mutex
+	name string
+	w    io.Writer
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"clientIP"`
+	Username  string    `json:"username"`
+	Session   string    `json:"session"`
+	Group     string    `json:"group"`
+	Devid     string    `json:"devid"`
+	Dest      string    `json:"dest"`
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Tx        int64     `json:"tx"`
+	Rx        int64     `json:"rx"`
+	Duration  int64     `json:"duration"`
+	Referer   string    `json:"referer"`
+	UserAgent string    `json:"userAgent"`
+}
+
+func (l *accessLog) write(cfg *HttpProxyConfig, e *accessLogEntry) {
+	if cfg.AccessLog == "" {
+		return
+	}
+
+	var line []byte
+
+	if cfg.AccessLogFormat == AccessLogFormatJSON {
+		line, _ = jsoniter.Marshal(e)
+		line = append(line, '\n')
+	} else {
+		line = []byte(e.combined())
+	}
+
+	l.output(cfg.AccessLog, line)
+}
+
+// output appends the line to the file, which is opened on the first
+// write or when the name changes. "-" is stdout.
+func (l *accessLog) output(name string, line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.name != name {
+		l.close()
+
+		if name == "-" {
+			l.w = os.Stdout
+		} else {
+			f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Error().Msgf("open log '%s' fail: %v", name, err)
+				return
+			}
+			l.w = f
+		}
+
+		l.name = name
+	}
+
+	l.w.Write(line)
+}
+
+// reopen closes the file, which is opened again on the next write
+func (l *accessLog) reopen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.close()
+}
+
+func (l *accessLog) close() {
+	if f, ok := l.w.(*os.File); ok && f != os.Stdout {
+		f.Close()
+	}
+
+	l.w = nil
+	l.name = ""
+}
+
+// combined formats the entry in the Apache combined log format, followed
+// by the device, the destination, the bytes sent to the device and the
+// duration in milliseconds.
+func (e *accessLogEntry) combined() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	dev := e.Devid
+	if e.Group != "" {
+		dev = e.Group + "/" + e.Devid
+	}
+
+	return fmt.Sprintf("%s - %s [%s] %s %d %d %s %s %s %s %d %d\n",
+		e.ClientIP, dash(e.Username), e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto), e.Status, e.Rx,
+		strconv.Quote(dash(e.Referer)), strconv.Quote(dash(e.UserAgent)),
+		strconv.Quote(dev), strconv.Quote(e.Dest), e.Tx, e.Duration)
+}
+
+// accessLogWriter records the status and the size of the response body
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.size += int64(n)
+
+	return n, err
+}
+
+// Unwrap lets http.ResponseController flush and hijack the connection
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accessLogBody counts the bytes of the request body
+type accessLogBody struct {
+	io.ReadCloser
+	size int64
+}
+
+func (b *accessLogBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.size += int64(n)
+	return n, err
+}
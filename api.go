@@ -3,13 +3,14 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
 	"io/fs"
 	"net"
 	"net/http"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -23,17 +24,23 @@ import (
 
 const httpSessionExpire = 30 * time.Minute
 
-func (srv *RttyServer) ListenAPI() error {
-	cfg := &srv.cfg
+// apiRoutes lists the path prefixes served by the API, used to mount
+// the API on an external http.ServeMux.
+var apiRoutes = []string{
+	"/connect/", "/broadcast", "/counts", "/groups", "/devs", "/dev/", "/cmd/",
+	"/web/", "/web2/", "/signout", "/signin", "/alive", "/reload",
+	"/tunnels", "/tunnels/", "/tunnel/", "/proxy-sessions", "/proxy-sessions/",
+	"/files/", "/file-transfers", "/file-transfers/",
+	"/push-jobs", "/push-jobs/", "/recordings/", "/shares", "/shares/", "/share/",
+	"/tokens", "/tokens/",
+}
 
+func newAPIServer(srv *RttyServer) *APIServer {
 	gin.SetMode(gin.ReleaseMode)
 
 	r := gin.New()
 
-	fs, err := fs.Sub(staticFs, "assets/dist")
-	if err != nil {
-		return err
-	}
+	fs, _ := fs.Sub(staticFs, "assets/dist")
 
 	root := http.FS(fs)
 
@@ -51,13 +58,34 @@ func (srv *RttyServer) ListenAPI() error {
 			c.Request.Method, c.Request.URL.Path, c.Request.Proto, c.Writer.Status())
 	})
 
-	if cfg.AllowOrigins {
-		log.Debug().Msg("Allow all origins")
-		r.Use(cors.Default())
-	}
+	r.Use(a.proxySubdomain)
+	r.Use(a.rejectProxyOrigin)
+
+	allowOrigins := cors.Default()
+
+	r.Use(func(c *gin.Context) {
+		if srv.config().User.AllowOrigins {
+			allowOrigins(c)
+		}
+	})
+
+	a.register(r)
+
+	r.NoRoute(a.checkClientAddr, a.handleFile)
+
+	return a
+}
+
+func (a *APIServer) register(r gin.IRouter) {
+	r = r.Group("/", a.checkClientAddr)
 
 	authorized := r.Group("/", func(c *gin.Context) {
-		if !cfg.LocalAuth && isLocalRequest(c) {
+		if a.srv.draining.Load() {
+			c.AbortWithStatus(http.StatusServiceUnavailable)
+			return
+		}
+
+		if !a.srv.config().User.LocalAuth && isLocalRequest(c) {
 			return
 		}
 
@@ -65,9 +93,15 @@ func (srv *RttyServer) ListenAPI() error {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
+
+		if t := apiToken(c); t != nil && !a.tokenAllowed(c, t) {
+			c.AbortWithStatus(http.StatusForbidden)
+			return
+		}
 	})
 
 	authorized.GET("/connect/:devid", a.handleConnect)
+	authorized.GET("/broadcast", a.handleBroadcast)
 	authorized.GET("/counts", a.handleCounts)
 	authorized.GET("/groups", a.handleGroups)
 	authorized.GET("/devs", a.handleDevs)
@@ -76,21 +110,84 @@ func (srv *RttyServer) ListenAPI() error {
 	authorized.Any("/web/:devid/:proto/:addr/*path", a.handleWeb)
 	authorized.Any("/web2/:group/:devid/:proto/:addr/*path", a.handleWeb2)
 	authorized.GET("/signout", a.handleSignout)
+	authorized.POST("/reload", a.handleReload)
+	authorized.GET("/tunnels", a.handleTunnels)
+	authorized.POST("/tunnels/:devid", a.handleTunnelOpen)
+	authorized.DELETE("/tunnels/:id", a.handleTunnelClose)
+	authorized.GET("/tunnel/:group/:devid/:addr", a.handleTunnelWs)
+	authorized.GET("/proxy-sessions", a.handleHttpProxySessions)
+	authorized.DELETE("/proxy-sessions/:id", a.handleHttpProxySessionRevoke)
+	authorized.PUT("/files/:devid", a.handleFilePut)
+	authorized.GET("/files/:devid", a.handleFileGet)
+	authorized.GET("/file-transfers", a.handleFileTransfers)
+	authorized.DELETE("/file-transfers/:id", a.handleFileTransferCancel)
+
+	authorized.POST("/push-jobs", a.handlePushJobCreate)
+	authorized.GET("/push-jobs", a.handlePushJobs)
+	authorized.GET("/push-jobs/:id", a.handlePushJob)
+	authorized.DELETE("/push-jobs/:id", a.handlePushJobDelete)
+
+	authorized.GET("/recordings/search", a.handleRecordingSearch)
+
+	authorized.POST("/shares", a.handleShareCreate)
+	authorized.GET("/shares", a.handleShares)
+	authorized.DELETE("/shares/:id", a.handleShareRevoke)
+
+	authorized.POST("/tokens", a.handleTokenCreate)
+	authorized.GET("/tokens", a.handleTokens)
+	authorized.DELETE("/tokens/:id", a.handleTokenRevoke)
 
 	r.POST("/signin", a.handleSignin)
 	r.GET("/alive", a.handleAlive)
+	r.GET("/share/:id", a.handleShare)
+}
 
-	r.NoRoute(a.handleFile)
+// ServeAPI serves the API and the web UI on the listener until the
+// server is stopped.
+func (srv *RttyServer) ServeAPI(ln net.Listener) error {
+	hs := &http.Server{Handler: srv.api.r}
 
-	ln, err := net.Listen("tcp", cfg.AddrUser)
-	if err != nil {
-		return err
+	if !srv.trackServer(hs) {
+		ln.Close()
+		return net.ErrClosed
 	}
-	defer ln.Close()
 
 	log.Info().Msgf("Listen users on: %s", ln.Addr().(*net.TCPAddr))
 
-	return r.RunListener(ln)
+	err := hs.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+// Handler returns the http.Handler which serves the API and the web UI.
+func (srv *RttyServer) Handler() http.Handler {
+	return srv.api.r
+}
+
+// RegisterRoutes registers the API routes on an external gin router.
+// The web UI is not included.
+func (srv *RttyServer) RegisterRoutes(r gin.IRouter) {
+	srv.api.register(r)
+}
+
+// RegisterServeMux registers the API routes on an external http.ServeMux.
+// The web UI is not included.
+func (srv *RttyServer) RegisterServeMux(mux *http.ServeMux) {
+	for _, pattern := range apiRoutes {
+		mux.Handle(pattern, srv.api.r)
+	}
+}
+
+func (a *APIServer) checkClientAddr(c *gin.Context) {
+	addr, _ := net.ResolveTCPAddr("tcp", c.Request.RemoteAddr)
+
+	if !ipAllowed(a.srv.config().User.AllowedCIDRs, addr) {
+		log.Debug().Msgf("user from %s not allowed", c.Request.RemoteAddr)
+		c.AbortWithStatus(http.StatusForbidden)
+	}
 }
 
 func isLocalRequest(c *gin.Context) bool {
@@ -107,13 +204,24 @@ type APIServer struct {
 }
 
 func (a *APIServer) auth(c *gin.Context) bool {
-	cfg := &a.srv.cfg
+	cfg := a.srv.config()
 
-	if !cfg.LocalAuth && isLocalRequest(c) {
+	if !cfg.User.LocalAuth && isLocalRequest(c) {
 		return true
 	}
 
-	if cfg.Password == "" {
+	if !cfg.User.authRequired() {
+		return true
+	}
+
+	if bearer, ok := bearerToken(c); ok {
+		t := a.srv.checkAPIToken(bearer)
+		if t == nil {
+			return false
+		}
+
+		c.Set("apiToken", t)
+
 		return true
 	}
 
@@ -127,17 +235,62 @@ func (a *APIServer) auth(c *gin.Context) bool {
 	return true
 }
 
+// sessionUser returns the username of the signed in user, or of the
+// creator of the API token, which is empty if signed in with the global
+// password or auth is not required.
+func (a *APIServer) sessionUser(c *gin.Context) string {
+	if t := apiToken(c); t != nil {
+		return t.Username
+	}
+
+	sid, err := c.Cookie("sid")
+	if err != nil {
+		return ""
+	}
+
+	username, _ := a.sessions.Get(sid)
+	name, _ := username.(string)
+
+	return name
+}
+
+// isAdmin reports whether the user is an admin. Users signed in with the
+// global password, or when auth is not required, are admins.
+func (a *APIServer) isAdmin(c *gin.Context) bool {
+	username := a.sessionUser(c)
+	if username == "" {
+		return true
+	}
+
+	for _, user := range a.srv.config().User.Users {
+		if user.Username == username {
+			return user.Admin
+		}
+	}
+
+	return false
+}
+
+// sessionOwner returns the username of the signed in user, or the client
+// IP if there's no username, to account resources per user.
+func (a *APIServer) sessionOwner(c *gin.Context) string {
+	if username := a.sessionUser(c); username != "" {
+		return username
+	}
+	return c.ClientIP()
+}
+
 func (a *APIServer) callUserHookUrl(c *gin.Context) bool {
-	cfg := &a.srv.cfg
+	cfg := a.srv.config()
 
-	if cfg.UserHookUrl == "" {
+	if cfg.User.HookUrl == "" {
 		return true
 	}
 
 	upath := c.Request.URL.RawPath
 
 	// Create HTTP request with original headers
-	req, err := http.NewRequest("GET", cfg.UserHookUrl, nil)
+	req, err := http.NewRequest("GET", cfg.User.HookUrl, nil)
 	if err != nil {
 		log.Error().Err(err).Msgf("create hook request for \"%s\" fail", upath)
 		return false
@@ -201,73 +354,49 @@ func (a *APIServer) handleConnect(c *gin.Context) {
 
 		c.Redirect(http.StatusFound, url)
 	} else {
-		handleUserConnection(a.srv, c)
+		handleUserConnection(a.srv, c, a.sessionUser(c), a.sessionOwner(c), a.isAdmin(c))
 	}
 }
 
 func (a *APIServer) handleCounts(c *gin.Context) {
-	count := 0
+	t := apiToken(c)
+	if t == nil || len(t.Groups) == 0 {
+		c.JSON(http.StatusOK, gin.H{"count": a.srv.DeviceCount()})
+		return
+	}
 
-	a.srv.groups.Range(func(key, value any) bool {
-		count += int(value.(*DeviceGroup).count.Load())
-		return true
-	})
+	count := 0
+	for _, group := range t.Groups {
+		count += len(a.srv.Devices(group))
+	}
 
 	c.JSON(http.StatusOK, gin.H{"count": count})
 }
 
 func (a *APIServer) handleGroups(c *gin.Context) {
-	groups := []string{""}
+	groups := a.srv.Groups()
 
-	a.srv.groups.Range(func(key, value any) bool {
-		if key != "" {
-			groups = append(groups, key.(string))
-		}
-		return true
-	})
+	// Only the groups the API token can reach
+	if t := apiToken(c); t != nil {
+		groups = slices.DeleteFunc(groups, func(group string) bool { return !t.groupAllowed(group) })
+	}
 
 	c.JSON(http.StatusOK, groups)
 }
 
 func (a *APIServer) handleDevs(c *gin.Context) {
 	devs := make([]*DeviceInfo, 0)
-	g := a.srv.GetGroup(c.Query("group"), false)
 
-	if g == nil {
-		c.JSON(http.StatusOK, devs)
-		return
+	for _, dev := range a.srv.Devices(c.Query("group")) {
+		devs = append(devs, dev.Info())
 	}
 
-	g.devices.Range(func(key, value any) bool {
-		dev := value.(*Device)
-
-		devs = append(devs, &DeviceInfo{
-			Group:     dev.group,
-			ID:        dev.id,
-			Desc:      dev.desc,
-			Connected: uint32(time.Now().Unix() - dev.timestamp),
-			Uptime:    dev.uptime,
-			Proto:     dev.proto,
-			IPaddr:    dev.conn.RemoteAddr().(*net.TCPAddr).IP.String(),
-		})
-
-		return true
-	})
-
 	c.JSON(http.StatusOK, devs)
 }
 
 func (a *APIServer) handleDev(c *gin.Context) {
 	if dev := a.srv.GetDevice(c.Query("group"), c.Param("devid")); dev != nil {
-		info := &DeviceInfo{
-			ID:        dev.id,
-			Desc:      dev.desc,
-			Connected: uint32(time.Now().Unix() - dev.timestamp),
-			Uptime:    dev.uptime,
-			Proto:     dev.proto,
-			IPaddr:    dev.conn.RemoteAddr().(*net.TCPAddr).IP.String(),
-		}
-		c.JSON(http.StatusOK, info)
+		c.JSON(http.StatusOK, dev.Info())
 	} else {
 		c.Status(http.StatusNotFound)
 	}
@@ -312,14 +441,31 @@ func (a *APIServer) handleSignout(c *gin.Context) {
 	}
 
 	a.sessions.Del(sid)
+	a.srv.revokeLoginHttpProxySessions(sid)
 
 	c.Status(http.StatusOK)
 }
 
+func (a *APIServer) handleReload(c *gin.Context) {
+	if !a.isAdmin(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	res, err := a.srv.ReloadConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"err": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func (a *APIServer) handleSignin(c *gin.Context) {
-	cfg := &a.srv.cfg
+	cfg := a.srv.config()
 
 	type credentials struct {
+		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
@@ -331,10 +477,10 @@ func (a *APIServer) handleSignin(c *gin.Context) {
 		return
 	}
 
-	if cfg.Password == creds.Password {
+	if cfg.User.checkPassword(creds.Username, creds.Password) {
 		sid := utils.GenUniqueID()
 
-		a.sessions.Set(sid, true, cache.WithEx(httpSessionExpire))
+		a.sessions.Set(sid, creds.Username, cache.WithEx(httpSessionExpire))
 
 		c.SetCookie("sid", sid, 0, "", "", false, true)
 		c.Status(http.StatusOK)
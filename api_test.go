@@ -0,0 +1,65 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignin(t *testing.T) {
+	users := []UserAccount{
+		{Username: "alice", Password: "alicepass", Admin: true},
+		{Username: "bob", Password: "bobpass"},
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		users    []UserAccount
+		creds    string
+		want     int
+	}{
+		{"global", "globalpass", nil, `{"password":"globalpass"}`, http.StatusOK},
+		{"global wrong", "globalpass", nil, `{"password":"x"}`, http.StatusUnauthorized},
+		{"global empty", "globalpass", nil, `{}`, http.StatusUnauthorized},
+		{"global no users", "globalpass", nil, `{"username":"alice","password":"alicepass"}`, http.StatusUnauthorized},
+
+		{"users", "", users, `{"username":"bob","password":"bobpass"}`, http.StatusOK},
+		{"users wrong", "", users, `{"username":"bob","password":"alicepass"}`, http.StatusUnauthorized},
+		{"users unknown", "", users, `{"username":"carol","password":""}`, http.StatusUnauthorized},
+		{"users no username", "", users, `{"password":""}`, http.StatusUnauthorized},
+		{"users no username any password", "", users, `{"password":"x"}`, http.StatusUnauthorized},
+
+		{"both global", "globalpass", users, `{"password":"globalpass"}`, http.StatusOK},
+		{"both user", "globalpass", users, `{"username":"alice","password":"alicepass"}`, http.StatusOK},
+		{"both user with global", "globalpass", users, `{"username":"alice","password":"globalpass"}`, http.StatusUnauthorized},
+
+		{"no auth", "", nil, `{"password":""}`, http.StatusUnauthorized},
+		{"bad request", "globalpass", nil, `{`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		srv := &RttyServer{}
+		srv.cfg.Store(&Config{User: UserConfig{Password: tt.password, Users: tt.users}})
+
+		a := newAPIServer(srv)
+
+		w := httptest.NewRecorder()
+		a.r.ServeHTTP(w, httptest.NewRequest("POST", "/signin", strings.NewReader(tt.creds)))
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+			continue
+		}
+
+		if hasSid := strings.Contains(w.Header().Get("Set-Cookie"), "sid="); hasSid != (tt.want == http.StatusOK) {
+			t.Errorf("%s: cookie %q", tt.name, w.Header().Get("Set-Cookie"))
+		}
+	}
+}
@@ -0,0 +1,425 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhaojh329/rttys/v5/utils"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// Scopes of the API tokens
+const (
+	TokenScopeDevices = "devices"
+	TokenScopeCmd     = "cmd"
+	TokenScopeTerm    = "term"
+	TokenScopeProxy   = "proxy"
+	TokenScopeFiles   = "files"
+)
+
+var tokenScopes = []string{TokenScopeDevices, TokenScopeCmd, TokenScopeTerm, TokenScopeProxy, TokenScopeFiles}
+
+type tokenRoute struct {
+	scope string
+
+	// The route is on the devices of the group given by the "group"
+	// param or query, which must be one of the token. The routes on
+	// objects found by their id check the group of the object with
+	// tokenGroupAllowed instead.
+	group bool
+}
+
+// tokenRoutes maps the routes API tokens can use to the scope needed.
+// The others, such as managing the tokens, need signing in.
+var tokenRoutes = map[string]tokenRoute{
+	"/counts":     {TokenScopeDevices, false},
+	"/groups":     {TokenScopeDevices, false},
+	"/devs":       {TokenScopeDevices, true},
+	"/dev/:devid": {TokenScopeDevices, true},
+
+	"/cmd/:devid": {TokenScopeCmd, true},
+
+	"/connect/:devid": {TokenScopeTerm, true},
+	"/broadcast":      {TokenScopeTerm, true},
+
+	"/web/:devid/:proto/:addr/*path":         {TokenScopeProxy, true},
+	"/web2/:group/:devid/:proto/:addr/*path": {TokenScopeProxy, true},
+	"/proxy-sessions":                        {TokenScopeProxy, false},
+	"/proxy-sessions/:id":                    {TokenScopeProxy, false},
+	"/tunnels":                               {TokenScopeProxy, false},
+	"/tunnels/:devid":                        {TokenScopeProxy, true},
+	"/tunnels/:id":                           {TokenScopeProxy, false},
+	"/tunnel/:group/:devid/:addr":            {TokenScopeProxy, true},
+
+	"/files/:devid":       {TokenScopeFiles, true},
+	"/file-transfers":     {TokenScopeFiles, false},
+	"/file-transfers/:id": {TokenScopeFiles, false},
+	"/push-jobs":          {TokenScopeFiles, true},
+	"/push-jobs/:id":      {TokenScopeFiles, false},
+}
+
+// The last use of a token is saved at most once in this interval
+const tokenLastUsedSave = time.Minute
+
+// APIToken authenticates scripts by "Authorization: Bearer <id>.<secret>"
+// as the user who created it. Only the hash of the secret is kept.
+type APIToken struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Hash     string   `json:"hash"`
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+	Groups   []string `json:"groups"`
+	Created  int64    `json:"created"`
+	Expire   int64    `json:"expire"`
+	LastUsed int64    `json:"lastUsed"`
+
+	// Fingerprint of the global password the token is created with,
+	// if the username is empty
+	PasswordHash string `json:"passwordHash,omitempty"`
+}
+
+type APITokenInfo struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+	Groups   []string `json:"groups"`
+	Created  int64    `json:"created"`
+	Expire   int64    `json:"expire"`
+	LastUsed int64    `json:"lastUsed"`
+
+	// Only given on creation
+	Token string `json:"token,omitempty"`
+}
+
+// apiTokens keeps the tokens, saved to user.api-token-file if set
+type apiTokens struct {
+	mu     sync.Mutex
+	tokens map[string]*APIToken
+
+	// Serializes the writes of the file
+	saveMu sync.Mutex
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// hashTokenPassword returns the fingerprint of the global password,
+// keyed by the secret of the token so the file doesn't reveal it.
+func hashTokenPassword(secret, password string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(password))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// info returns the info of the token, apiTokens.mu is held
+func (t *APIToken) info() *APITokenInfo {
+	return &APITokenInfo{
+		ID:       t.ID,
+		Name:     t.Name,
+		Username: t.Username,
+		Scopes:   t.Scopes,
+		Groups:   t.Groups,
+		Created:  t.Created,
+		Expire:   t.Expire,
+		LastUsed: t.LastUsed,
+	}
+}
+
+// groupAllowed reports whether the token can reach the devices of the group
+func (t *APIToken) groupAllowed(group string) bool {
+	return len(t.Groups) == 0 || slices.Contains(t.Groups, group)
+}
+
+// loadAPITokens loads the tokens saved in the file
+func (srv *RttyServer) loadAPITokens(name string) {
+	ts := &srv.apiTokens
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	ts.tokens = make(map[string]*APIToken)
+
+	if name == "" {
+		return
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error().Msgf("load api tokens: %v", err)
+		}
+		return
+	}
+
+	tokens := []*APIToken{}
+
+	if err := jsoniter.Unmarshal(b, &tokens); err != nil {
+		log.Error().Msgf("load api tokens from %s: %v", name, err)
+		return
+	}
+
+	for _, t := range tokens {
+		ts.tokens[t.ID] = t
+	}
+
+	log.Info().Msgf("loaded %d api tokens", len(tokens))
+}
+
+// saveAPITokens writes the tokens to the file, replacing it atomically
+func (srv *RttyServer) saveAPITokens() {
+	name := srv.config().User.APITokenFile
+	if name == "" {
+		return
+	}
+
+	ts := &srv.apiTokens
+
+	ts.saveMu.Lock()
+	defer ts.saveMu.Unlock()
+
+	ts.mu.Lock()
+	tokens := make([]*APIToken, 0, len(ts.tokens))
+	for _, t := range ts.tokens {
+		tokens = append(tokens, t)
+	}
+	b, _ := jsoniter.MarshalIndent(tokens, "", "  ")
+	ts.mu.Unlock()
+
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		log.Error().Msgf("save api tokens: %v", err)
+		return
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		log.Error().Msgf("save api tokens: %v", err)
+	}
+}
+
+// checkAPIToken returns the token of the bearer, nil if it's invalid,
+// expired, revoked, or its user is removed from the config. The tokens
+// created with the global password stop working once it's changed.
+func (srv *RttyServer) checkAPIToken(bearer string) *APIToken {
+	id, secret, ok := strings.Cut(bearer, ".")
+	if !ok {
+		return nil
+	}
+
+	ts := &srv.apiTokens
+	now := time.Now().Unix()
+
+	ts.mu.Lock()
+
+	t := ts.tokens[id]
+
+	if t == nil || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashTokenSecret(secret))) != 1 ||
+		(t.Expire > 0 && now >= t.Expire) {
+		ts.mu.Unlock()
+		return nil
+	}
+
+	cfg := srv.config()
+
+	if t.Username != "" && !cfg.User.hasUser(t.Username) {
+		ts.mu.Unlock()
+		return nil
+	}
+
+	// Created with the global password if the username is empty
+	if t.Username == "" && subtle.ConstantTimeCompare([]byte(t.PasswordHash),
+		[]byte(hashTokenPassword(secret, cfg.User.Password))) != 1 {
+		ts.mu.Unlock()
+		return nil
+	}
+
+	save := now-t.LastUsed >= int64(tokenLastUsedSave/time.Second)
+	t.LastUsed = now
+
+	ts.mu.Unlock()
+
+	if save {
+		go srv.saveAPITokens()
+	}
+
+	return t
+}
+
+// bearerToken returns the token in the Authorization header
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// apiToken returns the token the request is authenticated by, nil if
+// signed in.
+func apiToken(c *gin.Context) *APIToken {
+	if v, ok := c.Get("apiToken"); ok {
+		return v.(*APIToken)
+	}
+	return nil
+}
+
+// tokenAllowed reports whether the route and the group of the device
+// requested are in the scopes of the token.
+func (a *APIServer) tokenAllowed(c *gin.Context, t *APIToken) bool {
+	route, ok := tokenRoutes[c.FullPath()]
+	if !ok || !slices.Contains(t.Scopes, route.scope) {
+		return false
+	}
+
+	if !route.group {
+		return true
+	}
+
+	group := c.Param("group")
+	if group == "" {
+		group = c.Query("group")
+	}
+
+	return t.groupAllowed(group)
+}
+
+// tokenGroupAllowed reports whether the API token of the request, if
+// any, can reach the devices of the group.
+func tokenGroupAllowed(c *gin.Context, group string) bool {
+	t := apiToken(c)
+	return t == nil || t.groupAllowed(group)
+}
+
+func (a *APIServer) handleTokenCreate(c *gin.Context) {
+	type request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+		Groups []string `json:"groups"`
+		Expire int64    `json:"expire"`
+	}
+
+	req := request{}
+
+	if err := c.BindJSON(&req); err != nil || len(req.Scopes) == 0 || req.Expire < 0 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	for _, scope := range req.Scopes {
+		if !slices.Contains(tokenScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"err": "invalid scope: " + scope})
+			return
+		}
+	}
+
+	slices.Sort(req.Scopes)
+	req.Scopes = slices.Compact(req.Scopes)
+
+	if req.Groups == nil {
+		req.Groups = []string{}
+	}
+
+	now := time.Now().Unix()
+	secret := utils.GenUniqueID()
+
+	t := &APIToken{
+		ID:       utils.GenUniqueID(),
+		Name:     req.Name,
+		Hash:     hashTokenSecret(secret),
+		Username: a.sessionUser(c),
+		Scopes:   req.Scopes,
+		Groups:   req.Groups,
+		Created:  now,
+	}
+
+	if t.Username == "" {
+		t.PasswordHash = hashTokenPassword(secret, a.srv.config().User.Password)
+	}
+
+	if req.Expire > 0 {
+		t.Expire = now + req.Expire
+	}
+
+	ts := &a.srv.apiTokens
+
+	ts.mu.Lock()
+	ts.tokens[t.ID] = t
+	info := t.info()
+	ts.mu.Unlock()
+
+	a.srv.saveAPITokens()
+
+	log.Info().Msgf("api token '%s' created by '%s', scopes %v, groups %v", t.ID, t.Username, t.Scopes, t.Groups)
+
+	info.Token = t.ID + "." + secret
+
+	c.JSON(http.StatusOK, info)
+}
+
+// handleTokens lists the tokens, all for admins and the own tokens for
+// the others.
+func (a *APIServer) handleTokens(c *gin.Context) {
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	infos := make([]*APITokenInfo, 0)
+
+	ts := &a.srv.apiTokens
+
+	ts.mu.Lock()
+	for _, t := range ts.tokens {
+		if admin || t.Username == username {
+			infos = append(infos, t.info())
+		}
+	}
+	ts.mu.Unlock()
+
+	slices.SortFunc(infos, func(a, b *APITokenInfo) int { return int(a.Created - b.Created) })
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handleTokenRevoke(c *gin.Context) {
+	id := c.Param("id")
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	ts := &a.srv.apiTokens
+
+	ts.mu.Lock()
+	t := ts.tokens[id]
+	if t == nil || (!admin && t.Username != username) {
+		ts.mu.Unlock()
+		c.Status(http.StatusNotFound)
+		return
+	}
+	delete(ts.tokens, id)
+	ts.mu.Unlock()
+
+	a.srv.saveAPITokens()
+
+	log.Info().Msgf("api token '%s' revoked", id)
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,177 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenAllowed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	a := &APIServer{}
+	r := gin.New()
+
+	var token *APIToken
+	var allowed bool
+
+	check := func(c *gin.Context) { allowed = a.tokenAllowed(c, token) }
+
+	r.GET("/devs", check)
+	r.GET("/counts", check)
+	r.POST("/cmd/:devid", check)
+	r.GET("/tunnel/:group/:devid/:addr", check)
+	r.DELETE("/tunnels/:id", check)
+	r.POST("/tokens", check)
+
+	tests := []struct {
+		method string
+		url    string
+		scopes []string
+		groups []string
+		want   bool
+	}{
+		// Scopes
+		{"GET", "/devs", []string{TokenScopeDevices}, nil, true},
+		{"GET", "/devs", []string{TokenScopeCmd}, nil, false},
+		{"POST", "/cmd/dev1", []string{TokenScopeCmd}, nil, true},
+		{"POST", "/cmd/dev1", []string{TokenScopeDevices, TokenScopeTerm}, nil, false},
+		{"DELETE", "/tunnels/1", []string{TokenScopeProxy}, nil, true},
+		{"DELETE", "/tunnels/1", []string{TokenScopeFiles}, nil, false},
+
+		// Routes which need signing in
+		{"POST", "/tokens", tokenScopes, nil, false},
+
+		// Groups by query
+		{"GET", "/devs?group=g1", []string{TokenScopeDevices}, []string{"g1"}, true},
+		{"GET", "/devs?group=g2", []string{TokenScopeDevices}, []string{"g1"}, false},
+		{"GET", "/devs", []string{TokenScopeDevices}, []string{"g1"}, false},
+		{"GET", "/devs", []string{TokenScopeDevices}, []string{""}, true},
+		{"GET", "/devs?group=g2", []string{TokenScopeDevices}, nil, true},
+		{"POST", "/cmd/dev1?group=g1", []string{TokenScopeCmd}, []string{"g1", "g2"}, true},
+		{"POST", "/cmd/dev1", []string{TokenScopeCmd}, []string{"g1", "g2"}, false},
+
+		// Groups by param
+		{"GET", "/tunnel/g1/dev1/127.0.0.1:22", []string{TokenScopeProxy}, []string{"g1"}, true},
+		{"GET", "/tunnel/g2/dev1/127.0.0.1:22", []string{TokenScopeProxy}, []string{"g1"}, false},
+		{"GET", "/tunnel/g2/dev1/127.0.0.1:22?group=g1", []string{TokenScopeProxy}, []string{"g1"}, false},
+
+		// Routes without a group, checked by the handlers
+		{"GET", "/counts", []string{TokenScopeDevices}, []string{"g1"}, true},
+		{"DELETE", "/tunnels/1", []string{TokenScopeProxy}, []string{"g1"}, true},
+	}
+
+	for _, tt := range tests {
+		token = &APIToken{Scopes: tt.scopes, Groups: tt.groups}
+		allowed = false
+
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.url, nil))
+
+		if allowed != tt.want {
+			t.Errorf("%s %s scopes %v groups %v: allowed %v, want %v",
+				tt.method, tt.url, tt.scopes, tt.groups, allowed, tt.want)
+		}
+	}
+}
+
+func TestTokenGroupAllowed(t *testing.T) {
+	tests := []struct {
+		token *APIToken
+		group string
+		want  bool
+	}{
+		{nil, "g1", true},
+		{&APIToken{}, "g1", true},
+		{&APIToken{Groups: []string{"g1"}}, "g1", true},
+		{&APIToken{Groups: []string{"g1"}}, "g2", false},
+		{&APIToken{Groups: []string{"g1"}}, "", false},
+	}
+
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request, _ = http.NewRequest("GET", "/", nil)
+
+		if tt.token != nil {
+			c.Set("apiToken", tt.token)
+		}
+
+		if got := tokenGroupAllowed(c, tt.group); got != tt.want {
+			t.Errorf("token %+v group %q: got %v, want %v", tt.token, tt.group, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAPIToken(t *testing.T) {
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{User: UserConfig{Users: []UserAccount{{Username: "alice"}}}})
+
+	srv.apiTokens.tokens = map[string]*APIToken{
+		"t1": {ID: "t1", Hash: hashTokenSecret("s1"), Username: "alice"},
+		"t2": {ID: "t2", Hash: hashTokenSecret("s2"), Username: "bob"},
+		"t3": {ID: "t3", Hash: hashTokenSecret("s3"), PasswordHash: hashTokenPassword("s3", "")},
+		"t4": {ID: "t4", Hash: hashTokenSecret("s4"), Username: "alice", Expire: 1},
+	}
+
+	tests := []struct {
+		bearer string
+		want   bool
+	}{
+		{"t1.s1", true},
+		{"t1.s2", false},
+		{"t1", false},
+		{"t5.s1", false},
+
+		// The user is removed from the config
+		{"t2.s2", false},
+
+		// Created with the global password
+		{"t3.s3", true},
+
+		// Expired
+		{"t4.s4", false},
+	}
+
+	for _, tt := range tests {
+		if got := srv.checkAPIToken(tt.bearer) != nil; got != tt.want {
+			t.Errorf("%q: valid %v, want %v", tt.bearer, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAPITokenPassword(t *testing.T) {
+	srv := &RttyServer{}
+
+	srv.apiTokens.tokens = map[string]*APIToken{
+		"t1": {ID: "t1", Hash: hashTokenSecret("s1"), PasswordHash: hashTokenPassword("s1", "globalpass")},
+
+		// Saved before the fingerprint
+		"t2": {ID: "t2", Hash: hashTokenSecret("s2")},
+	}
+
+	tests := []struct {
+		password string
+		bearer   string
+		want     bool
+	}{
+		{"globalpass", "t1.s1", true},
+		{"globalpass", "t2.s2", false},
+		{"newpass", "t1.s1", false},
+		{"", "t1.s1", false},
+		{"globalpass", "t1.s1", true},
+	}
+
+	for _, tt := range tests {
+		srv.cfg.Store(&Config{User: UserConfig{Password: tt.password}})
+
+		if got := srv.checkAPIToken(tt.bearer) != nil; got != tt.want {
+			t.Errorf("password %q %q: valid %v, want %v", tt.password, tt.bearer, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+	xlog "github.com/zhaojh329/rttys/v5/log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// broadcast relays the input of one websocket to the terminal sessions of
+// several devices, and their output back tagged with the device ID.
+//
+// The output is sent in binary messages of the length of the device ID in
+// one byte, the device ID and the data. The text messages of the sessions
+// are sent with "devid" added, ended by {"type":"close","devid":"...",
+// "code":1000,"reason":"..."} with the websocket close code the session
+// would get alone.
+//
+// The input in binary messages is sent to the enabled sessions, all are
+// enabled at first. The text messages from the user are:
+//
+//	{"type":"winsize","devid":"...","cols":80,"rows":24}, to all if no devid
+//	{"type":"ack","devid":"...","ack":1024}
+//	{"type":"toggle","devid":"...","enabled":false}
+//	{"type":"commandConfirm","ok":true}
+//
+// The command filter follows one command line for all the sessions, as
+// they get the same input. A command is blocked on all the sessions if a
+// rule blocks it on any, and held back on all if any needs to confirm it,
+// told by {"type":"commandBlocked"|"commandConfirm","command":"...",
+// "devids":[...]} with the devices the rules apply to.
+type broadcast struct {
+	srv  *RttyServer
+	conn *websocket.Conn
+	ctx  context.Context
+
+	// Fixed once created
+	targets map[string]*broadcastTarget
+
+	// Writes to the websocket and the close messages
+	mu sync.Mutex
+
+	// The command line, and the sessions the Enter of the pending command
+	// is held back for with the rule applying to each, nil if none
+	cmd     cmdLine
+	confirm map[*broadcastTarget]*CommandRule
+}
+
+type broadcastTarget struct {
+	user     *User
+	enabled  atomic.Bool
+	loggedIn atomic.Bool
+
+	code   int
+	reason string
+}
+
+type broadcastMsg struct {
+	Type    string `json:"type"`
+	Devid   string `json:"devid"`
+	Cols    uint16 `json:"cols"`
+	Rows    uint16 `json:"rows"`
+	Ack     uint16 `json:"ack"`
+	Enabled bool   `json:"enabled"`
+	Ok      bool   `json:"ok"`
+}
+
+func (a *APIServer) handleBroadcast(c *gin.Context) {
+	if !a.callUserHookUrl(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	devids := c.QueryArray("devid")
+	if len(devids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"err": "device ID is required"})
+		return
+	}
+
+	handleBroadcastConnection(a.srv, c, devids, a.sessionUser(c), a.sessionOwner(c), a.isAdmin(c))
+}
+
+func handleBroadcastConnection(srv *RttyServer, c *gin.Context, devids []string, username, owner string, admin bool) {
+	defer xlog.LogPanic()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade to websocket failed")
+		return
+	}
+
+	ctx, cancel := context.WithCancel(srv.ctx)
+	defer cancel()
+
+	b := &broadcast{
+		srv:     srv,
+		conn:    conn,
+		ctx:     ctx,
+		targets: make(map[string]*broadcastTarget),
+	}
+
+	group := c.Query("group")
+
+	slices.Sort(devids)
+	devids = slices.Compact(devids)
+
+	for _, devid := range devids {
+		t := &broadcastTarget{code: websocket.CloseNormalClosure, reason: "session closed"}
+		t.enabled.Store(true)
+
+		if dev := srv.GetDevice(group, devid); dev != nil {
+			t.user = &User{srv: srv, username: username, owner: owner, admin: admin, created: time.Now(), dev: dev, bcast: b}
+		}
+
+		b.targets[devid] = t
+	}
+
+	log.Info().Msgf("broadcast by '%s' to devices %v", owner, devids)
+
+	for devid, t := range b.targets {
+		if t.user == nil {
+			b.setCloseMsg(devid, LoginErrorOffline, "device not found")
+			b.sessionClosed(devid)
+			continue
+		}
+
+		go func() {
+			defer xlog.LogPanic()
+
+			if t.user.login(t.user.dev) {
+				t.loggedIn.Store(true)
+			}
+		}()
+	}
+
+	b.serve()
+
+	log.Info().Msgf("broadcast by '%s' closed", owner)
+}
+
+// serve handles the messages from the websocket until it's closed, and
+// then closes the sessions.
+func (b *broadcast) serve() {
+	defer b.conn.Close()
+
+	for {
+		typ, data, err := b.conn.ReadMessage()
+		if err != nil {
+			if closeError, ok := err.(*websocket.CloseError); !ok || ignoredWsCloseError(closeError.Code) {
+				log.Error().Msgf("broadcast read fail: %v", err)
+			}
+			return
+		}
+
+		if typ == websocket.BinaryMessage {
+			b.input(data)
+			continue
+		}
+
+		msg := &broadcastMsg{}
+
+		if err := jsoniter.Unmarshal(data, msg); err != nil {
+			log.Error().Msgf("invalid msg from broadcast")
+			return
+		}
+
+		switch msg.Type {
+		case "winsize":
+			for devid, t := range b.targets {
+				if (msg.Devid == "" || msg.Devid == devid) && t.loggedIn.Load() {
+					t.user.dev.WriteMsg(proto.MsgTypeWinsize, t.user.sid, msg.Cols, msg.Rows)
+				}
+			}
+
+		case "ack":
+			if t := b.targets[msg.Devid]; t != nil && t.loggedIn.Load() {
+				if n := t.user.ack(msg.Ack); n > 0 {
+					t.user.ackTerm(n)
+				}
+			}
+
+		case "toggle":
+			if t := b.targets[msg.Devid]; t != nil {
+				t.enabled.Store(msg.Enabled)
+			}
+
+		case "commandConfirm":
+			for t, data := range b.confirmCommand(msg.Ok) {
+				t.user.dev.WriteMsg(proto.MsgTypeTermData, t.user.sid, data)
+			}
+		}
+	}
+}
+
+// input sends the data to the enabled sessions
+func (b *broadcast) input(data []byte) {
+	now := time.Now().UnixNano()
+
+	var targets []*broadcastTarget
+
+	for _, t := range b.targets {
+		if !t.enabled.Load() || !t.loggedIn.Load() || t.user.closed.Load() {
+			continue
+		}
+
+		t.user.lastInput.Store(now)
+
+		targets = append(targets, t)
+	}
+
+	for t, data := range b.filterInput(targets, data) {
+		if len(data) == 0 {
+			continue
+		}
+
+		user := t.user
+		dev := user.dev
+
+		if dev.limiter.wait(dev.ctx, len(data)) != nil || user.limiter.wait(user.ctx, len(data)) != nil {
+			continue
+		}
+
+		if err := dev.WriteMsg(proto.MsgTypeTermData, user.sid, data); err != nil {
+			log.Error().Msgf("write msg to device '%s' fail: %v", dev.id, err)
+		}
+	}
+}
+
+// filterInput follows the command line typed, and checks it against the
+// rules of each session on Enter like User.filterInput, deciding for all
+// the sessions together. It returns the input to send to each session.
+func (b *broadcast) filterInput(targets []*broadcastTarget, data []byte) map[*broadcastTarget][]byte {
+	rules := b.srv.config().CommandFilter.Rules
+
+	out := make(map[*broadcastTarget][]byte)
+
+	send := func(data []byte) {
+		for _, t := range targets {
+			out[t] = append(out[t], data...)
+		}
+	}
+
+	l := &b.cmd
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(rules) == 0 {
+		l.reset()
+		b.confirm = nil
+		send(data)
+		return out
+	}
+
+	// Typing again gives up the confirmation
+	for t, rule := range b.confirm {
+		if rule != nil {
+			t.user.logCommand(l.pending, rule, cmdOutcomeCanceled)
+		}
+		out[t] = []byte{cmdKillLine}
+	}
+
+	b.confirm = nil
+	l.pending = ""
+
+	for {
+		i, line := l.feed(data)
+		if i < 0 {
+			send(data)
+			return out
+		}
+
+		matched := make(map[*broadcastTarget]*CommandRule)
+		blocked := false
+
+		for _, t := range targets {
+			if rule := t.user.cmdRule(rules, line); rule != nil {
+				matched[t] = rule
+				blocked = blocked || rule.Action != CommandActionConfirm
+			}
+		}
+
+		if len(matched) == 0 {
+			send(data[:i+1])
+			data = data[i+1:]
+			continue
+		}
+
+		send(data[:i])
+
+		if blocked {
+			for t, rule := range matched {
+				t.user.logCommand(line, rule, cmdOutcomeBlocked)
+			}
+
+			send([]byte{cmdKillLine})
+			b.writeCmdMsg("commandBlocked", line, matched)
+
+			return out
+		}
+
+		b.confirm = make(map[*broadcastTarget]*CommandRule)
+		for _, t := range targets {
+			b.confirm[t] = matched[t]
+		}
+
+		l.pending = line
+		l.enter = data[i]
+		b.writeCmdMsg("commandConfirm", line, matched)
+
+		return out
+	}
+}
+
+// confirmCommand returns the input to send to each session for the
+// answer of the user to the confirmation.
+func (b *broadcast) confirmCommand(ok bool) map[*broadcastTarget][]byte {
+	l := &b.cmd
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == "" {
+		return nil
+	}
+
+	out := make(map[*broadcastTarget][]byte)
+
+	for t, rule := range b.confirm {
+		if ok {
+			out[t] = []byte{l.enter}
+		} else {
+			out[t] = []byte{cmdKillLine}
+		}
+
+		if rule == nil {
+			continue
+		}
+
+		if ok {
+			t.user.logCommand(l.pending, rule, cmdOutcomeConfirmed)
+		} else {
+			t.user.logCommand(l.pending, rule, cmdOutcomeCanceled)
+		}
+	}
+
+	b.confirm = nil
+	l.pending = ""
+
+	return out
+}
+
+func (b *broadcast) writeCmdMsg(typ, line string, matched map[*broadcastTarget]*CommandRule) {
+	devids := make([]string, 0, len(matched))
+	for t := range matched {
+		devids = append(devids, t.user.dev.id)
+	}
+
+	slices.Sort(devids)
+
+	msg, _ := jsoniter.Marshal(map[string]any{"type": typ, "command": line, "devids": devids})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+// writeText sends the JSON object of the session with the device ID added
+func (b *broadcast) writeText(devid string, data []byte) error {
+	id, _ := jsoniter.Marshal(devid)
+
+	msg := fmt.Appendf(nil, `{"devid":%s`, id)
+	if len(data) > 2 {
+		msg = append(msg, ',')
+	}
+	msg = append(msg, data[1:]...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.conn.WriteMessage(websocket.TextMessage, msg)
+}
+
+func (b *broadcast) writeTerm(devid string, data []byte) {
+	msg := make([]byte, 0, 1+len(devid)+len(data))
+	msg = append(msg, byte(len(devid)))
+	msg = append(msg, devid...)
+	msg = append(msg, data...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// setCloseMsg sets the close code and reason told when the session ends
+func (b *broadcast) setCloseMsg(devid string, code int, text string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.targets[devid]
+	t.code = code
+	t.reason = text
+}
+
+func (b *broadcast) sessionClosed(devid string) {
+	b.mu.Lock()
+	t := b.targets[devid]
+	code, reason := t.code, t.reason
+	b.mu.Unlock()
+
+	msg, _ := jsoniter.Marshal(map[string]any{"type": "close", "code": code, "reason": reason})
+	b.writeText(devid, msg)
+}
@@ -6,7 +6,7 @@ set -e
 
 # Configuration
 PACKAGE_NAME="rttys"
-VERSION=$(grep 'const RttysVersion' main.go | cut -d'"' -f2 | sed 's/^v//')
+VERSION=$(grep 'const RttysVersion' cmd/rttys/main.go | cut -d'"' -f2 | sed 's/^v//')
 MAINTAINER="Jianhui Zhao <zhaojh329@gmail.com>"
 DESCRIPTION="Access your device's terminal from anywhere via the web"
 URL="https://github.com/zhaojh329/rttys"
@@ -38,7 +38,7 @@ mkdir -p $BUILD_DIR/{usr/bin,etc/rttys,lib/systemd/system}
 
 # Build the binary
 echo "Building binary..."
-CGO_ENABLED=0 GOOS=linux GOARCH=$ARCH go build -ldflags "-s -w -X main.GitCommit=$GitCommit -X main.BuildTime=$BuildTime" -o $INSTALL_DIR/bin/rttys .
+CGO_ENABLED=0 GOOS=linux GOARCH=$ARCH go build -ldflags "-s -w -X main.GitCommit=$GitCommit -X main.BuildTime=$BuildTime" -o $INSTALL_DIR/bin/rttys ./cmd/rttys
 
 # Copy configuration files
 echo "Copying configuration files..."
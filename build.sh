@@ -1,6 +1,6 @@
 #!/bin/sh
 
-VERSION=$(grep 'const RttysVersion' main.go | cut -d'"' -f2 | sed 's/^v//')
+VERSION=$(grep 'const RttysVersion' cmd/rttys/main.go | cut -d'"' -f2 | sed 's/^v//')
 
 GitCommit=$(git log --pretty=format:"%h" -1)
 BuildTime=$(date +%FT%T%z)
@@ -29,7 +29,7 @@ generate() {
 		bin="rttys.exe"
 	}
 
-	GOOS=$os GOARCH=$arch CGO_ENABLED=0 go build -ldflags="-s -w -X main.GitCommit=$GitCommit -X main.BuildTime=$BuildTime" -o $dir/$bin && cp rttys.service $dir
+	GOOS=$os GOARCH=$arch CGO_ENABLED=0 go build -ldflags="-s -w -X main.GitCommit=$GitCommit -X main.BuildTime=$BuildTime" -o $dir/$bin ./cmd/rttys && cp rttys.service $dir
 
 	[ -n "$COMPRESS" ] && {
 		tar -jcvf $dir.tar.bz2 $dir
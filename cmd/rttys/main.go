@@ -7,14 +7,14 @@ package main
 
 import (
 	"context"
-	_ "net/http/pprof"
+	"fmt"
 	"os"
 	"runtime"
 	"runtime/debug"
 
+	"github.com/zhaojh329/rttys/v5"
 	xlog "github.com/zhaojh329/rttys/v5/log"
 
-	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
 )
@@ -64,6 +64,14 @@ func main() {
 				Name:  "http-proxy-redir-domain",
 				Usage: "domain for HTTP proxy set cookie",
 			},
+			&cli.StringFlag{
+				Name:  "http-proxy-mode",
+				Usage: "where to serve the HTTP proxy (port, path, subdomain)",
+			},
+			&cli.StringFlag{
+				Name:  "http-proxy-domain",
+				Usage: "parent domain of the HTTP proxy session subdomains",
+			},
 			&cli.StringFlag{
 				Name:    "token",
 				Aliases: []string{"t"},
@@ -94,6 +102,11 @@ func main() {
 				Name:  "pprof",
 				Usage: "enable pprof and listen on specified address (e.g. localhost:6060)",
 			},
+			&cli.IntFlag{
+				Name:  "drain-timeout",
+				Value: 30,
+				Usage: "seconds to wait for commands in flight on shutdown",
+			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"V"},
@@ -112,6 +125,21 @@ func main() {
 				Usage: "CA certificate to verify devices (mTLS)",
 			},
 		},
+		Commands: []*cli.Command{
+			tunnelCommand,
+			{
+				Name:  "config",
+				Usage: "config file helpers",
+				Commands: []*cli.Command{
+					{
+						Name:      "check",
+						Usage:     "validate the config and print the effective values",
+						ArgsUsage: "[file]",
+						Action:    cmdConfigCheck,
+					},
+				},
+			},
+		},
 		Action: cmdAction,
 	}
 
@@ -121,20 +149,26 @@ func main() {
 	}
 }
 
+// exitOnPanic logs the panic of the command and exits. The goroutines of
+// the server recover from theirs.
+func exitOnPanic() {
+	if r := recover(); r != nil {
+		log.Error().Msgf("%v", r)
+		log.Error().Msg(string(debug.Stack()))
+		os.Exit(2)
+	}
+}
+
 func cmdAction(c context.Context, cmd *cli.Command) error {
-	defer logPanic()
-
-	switch cmd.String("log-level") {
-	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	case "warn":
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	default:
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	defer exitOnPanic()
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
 	}
 
+	xlog.SetLevel(cfg.LogLevel)
+
 	if cmd.Bool("verbose") {
 		xlog.Verbose()
 	}
@@ -152,34 +186,59 @@ func cmdAction(c context.Context, cmd *cli.Command) error {
 		log.Info().Msg("Build Time: " + BuildTime)
 	}
 
-	if runtime.GOOS != "windows" {
-		go signalHandle()
-	}
+	srv := rttys.NewServer(cfg)
+	srv.SetConfigLoader(func() (rttys.Config, error) {
+		return loadConfig(cmd)
+	})
+
+	go signalHandle(srv)
 
-	cfg := Config{
-		AddrDev:   ":5912",
-		AddrUser:  ":5913",
-		LocalAuth: true,
+	lns, ready, err := inheritedListeners()
+	if err != nil {
+		return err
 	}
 
-	err := cfg.Parse(cmd)
+	if lns != nil {
+		log.Info().Msg("Serve on listeners inherited from the old process")
+		err = srv.StartWithListeners(lns[0], lns[1], lns[2])
+	} else {
+		err = srv.Start()
+	}
 	if err != nil {
 		return err
 	}
 
-	srv := &RttyServer{cfg: cfg}
+	if ready != nil {
+		ready()
+	}
 
-	return srv.Run()
+	sdNotify("READY=1")
+
+	srv.Wait()
+
+	return nil
 }
 
-func logPanic() {
-	if r := recover(); r != nil {
-		saveCrashLog(r, debug.Stack())
-		os.Exit(2)
-	}
+func loadConfig(cmd *cli.Command) (rttys.Config, error) {
+	cfg := rttys.DefaultConfig()
+	err := cfg.Parse(cmd)
+	return cfg, err
 }
 
-func saveCrashLog(p any, stack []byte) {
-	log.Error().Msgf("%v", p)
-	log.Error().Msg(string(stack))
+func cmdConfigCheck(c context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() > 0 {
+		if err := cmd.Set("conf", cmd.Args().First()); err != nil {
+			return err
+		}
+	}
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Configuration OK")
+	fmt.Print(cfg.String())
+
+	return nil
 }
@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/zhaojh329/rttys/v5"
+	xlog "github.com/zhaojh329/rttys/v5/log"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+func signalHandle(srv *rttys.RttyServer) {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+
+	shutdown := false
+
+	for s := range c {
+		switch s {
+		case syscall.SIGHUP:
+			log.Info().Msgf("Received %s, reloading config", s)
+			srv.ReloadConfig()
+
+		case syscall.SIGUSR1:
+			xlog.Verbose()
+			zerolog.SetGlobalLevel(zerolog.DebugLevel)
+			log.Debug().Msg("Debug mode enabled")
+
+		case syscall.SIGUSR2:
+			if shutdown {
+				continue
+			}
+
+			log.Info().Msgf("Received %s, upgrading", s)
+			upgrade(srv)
+
+		case syscall.SIGTERM, syscall.SIGINT:
+			if shutdown {
+				log.Warn().Msgf("Received %s again, stop immediately", s)
+				srv.Stop()
+				continue
+			}
+
+			log.Info().Msgf("Received %s, shutting down gracefully", s)
+			shutdown = true
+			go srv.Shutdown(context.Background())
+		}
+	}
+}
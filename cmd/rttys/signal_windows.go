@@ -0,0 +1,39 @@
+//go:build windows
+// +build windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+
+	"github.com/zhaojh329/rttys/v5"
+
+	"github.com/rs/zerolog/log"
+)
+
+func signalHandle(srv *rttys.RttyServer) {
+	c := make(chan os.Signal, 1)
+
+	signal.Notify(c, os.Interrupt)
+
+	shutdown := false
+
+	for s := range c {
+		if shutdown {
+			log.Warn().Msgf("Received %s again, stop immediately", s)
+			srv.Stop()
+			continue
+		}
+
+		log.Info().Msgf("Received %s, shutting down gracefully", s)
+		shutdown = true
+		go srv.Shutdown(context.Background())
+	}
+}
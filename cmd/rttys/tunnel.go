@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/urfave/cli/v3"
+)
+
+var tunnelCommand = &cli.Command{
+	Name:      "tunnel",
+	Usage:     "bridge stdin/stdout to a TCP port behind a device, e.g. for ssh ProxyCommand",
+	ArgsUsage: "http(s)://host:5913/tunnel/<group or ->/<devid>/<ip:port>",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:  "signin-user",
+			Usage: "username to sign in",
+		},
+		&cli.StringFlag{
+			Name:    "signin-password",
+			Usage:   "password to sign in",
+			Sources: cli.EnvVars("RTTYS_SIGNIN_PASSWORD"),
+		},
+		&cli.BoolFlag{
+			Name:  "insecure",
+			Usage: "don't verify the server certificate",
+		},
+	},
+	Action: cmdTunnel,
+}
+
+func cmdTunnel(c context.Context, cmd *cli.Command) error {
+	if cmd.Args().Len() != 1 {
+		return errors.New("tunnel URL is required")
+	}
+
+	u, err := url.Parse(cmd.Args().First())
+	if err != nil {
+		return err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cmd.Bool("insecure")}
+
+	jar, _ := cookiejar.New(nil)
+
+	if password := cmd.String("signin-password"); password != "" {
+		body, _ := jsoniter.Marshal(map[string]string{
+			"username": cmd.String("signin-user"),
+			"password": password,
+		})
+
+		cli := &http.Client{
+			Jar:       jar,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+
+		signin := *u
+		signin.Path = "/signin"
+
+		resp, err := cli.Post(signin.String(), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("sign in fail: %s", resp.Status)
+		}
+	}
+
+	dialer := &websocket.Dialer{
+		Jar:             jar,
+		TLSClientConfig: tlsConfig,
+	}
+
+	wsURL := *u
+	wsURL.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+
+	conn, resp, err := dialer.DialContext(c, wsURL.String(), nil)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v: %s", err, resp.Status)
+		}
+		return err
+	}
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 32*1024)
+
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			// Half close can't be relayed, keep reading until the
+			// peer closes
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		typ, r, err := conn.NextReader()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				return nil
+			}
+			return err
+		}
+
+		if typ != websocket.BinaryMessage {
+			continue
+		}
+
+		if _, err := io.Copy(os.Stdout, r); err != nil {
+			return err
+		}
+	}
+}
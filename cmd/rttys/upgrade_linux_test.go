@@ -0,0 +1,160 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/valyala/bytebufferpool"
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// The test binary runs as rttys when this is set
+const testMainEnv = "RTTYS_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+func registerDevice(addr, id string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	bb := bytebufferpool.Get()
+	defer bytebufferpool.Put(bb)
+
+	bb.WriteByte(5)
+
+	for typ, val := range map[byte][]byte{
+		proto.MsgRegAttrHeartbeat: {30},
+		proto.MsgRegAttrDevid:     []byte(id),
+	} {
+		bb.WriteByte(typ)
+		bb.B = binary.BigEndian.AppendUint16(bb.B, uint16(len(val)))
+		bb.Write(val)
+	}
+
+	msg := proto.NewMsgReaderWriter(proto.RoleRtty, conn)
+
+	msg.Write(proto.MsgTypeRegister, bb)
+
+	typ, data, err := msg.Read()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if typ != proto.MsgTypeRegister || data[0] != 0 {
+		conn.Close()
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return conn, nil
+}
+
+func deviceCount(addr string) string {
+	resp, err := http.Get("http://" + addr + "/counts")
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+
+	return strings.TrimSpace(string(b))
+}
+
+func TestUpgrade(t *testing.T) {
+	addrDev := freeAddr(t)
+	addrUser := freeAddr(t)
+
+	cmd := exec.Command(os.Args[0], "--addr-dev", addrDev, "--addr-user", addrUser,
+		"--addr-http-proxy", freeAddr(t))
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kill both the old and new process
+	defer syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+
+	var dev net.Conn
+	var err error
+
+	for range 50 {
+		time.Sleep(100 * time.Millisecond)
+		if dev, err = registerDevice(addrDev, "test"); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("register device: %v", err)
+	}
+	defer dev.Close()
+
+	if n := deviceCount(addrUser); n != `{"count":1}` {
+		t.Fatalf("unexpected count before upgrade: %s", n)
+	}
+
+	cmd.Process.Signal(syscall.SIGUSR2)
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// The idle device is disconnected by the old process
+	dev.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadAll(dev); err != nil {
+		t.Fatalf("device not disconnected by the old process: %v", err)
+	}
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Fatalf("old process exited with: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("old process not exited")
+	}
+
+	// The new process keeps listening on the same addresses
+	dev, err = registerDevice(addrDev, "test")
+	if err != nil {
+		t.Fatalf("register device to the new process: %v", err)
+	}
+	defer dev.Close()
+
+	if n := deviceCount(addrUser); n != `{"count":1}` {
+		t.Fatalf("unexpected count after upgrade: %s", n)
+	}
+}
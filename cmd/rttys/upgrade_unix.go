@@ -0,0 +1,166 @@
+//go:build !windows
+// +build !windows
+
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/zhaojh329/rttys/v5"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Set in the environment of the new process on upgrade. The listeners of
+// devices, users and HTTP proxy are passed as fd 3, 4 and 5, and fd 6 is a
+// pipe which the new process closes once it is ready to accept.
+const upgradeEnv = "RTTYS_UPGRADE"
+
+const upgradeReadyTimeout = 10 * time.Second
+
+// upgrade starts a new process of the current executable with the
+// listeners handed over, then lets the current process finish serving
+// the existing connections.
+func upgrade(srv *rttys.RttyServer) {
+	files, err := srv.ListenerFiles()
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade: get listener files fail")
+		return
+	}
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade: get executable fail")
+		return
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade: create pipe fail")
+		return
+	}
+	defer r.Close()
+
+	env := make([]string, 0)
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, upgradeEnv+"=") {
+			env = append(env, e)
+		}
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(env, upgradeEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, w)
+
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade: start new process fail")
+		return
+	}
+
+	log.Info().Msgf("upgrade: new process %d started, wait for it to be ready", cmd.Process.Pid)
+
+	if err := waitUpgradeReady(r); err != nil {
+		log.Error().Err(err).Msgf("upgrade: new process %d not ready, keep serving", cmd.Process.Pid)
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return
+	}
+
+	go cmd.Wait()
+
+	log.Info().Msgf("upgrade: new process %d is ready, hand over", cmd.Process.Pid)
+
+	go srv.Handover()
+}
+
+func waitUpgradeReady(r *os.File) error {
+	r.SetReadDeadline(time.Now().Add(upgradeReadyTimeout))
+
+	b := make([]byte, 1)
+
+	n, err := r.Read(b)
+	if n == 1 && b[0] == 'R' {
+		return nil
+	}
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return errors.New("timeout")
+	}
+
+	return errors.New("exited before ready")
+}
+
+// inheritedListeners returns the listeners handed over by the old process
+// on upgrade, and a func to notify it when the new one is ready.
+func inheritedListeners() ([]net.Listener, func(), error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil, nil
+	}
+
+	os.Unsetenv(upgradeEnv)
+
+	names := []string{"device", "user", "http-proxy"}
+	lns := make([]net.Listener, 0, len(names))
+
+	for i, name := range names {
+		f := os.NewFile(uintptr(3+i), name)
+
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, nil, fmt.Errorf("inherit %s listener: %w", name, err)
+		}
+
+		lns = append(lns, ln)
+	}
+
+	ready := os.NewFile(uintptr(3+len(names)), "upgrade-ready")
+
+	return lns, func() {
+		ready.Write([]byte{'R'})
+		ready.Close()
+		sdNotify(fmt.Sprintf("MAINPID=%d", os.Getpid()))
+	}, nil
+}
+
+// sdNotify sends a state to systemd if started as a notify service.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", addr)
+	if err != nil {
+		log.Error().Err(err).Msg("sd_notify fail")
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(state))
+}
@@ -8,10 +8,11 @@
 
 package main
 
-import (
-	"github.com/rs/zerolog/log"
-)
+import "net"
 
-func signalHandle() {
-	log.Debug().Msg("Signal handling not supported on Windows")
+func inheritedListeners() ([]net.Listener, func(), error) {
+	return nil, nil, nil
+}
+
+func sdNotify(state string) {
 }
@@ -0,0 +1,313 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// Outcomes of the filtered commands
+const (
+	cmdOutcomeBlocked   = "blocked"
+	cmdOutcomeConfirmed = "confirmed"
+	cmdOutcomeCanceled  = "canceled"
+)
+
+// Sent to the device instead of the Enter of a blocked or canceled
+// command, to kill the typed line.
+const cmdKillLine = 0x15
+
+type cmdLogEntry struct {
+	Time     time.Time `json:"time"`
+	Username string    `json:"username"`
+	Group    string    `json:"group"`
+	Devid    string    `json:"devid"`
+	Session  string    `json:"session"`
+	Command  string    `json:"command"`
+	Pattern  string    `json:"pattern"`
+	Outcome  string    `json:"outcome"`
+}
+
+// States of the escape sequences in the input
+const (
+	escNone = iota
+	escStart
+	escCSI
+	escSS3
+	escOSC
+	escOSCEsc
+)
+
+// cmdLine reconstructs the command line from the input of a terminal.
+// It can't follow the history, completion and cursor movement of the
+// shell, so the filter guards against mistakes rather than being a
+// security boundary.
+type cmdLine struct {
+	mu  sync.Mutex
+	buf []byte
+	esc int
+
+	// The command waiting for the confirmation of the user, with the
+	// Enter held back
+	pending string
+	rule    *CommandRule
+	enter   byte
+}
+
+// compile compiles the pattern of the rule, once by Validate
+func (rule *CommandRule) compile() error {
+	re, err := regexp.Compile(rule.Pattern)
+	if err != nil {
+		return err
+	}
+
+	rule.re = re
+
+	return nil
+}
+
+// cmdRule returns the first rule applying to the command of the user, or
+// nil if none.
+func (user *User) cmdRule(rules []CommandRule, line string) *CommandRule {
+	role := TermRoleUser
+	if user.admin {
+		role = TermRoleAdmin
+	}
+
+	for i := range rules {
+		rule := &rules[i]
+
+		if len(rule.Roles) > 0 && !slices.Contains(rule.Roles, role) {
+			continue
+		}
+
+		if len(rule.Groups) > 0 && !slices.Contains(rule.Groups, user.dev.group) {
+			continue
+		}
+
+		if rule.re.MatchString(line) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// feed follows the line with the input up to the first Enter. It returns
+// the index of the Enter and the line typed before it, or -1 if there's
+// no Enter. The escape sequences are skipped, an OSC up to BEL or ST. An
+// Enter ends any sequence, as the shell runs the line on it anyway.
+func (l *cmdLine) feed(data []byte) (int, string) {
+	for i, c := range data {
+		if c == '\r' || c == '\n' {
+			l.esc = escNone
+		}
+
+		switch l.esc {
+		case escOSCEsc:
+			if c == '\\' {
+				l.esc = escNone
+				continue
+			}
+			// Another sequence starts
+			fallthrough
+		case escStart:
+			switch c {
+			case '[':
+				l.esc = escCSI
+			case 'O':
+				l.esc = escSS3
+			case ']':
+				l.esc = escOSC
+			default:
+				l.esc = escNone
+			}
+			continue
+		case escCSI:
+			if c >= 0x40 && c <= 0x7e {
+				l.esc = escNone
+			}
+			continue
+		case escSS3:
+			l.esc = escNone
+			continue
+		case escOSC:
+			switch c {
+			case 0x07:
+				l.esc = escNone
+			case 0x1b:
+				l.esc = escOSCEsc
+			}
+			continue
+		}
+
+		switch {
+		case c == '\r' || c == '\n':
+			line := string(l.buf)
+			l.buf = l.buf[:0]
+			return i, line
+
+		case c == 0x7f || c == 0x08:
+			if len(l.buf) > 0 {
+				_, n := utf8.DecodeLastRune(l.buf)
+				l.buf = l.buf[:len(l.buf)-n]
+			}
+
+		case c == cmdKillLine || c == 0x03:
+			l.buf = l.buf[:0]
+
+		case c == 0x17:
+			// Delete the word before the cursor
+			n := len(l.buf)
+			for n > 0 && l.buf[n-1] == ' ' {
+				n--
+			}
+			for n > 0 && l.buf[n-1] != ' ' {
+				n--
+			}
+			l.buf = l.buf[:n]
+
+		case c == 0x1b:
+			l.esc = escStart
+
+		case c >= 0x20:
+			l.buf = append(l.buf, c)
+		}
+	}
+
+	return -1, ""
+}
+
+func (l *cmdLine) reset() {
+	l.buf = l.buf[:0]
+	l.esc = escNone
+	l.pending = ""
+}
+
+// filterInput follows the command line typed by the user, and checks it
+// against the rules on Enter. It returns the input to send to the device,
+// which is cut at the Enter of a blocked command or one to be confirmed.
+func (user *User) filterInput(data []byte) []byte {
+	rules := user.srv.config().CommandFilter.Rules
+
+	l := &user.cmd
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(rules) == 0 {
+		l.reset()
+		return data
+	}
+
+	// Typing again gives up the confirmation
+	var out []byte
+	if l.pending != "" {
+		user.logCommand(l.pending, l.rule, cmdOutcomeCanceled)
+		l.pending = ""
+		out = []byte{cmdKillLine}
+	}
+
+	for {
+		i, line := l.feed(data)
+		if i < 0 {
+			return append(out, data...)
+		}
+
+		rule := user.cmdRule(rules, line)
+		if rule == nil {
+			out = append(out, data[:i+1]...)
+			data = data[i+1:]
+			continue
+		}
+
+		if rule.Action == CommandActionConfirm {
+			l.pending = line
+			l.rule = rule
+			l.enter = data[i]
+			user.writeCmdMsg("commandConfirm", line)
+			return append(out, data[:i]...)
+		}
+
+		user.logCommand(line, rule, cmdOutcomeBlocked)
+		user.writeCmdMsg("commandBlocked", line)
+
+		return append(append(out, data[:i]...), cmdKillLine)
+	}
+}
+
+// confirmCommand returns the input to send to the device for the answer
+// of the user to the confirmation.
+func (user *User) confirmCommand(ok bool) []byte {
+	l := &user.cmd
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pending == "" {
+		return nil
+	}
+
+	line := l.pending
+	l.pending = ""
+
+	if ok {
+		user.logCommand(line, l.rule, cmdOutcomeConfirmed)
+		return []byte{l.enter}
+	}
+
+	user.logCommand(line, l.rule, cmdOutcomeCanceled)
+
+	return []byte{cmdKillLine}
+}
+
+func (user *User) writeCmdMsg(typ, line string) {
+	msg, _ := jsoniter.Marshal(map[string]string{"type": typ, "command": line})
+	user.WriteMsg(websocket.TextMessage, msg)
+}
+
+// logCommand logs the filtered command, and writes it to the file of
+// command-filter.log in JSON.
+func (user *User) logCommand(line string, rule *CommandRule, outcome string) {
+	e := &cmdLogEntry{
+		Time:     time.Now(),
+		Username: user.username,
+		Group:    user.dev.group,
+		Devid:    user.dev.id,
+		Session:  user.sid,
+		Command:  line,
+		Pattern:  rule.Pattern,
+		Outcome:  outcome,
+	}
+
+	ev := log.Info()
+	if outcome != cmdOutcomeConfirmed {
+		ev = log.Warn()
+	}
+
+	ev.Msgf("command '%s' of '%s' on device '%s' %s, rule '%s'",
+		e.Command, e.Username, e.Devid, e.Outcome, e.Pattern)
+
+	srv := user.srv
+	cfg := srv.config()
+
+	if cfg.CommandFilter.Log == "" {
+		return
+	}
+
+	b, _ := jsoniter.Marshal(e)
+	b = append(b, '\n')
+
+	srv.cmdLog.output(cfg.CommandFilter.Log, b)
+}
@@ -0,0 +1,267 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func newCmdFilterServer(rules ...CommandRule) *RttyServer {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			panic(err)
+		}
+	}
+
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{CommandFilter: CommandFilterConfig{Rules: rules}})
+	return srv
+}
+
+func TestFilterInput(t *testing.T) {
+	srv := newCmdFilterServer(
+		CommandRule{Pattern: `^\s*rm\s+-rf\s+/\s*$`},
+		CommandRule{Pattern: `^\s*reboot\b`, Action: CommandActionConfirm},
+		CommandRule{Pattern: `^\s*mtd\b`, Roles: []string{TermRoleUser}},
+		CommandRule{Pattern: `^\s*poweroff\b`, Groups: []string{"prod"}},
+	)
+
+	tests := []struct {
+		name    string
+		admin   bool
+		input   []string
+		want    string
+		pending string
+	}{
+		{"plain", false, []string{"ls -l\r"}, "ls -l\r", ""},
+		{"several lines", false, []string{"ls\rpwd\r"}, "ls\rpwd\r", ""},
+		{"no enter", false, []string{"rm -rf /"}, "rm -rf /", ""},
+		{"blocked", false, []string{"rm -rf /\r"}, "rm -rf /\x15", ""},
+		{"blocked by newline", false, []string{"rm -rf /\n"}, "rm -rf /\x15", ""},
+		{"blocked in chunks", false, []string{"rm -r", "f /", "\r"}, "rm -rf /\x15", ""},
+		{"blocked after a line", false, []string{"ls\rrm -rf /\rpwd\r"}, "ls\rrm -rf /\x15", ""},
+		{"backspace", false, []string{"rm -rf /x\x7f\r"}, "rm -rf /x\x7f\x15", ""},
+		{"multibyte backspace", false, []string{"rm -rf /é\x7f\r"}, "rm -rf /é\x7f\x15", ""},
+		{"kill line", false, []string{"ls\x15rm -rf /\r"}, "ls\x15rm -rf /\x15", ""},
+		{"ctrl-c", false, []string{"rm -rf /\x03"}, "rm -rf /\x03", ""},
+		{"ctrl-c then enter", false, []string{"rm -rf /\x03\r"}, "rm -rf /\x03\r", ""},
+		{"delete word", false, []string{"rm -rf /tmp\x17/\r"}, "rm -rf /tmp\x17/\x15", ""},
+		{"escape sequences", false, []string{"rm -rf \x1b[D\x1bOA/\r"}, "rm -rf \x1b[D\x1bOA/\x15", ""},
+		{"escape in chunks", false, []string{"rm -rf /\x1b", "[", "1;5D\r"}, "rm -rf /\x1b[1;5D\x15", ""},
+		{"osc bel", false, []string{"rm -rf \x1b]0;x\x07/\r"}, "rm -rf \x1b]0;x\x07/\x15", ""},
+		{"osc st", false, []string{"rm -rf \x1b]0;x\x1b\\/\r"}, "rm -rf \x1b]0;x\x1b\\/\x15", ""},
+		{"osc in chunks", false, []string{"rm -rf \x1b]", "0;title", "\x1b", "\\/\r"}, "rm -rf \x1b]0;title\x1b\\/\x15", ""},
+		{"osc then csi", false, []string{"rm -rf \x1b]0;x\x1b[D/\r"}, "rm -rf \x1b]0;x\x1b[D/\x15", ""},
+		{"enter ends an osc", false, []string{"rm -rf /\x1b]0;x\r"}, "rm -rf /\x1b]0;x\x15", ""},
+		{"enter ends a csi", false, []string{"rm -rf /\x1b[1\r"}, "rm -rf /\x1b[1\x15", ""},
+		{"role", true, []string{"mtd erase\r"}, "mtd erase\r", ""},
+		{"role blocked", false, []string{"mtd erase\r"}, "mtd erase\x15", ""},
+		{"other group", false, []string{"poweroff\r"}, "poweroff\r", ""},
+
+		{"confirm", false, []string{"reboot\r"}, "reboot", "reboot"},
+		{"confirm drops the rest", false, []string{"reboot\rls\r"}, "reboot", "reboot"},
+		{"typing cancels", false, []string{"reboot\r", "ls\r"}, "reboot\x15ls\r", ""},
+		{"typing confirms again", false, []string{"reboot\r", "reboot\r"}, "reboot\x15reboot", "reboot"},
+	}
+
+	for _, tt := range tests {
+		user := &User{srv: srv, admin: tt.admin, dev: &Device{id: "dev1", group: "test"}}
+
+		var got []byte
+		for _, in := range tt.input {
+			got = append(got, user.filterInput([]byte(in))...)
+		}
+
+		if string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+
+		if user.cmd.pending != tt.pending {
+			t.Errorf("%s: pending %q, want %q", tt.name, user.cmd.pending, tt.pending)
+		}
+	}
+}
+
+func TestFilterInputNoRules(t *testing.T) {
+	user := &User{srv: newCmdFilterServer(), dev: &Device{id: "dev1"}}
+	user.cmd.buf = []byte("rm -rf")
+	user.cmd.pending = "reboot"
+
+	if got := user.filterInput([]byte(" /\r")); string(got) != " /\r" {
+		t.Errorf("got %q, want the input", got)
+	}
+
+	if len(user.cmd.buf) != 0 || user.cmd.pending != "" {
+		t.Errorf("line %q pending %q left", user.cmd.buf, user.cmd.pending)
+	}
+}
+
+func TestConfirmCommand(t *testing.T) {
+	srv := newCmdFilterServer(CommandRule{Pattern: `^reboot$`, Action: CommandActionConfirm})
+
+	tests := []struct {
+		input string
+		ok    bool
+		want  string
+	}{
+		{"reboot\r", true, "\r"},
+		{"reboot\n", true, "\n"},
+		{"reboot\r", false, "\x15"},
+		{"ls\r", true, ""},
+	}
+
+	for _, tt := range tests {
+		user := &User{srv: srv, dev: &Device{id: "dev1"}}
+		user.filterInput([]byte(tt.input))
+
+		if got := user.confirmCommand(tt.ok); string(got) != tt.want {
+			t.Errorf("%q ok %v: got %q, want %q", tt.input, tt.ok, got, tt.want)
+		}
+
+		if got := user.confirmCommand(tt.ok); got != nil {
+			t.Errorf("%q ok %v: answered twice, got %q", tt.input, tt.ok, got)
+		}
+	}
+}
+
+// newTestBroadcast returns a broadcast to the devices, and the client end
+// of its websocket
+func newTestBroadcast(t *testing.T, srv *RttyServer, devs ...*Device) (*broadcast, *websocket.Conn) {
+	conns := make(chan *websocket.Conn, 1)
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _ := upgrader.Upgrade(w, r, nil)
+		conns <- conn
+	}))
+	t.Cleanup(hs.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hs.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	b := &broadcast{srv: srv, conn: <-conns, targets: map[string]*broadcastTarget{}}
+	t.Cleanup(func() { b.conn.Close() })
+
+	for _, dev := range devs {
+		bt := &broadcastTarget{user: &User{srv: srv, dev: dev, bcast: b}}
+		b.targets[dev.id] = bt
+	}
+
+	return b, client
+}
+
+func TestBroadcastFilterInput(t *testing.T) {
+	srv := newCmdFilterServer(
+		CommandRule{Pattern: `^reboot$`, Action: CommandActionConfirm, Groups: []string{"prod"}},
+		CommandRule{Pattern: `^reboot$`, Groups: []string{"lab"}},
+		CommandRule{Pattern: `^poweroff$`, Action: CommandActionConfirm, Groups: []string{"prod"}},
+	)
+
+	prod := &Device{id: "prod1", group: "prod"}
+	lab := &Device{id: "lab1", group: "lab"}
+	test := &Device{id: "test1", group: "test"}
+
+	b, client := newTestBroadcast(t, srv, prod, lab, test)
+
+	all := []*broadcastTarget{b.targets["prod1"], b.targets["lab1"], b.targets["test1"]}
+
+	input := func(targets []*broadcastTarget, data string) map[string]string {
+		out := map[string]string{}
+		for bt, data := range b.filterInput(targets, []byte(data)) {
+			out[bt.user.dev.id] = string(data)
+		}
+		return out
+	}
+
+	readMsg := func() map[string]any {
+		client.SetReadDeadline(time.Now().Add(time.Second))
+
+		_, data, err := client.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+
+		msg := map[string]any{}
+		jsoniter.Unmarshal(data, &msg)
+
+		return msg
+	}
+
+	checkOut := func(name string, got, want map[string]string) {
+		if len(got) != len(want) {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+			return
+		}
+		for devid, data := range want {
+			if got[devid] != data {
+				t.Errorf("%s: got %q, want %q", name, got, want)
+				return
+			}
+		}
+	}
+
+	checkMsg := func(name, typ string, devids ...string) {
+		msg := readMsg()
+
+		got := []string{}
+		for _, id := range msg["devids"].([]any) {
+			got = append(got, id.(string))
+		}
+
+		if msg["type"] != typ || !slices.Equal(got, devids) {
+			t.Errorf("%s: got message %v, want %s for %v", name, msg, typ, devids)
+		}
+	}
+
+	// Nothing matched
+	checkOut("plain", input(all, "ls\r"), map[string]string{"prod1": "ls\r", "lab1": "ls\r", "test1": "ls\r"})
+
+	// Blocked on one, to be confirmed on another: blocked on all, rather
+	// than run on some
+	checkOut("blocked", input(all, "reboot\r"),
+		map[string]string{"prod1": "reboot\x15", "lab1": "reboot\x15", "test1": "reboot\x15"})
+	checkMsg("blocked", "commandBlocked", "lab1", "prod1")
+
+	// To be confirmed on one: held back on all, with one prompt
+	checkOut("confirm", input(all, "poweroff\r"),
+		map[string]string{"prod1": "poweroff", "lab1": "poweroff", "test1": "poweroff"})
+	checkMsg("confirm", "commandConfirm", "prod1")
+
+	if b.cmd.pending != "poweroff" {
+		t.Errorf("confirm: pending %q", b.cmd.pending)
+	}
+
+	out := map[string]string{}
+	for bt, data := range b.confirmCommand(true) {
+		out[bt.user.dev.id] = string(data)
+	}
+	checkOut("confirmed", out, map[string]string{"prod1": "\r", "lab1": "\r", "test1": "\r"})
+
+	if b.confirmCommand(true) != nil {
+		t.Error("confirmed twice")
+	}
+
+	// Typing again cancels on all the sessions held back, even the ones
+	// disabled since
+	input(all, "poweroff\r")
+	readMsg()
+
+	checkOut("canceled", input(all[:1], "ls\r"),
+		map[string]string{"prod1": "\x15ls\r", "lab1": "\x15", "test1": "\x15"})
+
+	// Only the enabled sessions are checked
+	checkOut("disabled", input(all[2:], "reboot\r"), map[string]string{"test1": "reboot\r"})
+}
@@ -3,119 +3,934 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 
-	"github.com/kylelemons/go-gypsy/yaml"
+	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
+	"gopkg.in/yaml.v3"
 )
 
+// Prefix of the environment variables which override the config file,
+// e.g. RTTYS_DEVICE_ADDR for device.addr
+const configEnvPrefix = "RTTYS_"
+
 type Config struct {
-	AddrDev       string
-	AddrUser      string
-	AddrHttpProxy string
+	LogLevel string `yaml:"log-level"`
+	Pprof    string `yaml:"pprof"`
+
+	// Seconds to wait for commands in flight on graceful shutdown
+	DrainTimeout int `yaml:"drain-timeout"`
+
+	Device    DeviceConfig    `yaml:"device"`
+	User      UserConfig      `yaml:"user"`
+	Term      TermConfig      `yaml:"term"`
+	HttpProxy HttpProxyConfig `yaml:"http-proxy"`
+	Tunnel    TunnelConfig    `yaml:"tunnel"`
+	RateLimit RateLimitConfig `yaml:"rate-limit"`
+
+	FileTransfer  FileTransferConfig  `yaml:"file-transfer"`
+	CommandFilter CommandFilterConfig `yaml:"command-filter"`
+	Recording     RecordingConfig     `yaml:"recording"`
+	Share         ShareConfig         `yaml:"share"`
+}
 
-	HttpProxyRedirURL    string
-	HttpProxyRedirDomain string
+type DeviceConfig struct {
+	Addr string `yaml:"addr"`
 
-	Token        string
-	DevHookUrl   string
-	UserHookUrl  string
-	LocalAuth    bool
-	Password     string
-	AllowOrigins bool
+	// Devices must provide one of the tokens if not empty
+	Tokens []string `yaml:"tokens"`
 
-	PprofAddr string
+	HookUrl string `yaml:"hook-url"`
 
-	SslCert string
-	SslKey  string
-	CaCert  string
+	// Devices are only accepted from these networks if not empty
+	AllowedCIDRs []string `yaml:"allowed-cidrs"`
+
+	SSL SSLConfig `yaml:"ssl"`
 }
 
-func (cfg *Config) Parse(c *cli.Command) error {
-	var yamlCfg *yaml.File
-	var err error
+type SSLConfig struct {
+	Cert   string `yaml:"cert"`
+	Key    string `yaml:"key"`
+	CaCert string `yaml:"cacert"`
+}
+
+type UserConfig struct {
+	Addr string `yaml:"addr"`
+
+	// Password for signing in without a username
+	Password string `yaml:"password"`
+
+	Users []UserAccount `yaml:"users"`
+
+	// Need auth for local requests
+	LocalAuth bool `yaml:"local-auth"`
+
+	AllowOrigins bool   `yaml:"allow-origins"`
+	HookUrl      string `yaml:"hook-url"`
+
+	// Users are only accepted from these networks if not empty
+	AllowedCIDRs []string `yaml:"allowed-cidrs"`
+
+	// File the API tokens are saved to, kept in memory only if empty
+	APITokenFile string `yaml:"api-token-file"`
+}
+
+type UserAccount struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Admin    bool   `yaml:"admin"`
+}
+
+func (cfg *UserConfig) authRequired() bool {
+	return cfg.Password != "" || len(cfg.Users) > 0
+}
 
-	conf := c.String("conf")
-	if conf != "" {
-		yamlCfg, err = yaml.ReadFile(conf)
-		if err != nil {
-			return fmt.Errorf(`read config file: %s`, err.Error())
+// hasUser reports whether the user is configured
+func (cfg *UserConfig) hasUser(username string) bool {
+	for _, user := range cfg.Users {
+		if user.Username == username {
+			return true
 		}
+	}
+
+	return false
+}
+
+// checkPassword checks the password of the user, or the global
+// password if username is empty. Signing in without a username is
+// possible only with a global password set.
+func (cfg *UserConfig) checkPassword(username, password string) bool {
+	if username == "" {
+		return cfg.Password != "" && cfg.Password == password
+	}
 
+	for _, user := range cfg.Users {
+		if user.Username == username {
+			return user.Password == password
+		}
 	}
 
-	fields := map[string]any{
-		"addr-dev":        &cfg.AddrDev,
-		"addr-user":       &cfg.AddrUser,
-		"addr-http-proxy": &cfg.AddrHttpProxy,
+	return false
+}
+
+type TermConfig struct {
+	// Seconds a terminal session is kept after its websocket is lost, to
+	// be reattached. Sessions are not detachable if 0
+	DetachTimeout int `yaml:"detach-timeout"`
+
+	// Bytes of the recent output replayed on reattach
+	BufferSize int `yaml:"buffer-size"`
+
+	// Seconds without input before a session is closed, 0 to disable
+	IdleTimeout int `yaml:"idle-timeout"`
+
+	// Maximum seconds a session lives, 0 for unlimited
+	Lifetime int `yaml:"lifetime"`
+
+	// Seconds to warn the user before a session is closed
+	Warning int `yaml:"warning"`
+
+	// Maximum sessions to each device, including the detached ones.
+	// 0 for unlimited
+	MaxPerDevice int `yaml:"max-per-device"`
+
+	// Maximum sessions of each user, counted by the client IP if signed
+	// in without a username. 0 for unlimited
+	MaxPerUser int `yaml:"max-per-user"`
+
+	// Maximum sessions of the server, 0 for unlimited
+	MaxSessions int `yaml:"max-sessions"`
+
+	// Maximum sessions waiting for the device to login, for each device.
+	// 0 for unlimited
+	MaxPending int `yaml:"max-pending"`
+
+	// Limits of the sessions to the devices in a group, which replace the
+	// default ones
+	Groups map[string]TermLimits `yaml:"groups"`
+
+	// Limits of the sessions of the admin and user roles, which replace the
+	// default ones. The shorter is used if both a group and a role apply
+	Roles map[string]TermLimits `yaml:"roles"`
+}
+
+type TermLimits struct {
+	IdleTimeout int `yaml:"idle-timeout"`
+	Lifetime    int `yaml:"lifetime"`
+}
+
+// Roles of the terminal limits
+const (
+	TermRoleAdmin = "admin"
+	TermRoleUser  = "user"
+)
+
+// Where the HTTP proxy is served
+const (
+	// On the separate http-proxy.addr listener, the session is in a cookie
+	HttpProxyModePort = "port"
+	// On the separate http-proxy.addr listener under /proxy/<sid>/
+	HttpProxyModePath = "path"
+	// On the user listener under <sid>.<http-proxy.domain>
+	HttpProxyModeSubdomain = "subdomain"
+)
+
+type HttpProxyConfig struct {
+	// Automatically select an available port if empty
+	Addr string `yaml:"addr"`
+
+	Mode string `yaml:"mode"`
+
+	// Parent domain of the session subdomains in subdomain mode
+	Domain string `yaml:"domain"`
+
+	// Seconds a session is kept without being used
+	SessionIdleTimeout int `yaml:"session-idle-timeout"`
+
+	// Maximum seconds a session lives since created, 0 for unlimited
+	SessionLifetime int `yaml:"session-lifetime"`
+
+	// Only accept a session from the client IP which created it
+	SessionBindIP bool `yaml:"session-bind-ip"`
+
+	RedirURL    string `yaml:"redir-url"`
+	RedirDomain string `yaml:"redir-domain"`
+
+	// File the proxied requests are logged to, "-" for stdout, disabled if empty
+	AccessLog string `yaml:"access-log"`
+
+	// Format of the access log: combined or json
+	AccessLogFormat string `yaml:"access-log-format"`
+}
+
+// Formats of the HTTP proxy access log
+const (
+	AccessLogFormatCombined = "combined"
+	AccessLogFormatJSON     = "json"
+)
+
+type TunnelConfig struct {
+	// Host the tunnel listeners bind to, the loopback if empty. Binding
+	// all the interfaces must be asked for by "0.0.0.0" or "::". Only the
+	// client IP which opened a tunnel may connect to its port.
+	ListenHost string `yaml:"listen-host"`
+
+	// Seconds without traffic before a tunnel is closed, 0 to disable
+	IdleTimeout int `yaml:"idle-timeout"`
+
+	// Maximum tunnels per user, 0 for unlimited
+	MaxPerUser int `yaml:"max-per-user"`
+}
+
+type RateLimitConfig struct {
+	Default RateLimits `yaml:"default"`
+
+	// Limits of the devices in a group, which replace the default ones
+	Groups map[string]RateLimits `yaml:"groups"`
+}
+
+// Bytes per second, 0 for unlimited. The terminal sessions and file
+// transfers are limited in both directions. The HTTP proxy and tunnels
+// are limited toward the device only: the device sends their data
+// without flow control, so it can't be told to hold them back.
+type RateLimits struct {
+	// Total of a device, not counting the HTTP proxy and tunnel data
+	// from the device
+	Device int `yaml:"device"`
+
+	// Each terminal session
+	User int `yaml:"user"`
+
+	// Each HTTP proxy session, toward the device
+	HttpProxy int `yaml:"http-proxy"`
+
+	// Each tunnel, toward the device
+	Tunnel int `yaml:"tunnel"`
+}
+
+type FileTransferConfig struct {
+	// File each transfer is logged to in JSON, "-" for stdout, disabled if empty
+	Log string `yaml:"log"`
+
+	Default FilePolicy `yaml:"default"`
+
+	// Policies of the devices in a group, which replace the default one
+	Groups map[string]FilePolicy `yaml:"groups"`
+}
+
+// Directions of the file transfers allowed by a policy, upload is from
+// the user to the device.
+const (
+	FileDirectionBoth     = "both"
+	FileDirectionUpload   = "upload"
+	FileDirectionDownload = "download"
+	FileDirectionNone     = "none"
+)
+
+type FilePolicy struct {
+	// Maximum bytes of a file, 0 for unlimited
+	MaxSize int `yaml:"max-size"`
+
+	// One of both, upload, download and none, both if empty
+	Direction string `yaml:"direction"`
 
-		"http-proxy-redir-url":    &cfg.HttpProxyRedirURL,
-		"http-proxy-redir-domain": &cfg.HttpProxyRedirDomain,
+	// Glob patterns of which the file name must match one if not empty
+	Names []string `yaml:"names"`
+}
+
+type CommandFilterConfig struct {
+	// File each blocked or confirmed command is logged to in JSON, "-" for
+	// stdout, disabled if empty
+	Log string `yaml:"log"`
+
+	// Rules checked in order when Enter is typed in a terminal, the first
+	// one matching the command line applies
+	Rules []CommandRule `yaml:"rules"`
+}
+
+// Actions of the command rules
+const (
+	CommandActionBlock   = "block"
+	CommandActionConfirm = "confirm"
+)
+
+type CommandRule struct {
+	// Regular expression matched against the command line
+	Pattern string `yaml:"pattern"`
+
+	// One of block and confirm, block if empty
+	Action string `yaml:"action"`
+
+	// Roles of the users the rule applies to, all if empty
+	Roles []string `yaml:"roles"`
+
+	// Groups of the devices the rule applies to, all if empty
+	Groups []string `yaml:"groups"`
 
-		"token":         &cfg.Token,
-		"dev-hook-url":  &cfg.DevHookUrl,
-		"user-hook-url": &cfg.UserHookUrl,
-		"local-auth":    &cfg.LocalAuth,
-		"password":      &cfg.Password,
-		"allow-origins": &cfg.AllowOrigins,
+	// Pattern compiled by Validate
+	re *regexp.Regexp
+}
+
+type RecordingConfig struct {
+	// Directory the output of the terminal sessions is recorded to, with
+	// the escape sequences stripped, to be searched. Disabled if empty
+	Dir string `yaml:"dir"`
+
+	// Days the recordings are kept, 0 for forever
+	Retention int `yaml:"retention"`
+}
+
+type ShareConfig struct {
+	// Maximum seconds a share link is valid, sharing is disabled if 0
+	MaxExpire int `yaml:"max-expire"`
 
-		"pprof": &cfg.PprofAddr,
+	// Maximum guests viewing a share at once, 0 for unlimited
+	MaxViewers int `yaml:"max-viewers"`
+}
+
+// The flat options used before the config was split into sections.
+// They are still accepted in the config file, but deprecated.
+type legacyConfig struct {
+	AddrDev              *string `yaml:"addr-dev"`
+	AddrUser             *string `yaml:"addr-user"`
+	AddrHttpProxy        *string `yaml:"addr-http-proxy"`
+	HttpProxyRedirURL    *string `yaml:"http-proxy-redir-url"`
+	HttpProxyRedirDomain *string `yaml:"http-proxy-redir-domain"`
+	Token                *string `yaml:"token"`
+	DevHookUrl           *string `yaml:"dev-hook-url"`
+	UserHookUrl          *string `yaml:"user-hook-url"`
+	LocalAuth            *bool   `yaml:"local-auth"`
+	Password             *string `yaml:"password"`
+	AllowOrigins         *bool   `yaml:"allow-origins"`
+	SslCert              *string `yaml:"sslcert"`
+	SslKey               *string `yaml:"sslkey"`
+	CaCert               *string `yaml:"cacert"`
+}
+
+type configFile struct {
+	Config `yaml:",inline"`
+	Legacy legacyConfig `yaml:",inline"`
+}
 
-		"sslcert": &cfg.SslCert,
-		"sslkey":  &cfg.SslKey,
-		"cacert":  &cfg.CaCert,
+func DefaultConfig() Config {
+	return Config{
+		LogLevel:     "info",
+		DrainTimeout: 30,
+		Device: DeviceConfig{
+			Addr: ":5912",
+		},
+		User: UserConfig{
+			Addr:      ":5913",
+			LocalAuth: true,
+		},
+		Term: TermConfig{
+			BufferSize: 64 * 1024,
+			Warning:    60,
+		},
+		HttpProxy: HttpProxyConfig{
+			Mode:               HttpProxyModePort,
+			SessionIdleTimeout: 900,
+			SessionBindIP:      true,
+			AccessLogFormat:    AccessLogFormatCombined,
+		},
+		Tunnel: TunnelConfig{
+			ListenHost:  defaultTunnelListenHost,
+			IdleTimeout: 600,
+			MaxPerUser:  10,
+		},
+		Share: ShareConfig{
+			MaxExpire:  86400,
+			MaxViewers: 10,
+		},
 	}
+}
 
-	for name, opt := range fields {
-		if yamlCfg != nil {
-			if err = getConfigOpt(yamlCfg, name, opt); err != nil {
-				return err
-			}
+// Parse loads the config file given by the "conf" flag, then applies the
+// environment variables and the flags, and validates the result.
+func (cfg *Config) Parse(c *cli.Command) error {
+	if conf := c.String("conf"); conf != "" {
+		if err := cfg.LoadFile(conf); err != nil {
+			return err
 		}
+	}
+
+	if err := cfg.LoadEnv(); err != nil {
+		return err
+	}
 
+	for name, opt := range cfg.flags() {
 		getFlagOpt(c, name, opt)
 	}
 
+	return cfg.Validate()
+}
+
+// LoadFile loads a YAML config file. Unknown options are reported as errors.
+func (cfg *Config) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	defer f.Close()
+
+	file := configFile{Config: *cfg}
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	err = dec.Decode(&file)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("parse config file '%s': %w", name, err)
+	}
+
+	*cfg = file.Config
+
+	cfg.applyLegacy(&file.Legacy)
+
 	return nil
 }
 
-func getConfigOpt(yamlCfg *yaml.File, name string, opt any) error {
-	var err error
+func (cfg *Config) applyLegacy(legacy *legacyConfig) {
+	opts := []struct {
+		name string
+		opt  any
+		dst  any
+	}{
+		{"addr-dev", legacy.AddrDev, &cfg.Device.Addr},
+		{"addr-user", legacy.AddrUser, &cfg.User.Addr},
+		{"addr-http-proxy", legacy.AddrHttpProxy, &cfg.HttpProxy.Addr},
+		{"http-proxy-redir-url", legacy.HttpProxyRedirURL, &cfg.HttpProxy.RedirURL},
+		{"http-proxy-redir-domain", legacy.HttpProxyRedirDomain, &cfg.HttpProxy.RedirDomain},
+		{"token", legacy.Token, &cfg.Device.Tokens},
+		{"dev-hook-url", legacy.DevHookUrl, &cfg.Device.HookUrl},
+		{"user-hook-url", legacy.UserHookUrl, &cfg.User.HookUrl},
+		{"local-auth", legacy.LocalAuth, &cfg.User.LocalAuth},
+		{"password", legacy.Password, &cfg.User.Password},
+		{"allow-origins", legacy.AllowOrigins, &cfg.User.AllowOrigins},
+		{"sslcert", legacy.SslCert, &cfg.Device.SSL.Cert},
+		{"sslkey", legacy.SslKey, &cfg.Device.SSL.Key},
+		{"cacert", legacy.CaCert, &cfg.Device.SSL.CaCert},
+	}
 
-	switch opt := opt.(type) {
-	case *string:
-		var val string
-		val, err = yamlCfg.Get(name)
-		if err == nil {
-			*opt = val
+	for _, o := range opts {
+		switch opt := o.opt.(type) {
+		case *string:
+			if opt == nil {
+				continue
+			}
+			switch dst := o.dst.(type) {
+			case *string:
+				*dst = *opt
+			case *[]string:
+				*dst = []string{*opt}
+			}
+		case *bool:
+			if opt == nil {
+				continue
+			}
+			*o.dst.(*bool) = *opt
 		}
-	case *int:
-		var val int64
-		val, err = yamlCfg.GetInt(name)
-		if err == nil {
-			*opt = int(val)
+
+		log.Warn().Msgf("config option '%s' is deprecated, use '%s' instead", o.name, cfg.optName(o.dst))
+	}
+}
+
+// LoadEnv overrides the options with the environment variables named
+// by the option path, e.g. RTTYS_USER_LOCAL_AUTH for user.local-auth.
+// Lists are separated by commas.
+func (cfg *Config) LoadEnv() error {
+	var errs []error
+
+	cfg.walk(func(name string, v reflect.Value) {
+		env := configEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+
+		val, ok := os.LookupEnv(env)
+		if !ok {
+			return
 		}
-	case *bool:
-		var val bool
-		val, err = yamlCfg.GetBool(name)
-		if err == nil {
-			*opt = val
+
+		switch v.Kind() {
+		case reflect.String:
+			v.SetString(val)
+		case reflect.Int:
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid integer '%s'", env, val))
+				return
+			}
+			v.SetInt(int64(n))
+		case reflect.Bool:
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid boolean '%s'", env, val))
+				return
+			}
+			v.SetBool(b)
+		case reflect.Slice:
+			if v.Type().Elem().Kind() != reflect.String {
+				errs = append(errs, fmt.Errorf("%s: not supported by environment variable", env))
+				return
+			}
+			list := []string{}
+			for item := range strings.SplitSeq(val, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			v.Set(reflect.ValueOf(list))
+		case reflect.Map:
+			errs = append(errs, fmt.Errorf("%s: not supported by environment variable", env))
 		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// Validate checks the values of all options.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	invalid := func(name string, format string, a ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", name, fmt.Sprintf(format, a...)))
+	}
+
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
 	default:
-		return fmt.Errorf("unsupported type for option %s", name)
+		invalid("log-level", "must be one of debug, info, warn and error, got '%s'", cfg.LogLevel)
 	}
 
-	if err != nil {
-		if _, ok := err.(*yaml.NodeNotFound); ok {
-			return nil
+	if cfg.DrainTimeout < 0 {
+		invalid("drain-timeout", "must not be negative")
+	}
+
+	if cfg.Term.DetachTimeout < 0 {
+		invalid("term.detach-timeout", "must not be negative")
+	}
+
+	if cfg.Term.BufferSize <= 0 {
+		invalid("term.buffer-size", "must be positive")
+	}
+
+	if cfg.Term.Warning < 0 {
+		invalid("term.warning", "must not be negative")
+	}
+
+	if cfg.Term.MaxPerDevice < 0 {
+		invalid("term.max-per-device", "must not be negative")
+	}
+
+	if cfg.Term.MaxPerUser < 0 {
+		invalid("term.max-per-user", "must not be negative")
+	}
+
+	if cfg.Term.MaxSessions < 0 {
+		invalid("term.max-sessions", "must not be negative")
+	}
+
+	if cfg.Term.MaxPending < 0 {
+		invalid("term.max-pending", "must not be negative")
+	}
+
+	termLimits := map[string]TermLimits{"term": {cfg.Term.IdleTimeout, cfg.Term.Lifetime}}
+
+	for group, limits := range cfg.Term.Groups {
+		termLimits[fmt.Sprintf("term.groups[%s]", group)] = limits
+	}
+
+	for role, limits := range cfg.Term.Roles {
+		name := fmt.Sprintf("term.roles[%s]", role)
+
+		if role != TermRoleAdmin && role != TermRoleUser {
+			invalid(name, "role must be admin or user")
 		}
-		return fmt.Errorf(`invalud "%s": %w`, name, err)
+
+		termLimits[name] = limits
 	}
 
-	return nil
+	for name, limits := range termLimits {
+		if limits.IdleTimeout < 0 || limits.Lifetime < 0 {
+			invalid(name, "idle-timeout and lifetime must not be negative")
+		}
+	}
+
+	if cfg.HttpProxy.SessionIdleTimeout <= 0 {
+		invalid("http-proxy.session-idle-timeout", "must be positive")
+	}
+
+	if cfg.HttpProxy.SessionLifetime < 0 {
+		invalid("http-proxy.session-lifetime", "must not be negative")
+	}
+
+	if cfg.Tunnel.IdleTimeout < 0 {
+		invalid("tunnel.idle-timeout", "must not be negative")
+	}
+
+	if cfg.Tunnel.MaxPerUser < 0 {
+		invalid("tunnel.max-per-user", "must not be negative")
+	}
+
+	rateLimits := map[string]RateLimits{"rate-limit.default": cfg.RateLimit.Default}
+
+	for group, limits := range cfg.RateLimit.Groups {
+		rateLimits[fmt.Sprintf("rate-limit.groups[%s]", group)] = limits
+	}
+
+	for name, limits := range rateLimits {
+		if limits.Device < 0 || limits.User < 0 || limits.HttpProxy < 0 || limits.Tunnel < 0 {
+			invalid(name, "must not be negative")
+		}
+	}
+
+	filePolicies := map[string]FilePolicy{"file-transfer.default": cfg.FileTransfer.Default}
+
+	for group, policy := range cfg.FileTransfer.Groups {
+		filePolicies[fmt.Sprintf("file-transfer.groups[%s]", group)] = policy
+	}
+
+	for name, policy := range filePolicies {
+		if policy.MaxSize < 0 {
+			invalid(name+".max-size", "must not be negative")
+		}
+
+		switch policy.Direction {
+		case "", FileDirectionBoth, FileDirectionUpload, FileDirectionDownload, FileDirectionNone:
+		default:
+			invalid(name+".direction", "must be one of both, upload, download and none, got '%s'", policy.Direction)
+		}
+
+		for i, pattern := range policy.Names {
+			if _, err := path.Match(pattern, ""); err != nil {
+				invalid(fmt.Sprintf("%s.names[%d]", name, i), "invalid pattern '%s'", pattern)
+			}
+		}
+	}
+
+	for i := range cfg.CommandFilter.Rules {
+		rule := &cfg.CommandFilter.Rules[i]
+		name := fmt.Sprintf("command-filter.rules[%d]", i)
+
+		if rule.Pattern == "" {
+			invalid(name+".pattern", "must not be empty")
+		} else if err := rule.compile(); err != nil {
+			invalid(name+".pattern", "invalid regular expression '%s'", rule.Pattern)
+		}
+
+		switch rule.Action {
+		case "", CommandActionBlock, CommandActionConfirm:
+		default:
+			invalid(name+".action", "must be one of block and confirm, got '%s'", rule.Action)
+		}
+
+		for _, role := range rule.Roles {
+			if role != TermRoleAdmin && role != TermRoleUser {
+				invalid(name+".roles", "role must be admin or user, got '%s'", role)
+			}
+		}
+	}
+
+	if cfg.Recording.Retention < 0 {
+		invalid("recording.retention", "must not be negative")
+	}
+
+	if cfg.Share.MaxExpire < 0 {
+		invalid("share.max-expire", "must not be negative")
+	}
+
+	if cfg.Share.MaxViewers < 0 {
+		invalid("share.max-viewers", "must not be negative")
+	}
+
+	if h := cfg.Tunnel.ListenHost; h != "" {
+		if _, err := netip.ParseAddr(h); err != nil && !isValidHostname(h) {
+			invalid("tunnel.listen-host", "invalid host '%s'", h)
+		}
+	}
+
+	addrs := []struct {
+		name     string
+		addr     string
+		optional bool
+	}{
+		{"pprof", cfg.Pprof, true},
+		{"device.addr", cfg.Device.Addr, false},
+		{"user.addr", cfg.User.Addr, false},
+		{"http-proxy.addr", cfg.HttpProxy.Addr, true},
+	}
+
+	for _, a := range addrs {
+		if a.addr == "" {
+			if !a.optional {
+				invalid(a.name, "is required")
+			}
+			continue
+		}
+
+		if _, _, err := net.SplitHostPort(a.addr); err != nil {
+			invalid(a.name, "invalid address '%s'", a.addr)
+		}
+	}
+
+	urls := map[string]string{
+		"device.hook-url":      cfg.Device.HookUrl,
+		"user.hook-url":        cfg.User.HookUrl,
+		"http-proxy.redir-url": cfg.HttpProxy.RedirURL,
+	}
+
+	for name, val := range urls {
+		if val == "" {
+			continue
+		}
+
+		u, err := url.Parse(val)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid(name, "invalid http(s) URL '%s'", val)
+		}
+	}
+
+	if (cfg.Device.SSL.Cert == "") != (cfg.Device.SSL.Key == "") {
+		invalid("device.ssl", "cert and key must be set together")
+	}
+
+	if cfg.Device.SSL.CaCert != "" && cfg.Device.SSL.Cert == "" {
+		invalid("device.ssl.cacert", "requires cert and key")
+	}
+
+	switch cfg.HttpProxy.Mode {
+	case "", HttpProxyModePort, HttpProxyModePath:
+	case HttpProxyModeSubdomain:
+		if cfg.HttpProxy.Domain == "" {
+			invalid("http-proxy.domain", "is required in subdomain mode")
+		} else if !isValidHostname(cfg.HttpProxy.Domain) {
+			invalid("http-proxy.domain", "invalid domain '%s'", cfg.HttpProxy.Domain)
+		}
+	default:
+		invalid("http-proxy.mode", "must be one of port, path and subdomain, got '%s'", cfg.HttpProxy.Mode)
+	}
+
+	switch cfg.HttpProxy.AccessLogFormat {
+	case "", AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		invalid("http-proxy.access-log-format", "must be one of combined and json, got '%s'", cfg.HttpProxy.AccessLogFormat)
+	}
+
+	for i, token := range cfg.Device.Tokens {
+		if token == "" {
+			invalid(fmt.Sprintf("device.tokens[%d]", i), "must not be empty")
+		}
+	}
+
+	cidrs := map[string][]string{
+		"device.allowed-cidrs": cfg.Device.AllowedCIDRs,
+		"user.allowed-cidrs":   cfg.User.AllowedCIDRs,
+	}
+
+	for name, list := range cidrs {
+		for i, cidr := range list {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				invalid(fmt.Sprintf("%s[%d]", name, i), "invalid CIDR '%s'", cidr)
+			}
+		}
+	}
+
+	usernames := map[string]bool{}
+
+	for i, user := range cfg.User.Users {
+		name := fmt.Sprintf("user.users[%d]", i)
+
+		if user.Username == "" {
+			invalid(name, "username is required")
+		} else if usernames[user.Username] {
+			invalid(name, "duplicate username '%s'", user.Username)
+		}
+
+		if user.Password == "" {
+			invalid(name, "password is required")
+		}
+
+		usernames[user.Username] = true
+	}
+
+	return errors.Join(errs...)
+}
+
+// flags maps the command line flags to the options.
+func (cfg *Config) flags() map[string]any {
+	return map[string]any{
+		"log-level":     &cfg.LogLevel,
+		"pprof":         &cfg.Pprof,
+		"drain-timeout": &cfg.DrainTimeout,
+
+		"addr-dev":     &cfg.Device.Addr,
+		"token":        &cfg.Device.Tokens,
+		"dev-hook-url": &cfg.Device.HookUrl,
+		"sslcert":      &cfg.Device.SSL.Cert,
+		"sslkey":       &cfg.Device.SSL.Key,
+		"cacert":       &cfg.Device.SSL.CaCert,
+
+		"addr-user":     &cfg.User.Addr,
+		"password":      &cfg.User.Password,
+		"local-auth":    &cfg.User.LocalAuth,
+		"allow-origins": &cfg.User.AllowOrigins,
+		"user-hook-url": &cfg.User.HookUrl,
+
+		"addr-http-proxy":         &cfg.HttpProxy.Addr,
+		"http-proxy-redir-url":    &cfg.HttpProxy.RedirURL,
+		"http-proxy-redir-domain": &cfg.HttpProxy.RedirDomain,
+		"http-proxy-mode":         &cfg.HttpProxy.Mode,
+		"http-proxy-domain":       &cfg.HttpProxy.Domain,
+	}
+}
+
+// walk calls f for each option with its dotted path, e.g. "device.ssl.cert".
+func (cfg *Config) walk(f func(name string, v reflect.Value)) {
+	var walk func(prefix string, v reflect.Value)
+
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+
+		for i := range t.NumField() {
+			name := prefix + t.Field(i).Tag.Get("yaml")
+
+			if t.Field(i).Type.Kind() == reflect.Struct {
+				walk(name+".", v.Field(i))
+			} else {
+				f(name, v.Field(i))
+			}
+		}
+	}
+
+	walk("", reflect.ValueOf(cfg).Elem())
+}
+
+// optName returns the dotted path of the option which ptr points to.
+func (cfg *Config) optName(ptr any) string {
+	name := ""
+
+	cfg.walk(func(n string, v reflect.Value) {
+		if v.Addr().Interface() == ptr {
+			name = n
+		}
+	})
+
+	return name
+}
+
+// fields returns all options keyed by their dotted path.
+func (cfg *Config) fields() map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+
+	cfg.walk(func(name string, v reflect.Value) {
+		fields[name] = v
+	})
+
+	return fields
+}
+
+// Shown instead of the secrets
+const maskedSecret = "******"
+
+// maskSecret masks the value of a secret option. Of a list of accounts,
+// only the passwords are masked.
+func maskSecret(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Len() > 0 {
+			v.SetString(maskedSecret)
+		}
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return
+		}
+
+		if v.Type().Elem().Kind() != reflect.Struct {
+			v.Set(reflect.ValueOf([]string{maskedSecret}).Convert(v.Type()))
+			return
+		}
+
+		masked := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(masked, v)
+
+		for i := range masked.Len() {
+			elem := masked.Index(i)
+
+			for j := range elem.NumField() {
+				if elem.Type().Field(j).Tag.Get("yaml") == "password" {
+					maskSecret(elem.Field(j))
+				}
+			}
+		}
+
+		v.Set(masked)
+	}
+}
+
+// String returns the config in YAML, with the options of secretOpts masked
+func (cfg *Config) String() string {
+	c := *cfg
+
+	fields := c.fields()
+
+	for name := range secretOpts {
+		maskSecret(fields[name])
+	}
+
+	b, _ := yaml.Marshal(&c)
+	return string(b)
 }
 
 func getFlagOpt(c *cli.Command, name string, opt any) {
@@ -126,9 +941,40 @@ func getFlagOpt(c *cli.Command, name string, opt any) {
 	switch opt := opt.(type) {
 	case *string:
 		*opt = c.String(name)
+	case *[]string:
+		*opt = []string{c.String(name)}
 	case *int:
 		*opt = c.Int(name)
 	case *bool:
 		*opt = c.Bool(name)
 	}
 }
+
+// ipAllowed reports whether the IP of addr is in one of the cidrs.
+// Any address is allowed if cidrs is empty.
+func ipAllowed(cidrs []string, addr net.Addr) bool {
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false
+	}
+
+	ip = ip.Unmap()
+
+	for _, cidr := range cidrs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err == nil && prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
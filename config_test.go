@@ -0,0 +1,200 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		err    string
+	}{
+		{"default", func(cfg *Config) {}, ""},
+		{"log level", func(cfg *Config) { cfg.LogLevel = "trace" }, "log-level:"},
+		{"drain timeout", func(cfg *Config) { cfg.DrainTimeout = -1 }, "drain-timeout:"},
+		{"buffer size", func(cfg *Config) { cfg.Term.BufferSize = 0 }, "term.buffer-size:"},
+		{"term role", func(cfg *Config) {
+			cfg.Term.Roles = map[string]TermLimits{"guest": {}}
+		}, "term.roles[guest]: role must be admin or user"},
+		{"term group limits", func(cfg *Config) {
+			cfg.Term.Groups = map[string]TermLimits{"g1": {IdleTimeout: -1}}
+		}, "term.groups[g1]:"},
+		{"session idle timeout", func(cfg *Config) { cfg.HttpProxy.SessionIdleTimeout = 0 }, "http-proxy.session-idle-timeout:"},
+		{"tunnel max per user", func(cfg *Config) { cfg.Tunnel.MaxPerUser = -1 }, "tunnel.max-per-user:"},
+		{"tunnel listen host", func(cfg *Config) { cfg.Tunnel.ListenHost = "::" }, ""},
+		{"bad tunnel listen host", func(cfg *Config) { cfg.Tunnel.ListenHost = "bad host" }, "tunnel.listen-host:"},
+		{"rate limit", func(cfg *Config) {
+			cfg.RateLimit.Groups = map[string]RateLimits{"g1": {Tunnel: -1}}
+		}, "rate-limit.groups[g1]:"},
+		{"file direction", func(cfg *Config) { cfg.FileTransfer.Default.Direction = "sideways" }, "file-transfer.default.direction:"},
+		{"file names", func(cfg *Config) { cfg.FileTransfer.Default.Names = []string{"[a"} }, "file-transfer.default.names[0]:"},
+		{"command pattern", func(cfg *Config) {
+			cfg.CommandFilter.Rules = []CommandRule{{Pattern: "("}}
+		}, "command-filter.rules[0].pattern:"},
+		{"command action", func(cfg *Config) {
+			cfg.CommandFilter.Rules = []CommandRule{{Pattern: "x", Action: "ask"}}
+		}, "command-filter.rules[0].action:"},
+		{"share max viewers", func(cfg *Config) { cfg.Share.MaxViewers = -1 }, "share.max-viewers:"},
+		{"device addr", func(cfg *Config) { cfg.Device.Addr = "" }, "device.addr: is required"},
+		{"user addr", func(cfg *Config) { cfg.User.Addr = "5913" }, "user.addr: invalid address"},
+		{"no http proxy", func(cfg *Config) { cfg.HttpProxy.Addr = "" }, ""},
+		{"hook url", func(cfg *Config) { cfg.User.HookUrl = "ftp://hook" }, "user.hook-url:"},
+		{"ssl", func(cfg *Config) { cfg.Device.SSL.Cert = "cert.pem" }, "device.ssl:"},
+		{"subdomain", func(cfg *Config) { cfg.HttpProxy.Mode = HttpProxyModeSubdomain }, "http-proxy.domain: is required"},
+		{"proxy mode", func(cfg *Config) { cfg.HttpProxy.Mode = "host" }, "http-proxy.mode:"},
+		{"device token", func(cfg *Config) { cfg.Device.Tokens = []string{"a", ""} }, "device.tokens[1]:"},
+		{"cidr", func(cfg *Config) { cfg.User.AllowedCIDRs = []string{"10.0.0.1"} }, "user.allowed-cidrs[0]:"},
+		{"duplicate user", func(cfg *Config) {
+			cfg.User.Users = []UserAccount{{Username: "a", Password: "1"}, {Username: "a", Password: "2"}}
+		}, "user.users[1]: duplicate username"},
+		{"user password", func(cfg *Config) {
+			cfg.User.Users = []UserAccount{{Username: "a"}}
+		}, "user.users[0]: password is required"},
+	}
+
+	for _, tt := range tests {
+		cfg := DefaultConfig()
+		tt.modify(&cfg)
+
+		err := cfg.Validate()
+
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigValidateAll(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.LogLevel = "trace"
+	cfg.Share.MaxExpire = -1
+
+	// All the errors are told at once
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "log-level:") || !strings.Contains(err.Error(), "share.max-expire:") {
+		t.Errorf("error %v, want both log-level and share.max-expire", err)
+	}
+}
+
+func TestConfigValidateCommandRules(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CommandFilter.Rules = []CommandRule{{Pattern: `^reboot\b`}}
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Compiled once for the filter
+	if re := cfg.CommandFilter.Rules[0].re; re == nil || !re.MatchString("reboot now") {
+		t.Errorf("pattern not compiled: %v", re)
+	}
+}
+
+func TestConfigLoadEnv(t *testing.T) {
+	t.Setenv("RTTYS_LOG_LEVEL", "debug")
+	t.Setenv("RTTYS_USER_LOCAL_AUTH", "false")
+	t.Setenv("RTTYS_TERM_MAX_PER_USER", "3")
+	t.Setenv("RTTYS_USER_ALLOWED_CIDRS", " 10.0.0.0/8, ,192.168.0.0/16")
+	t.Setenv("RTTYS_HTTP_PROXY_SESSION_BIND_IP", "0")
+
+	cfg := DefaultConfig()
+
+	if err := cfg.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.LogLevel != "debug" {
+		t.Errorf("log-level %q, want debug", cfg.LogLevel)
+	}
+
+	if cfg.User.LocalAuth {
+		t.Error("user.local-auth not overridden")
+	}
+
+	if cfg.Term.MaxPerUser != 3 {
+		t.Errorf("term.max-per-user %d, want 3", cfg.Term.MaxPerUser)
+	}
+
+	if want := []string{"10.0.0.0/8", "192.168.0.0/16"}; !slices.Equal(cfg.User.AllowedCIDRs, want) {
+		t.Errorf("user.allowed-cidrs %q, want %q", cfg.User.AllowedCIDRs, want)
+	}
+
+	if cfg.HttpProxy.SessionBindIP {
+		t.Error("http-proxy.session-bind-ip not overridden")
+	}
+
+	// Not set, kept
+	if cfg.User.Addr != ":5913" {
+		t.Errorf("user.addr %q, want the default", cfg.User.Addr)
+	}
+}
+
+func TestConfigLoadEnvInvalid(t *testing.T) {
+	tests := []struct {
+		env string
+		val string
+	}{
+		{"RTTYS_TERM_MAX_PER_USER", "many"},
+		{"RTTYS_USER_LOCAL_AUTH", "maybe"},
+		{"RTTYS_TERM_GROUPS", "g1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv(tt.env, tt.val)
+
+			cfg := DefaultConfig()
+
+			if err := cfg.LoadEnv(); err == nil || !strings.Contains(err.Error(), tt.env) {
+				t.Errorf("%s=%s: error %v", tt.env, tt.val, err)
+			}
+		})
+	}
+}
+
+func TestConfigString(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Device.Tokens = []string{"devtoken1", "devtoken2"}
+	cfg.User.Password = "globalpass"
+	cfg.User.Users = []UserAccount{{Username: "alice", Password: "alicepass"}}
+
+	s := cfg.String()
+
+	for _, secret := range []string{"devtoken1", "devtoken2", "globalpass", "alicepass"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("secret %q shown", secret)
+		}
+	}
+
+	if !strings.Contains(s, "alice") || !strings.Contains(s, maskedSecret) {
+		t.Errorf("users or masks missing:\n%s", s)
+	}
+
+	// The config itself is kept
+	if cfg.User.Users[0].Password != "alicepass" || cfg.Device.Tokens[0] != "devtoken1" {
+		t.Error("config modified")
+	}
+
+	fields := cfg.fields()
+
+	for name := range secretOpts {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("secret option %q not found", name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// ringBuffer keeps the last bytes written to it
+type ringBuffer struct {
+	buf []byte
+	pos int
+	n   int
+
+	// Older bytes have been overwritten
+	dropped bool
+}
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (r *ringBuffer) Write(p []byte) {
+	if r.n+len(p) > len(r.buf) {
+		r.dropped = true
+	}
+
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.pos = 0
+		r.n = len(r.buf)
+		return
+	}
+
+	n := copy(r.buf[r.pos:], p)
+	copy(r.buf, p[n:])
+
+	r.pos = (r.pos + len(p)) % len(r.buf)
+	r.n = min(r.n+len(p), len(r.buf))
+}
+
+// Bytes returns the kept bytes, from the first complete line once the
+// older ones have been dropped, not to start in an escape sequence.
+func (r *ringBuffer) Bytes() []byte {
+	start := r.pos - r.n
+	if start < 0 {
+		start += len(r.buf)
+	}
+
+	var b []byte
+
+	if start+r.n <= len(r.buf) {
+		b = bytes.Clone(r.buf[start : start+r.n])
+	} else {
+		b = append(bytes.Clone(r.buf[start:]), r.buf[:r.pos]...)
+	}
+
+	if r.dropped {
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
+	}
+
+	return b
+}
+
+// detach keeps the session on the device after the websocket is lost,
+// until reattached or the timeout. It's called with the lock held and
+// reports false if the session is not detachable.
+func (user *User) detach() bool {
+	timeout := user.srv.config().Term.DetachTimeout
+
+	if user.token == "" || timeout <= 0 || user.closed.Load() {
+		return false
+	}
+
+	user.conn.Close()
+	user.conn = nil
+
+	// The output sent to the lost websocket is never acknowledged
+	for user.unacked > 0 {
+		n := min(user.unacked, 0xffff)
+		user.ackTerm(uint16(n))
+		user.unacked -= n
+	}
+
+	user.detachTimer = time.AfterFunc(time.Duration(timeout)*time.Second, func() {
+		log.Info().Msgf("detached session '%s' of device '%s' timeout", user.sid, user.dev.id)
+		user.Close()
+	})
+
+	log.Info().Msgf("session '%s' of device '%s' detached", user.sid, user.dev.id)
+
+	return true
+}
+
+// reattachUser attaches the websocket to the session of the token, which
+// must belong to the same user, and replays the recent output. A session
+// still attached is taken over, the old websocket may not have noticed
+// the loss yet.
+func (dev *Device) reattachUser(token, username string, conn *websocket.Conn) *User {
+	var user *User
+
+	dev.users.Range(func(key, value any) bool {
+		u := value.(*User)
+		if u.token != "" && subtle.ConstantTimeCompare([]byte(u.token), []byte(token)) == 1 {
+			user = u
+			return false
+		}
+		return true
+	})
+
+	if user == nil || user.username != username {
+		return nil
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.closed.Load() {
+		return nil
+	}
+
+	if user.detachTimer != nil {
+		user.detachTimer.Stop()
+		user.detachTimer = nil
+	}
+
+	if old := user.conn; old != nil {
+		old.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "session reattached"), time.Now().Add(time.Second))
+		old.Close()
+	}
+
+	user.conn = conn
+
+	conn.WriteMessage(websocket.TextMessage, user.loginMsg())
+
+	if b := user.scrollback.Bytes(); len(b) > 0 {
+		conn.WriteMessage(websocket.BinaryMessage, append([]byte{0}, b...))
+	}
+
+	log.Info().Msgf("session '%s' of device '%s' reattached", user.sid, dev.id)
+
+	return user
+}
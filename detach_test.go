@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import "testing"
+
+func TestRingBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		writes []string
+		want   string
+	}{
+		{"empty", 8, nil, ""},
+		{"partial", 8, []string{"abc", "de"}, "abcde"},
+		{"exactly full", 8, []string{"ab\ncd", "efg"}, "ab\ncdefg"},
+		{"exactly full at once", 8, []string{"ab\ncdefg"}, "ab\ncdefg"},
+		{"wrapped", 8, []string{"ab\ncdef", "gh\nij"}, "ij"},
+		{"wrapped without newline", 8, []string{"abcdef", "ghij"}, "cdefghij"},
+		{"wrapped newline kept", 8, []string{"abcdef", "g\nhij"}, "hij"},
+		{"larger than the buffer", 8, []string{"01234\n6789ab"}, "6789ab"},
+		{"larger without newline", 4, []string{"ab", "cdefgh"}, "efgh"},
+		{"many writes", 4, []string{"a", "b", "c", "d", "e", "f"}, "cdef"},
+		{"newline at the end", 8, []string{"abcdefgh", "\n"}, ""},
+	}
+
+	for _, tt := range tests {
+		r := newRingBuffer(tt.size)
+
+		for _, w := range tt.writes {
+			r.Write([]byte(w))
+		}
+
+		if got := string(r.Bytes()); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRingBufferCopy(t *testing.T) {
+	r := newRingBuffer(8)
+	r.Write([]byte("abc"))
+
+	b := r.Bytes()
+	b[0] = 'x'
+
+	if got := string(r.Bytes()); got != "abc" {
+		t.Errorf("modified by the caller: %q", got)
+	}
+}
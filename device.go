@@ -3,7 +3,7 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
 	"bytes"
@@ -11,11 +11,13 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -24,6 +26,7 @@ import (
 	jsoniter "github.com/json-iterator/go"
 	"github.com/rs/zerolog/log"
 	"github.com/zhaojh329/rtty-go/proto"
+	xlog "github.com/zhaojh329/rttys/v5/log"
 	"github.com/zhaojh329/rttys/v5/utils"
 )
 
@@ -34,6 +37,7 @@ type DeviceInfo struct {
 	Uptime    uint32 `json:"uptime"`
 	Desc      string `json:"description"`
 	Proto     uint8  `json:"proto"`
+	Caps      uint8  `json:"caps"`
 	IPaddr    string `json:"ipaddr"`
 }
 
@@ -41,6 +45,7 @@ type Device struct {
 	group     string
 	id        string
 	proto     uint8
+	caps      uint8
 	desc      string
 	timestamp int64
 	uptime    uint32
@@ -52,11 +57,16 @@ type Device struct {
 	commands sync.Map
 	https    sync.Map
 
+	// File transfers driven by the server, keyed by the terminal sid
+	transfers sync.Map
+
 	conn   net.Conn
 	close  sync.Once
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	limiter *rateLimiter
+
 	msg *proto.MsgReaderWriter
 }
 
@@ -75,6 +85,21 @@ const (
 	CommandTimeout          = 30
 )
 
+// Register attribute of the optional features of a device, a 1-byte
+// bitmask of DevCap*. It's not defined by rtty-go/proto, so it's taken
+// from the end of the range, away from the attributes added there. A
+// device without it has none of the features.
+const MsgRegAttrCaps byte = 0xff
+
+const (
+	// The HTTP proxy destination is sent with its address type, e.g. IPv6
+	DevCapHttpDestAddr uint8 = 1 << iota
+
+	// Hostnames are resolved by the device for the HTTP proxy, which
+	// implies DevCapHttpDestAddr
+	DevCapHttpDestName
+)
+
 var DevRegErrMsg = map[byte]string{
 	0:                         "Success",
 	devRegErrUnsupportedProto: "Unsupported protocol",
@@ -93,47 +118,82 @@ var DeviceMsgHandlers = map[byte]func(*Device, []byte) error{
 	proto.MsgTypeHttp:      handleHttpMsg,
 }
 
-func (srv *RttyServer) ListenDevices() {
-	cfg := &srv.cfg
-
-	ln, err := net.Listen("tcp", cfg.AddrDev)
+// ServeDevices accepts device connections on the listener until the
+// server is stopped. The listener is wrapped with TLS if configured.
+func (srv *RttyServer) ServeDevices(ln net.Listener) error {
+	ln, err := srv.wrapDeviceListener(ln)
 	if err != nil {
-		log.Fatal().Msg(err.Error())
+		ln.Close()
+		return err
 	}
-	defer ln.Close()
 
-	if cfg.SslCert != "" && cfg.SslKey != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.SslCert, cfg.SslKey)
-		if err != nil {
-			log.Fatal().Msg(err.Error())
-		}
+	return srv.serveDevices(ln)
+}
 
-		config := &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
-		}
+func (srv *RttyServer) wrapDeviceListener(ln net.Listener) (net.Listener, error) {
+	cfg := srv.config()
 
-		if cfg.CaCert != "" {
-			caCert, err := os.ReadFile(cfg.CaCert)
-			if err != nil {
-				log.Fatal().Msg(err.Error())
-			}
-			caCertPool := x509.NewCertPool()
-			caCertPool.AppendCertsFromPEM(caCert)
-			config.ClientCAs = caCertPool
-			config.ClientAuth = tls.RequireAndVerifyClientCert
+	if cfg.Device.SSL.Cert != "" && cfg.Device.SSL.Key != "" {
+		config, err := loadDeviceTLSConfig(cfg)
+		if err != nil {
+			return ln, err
 		}
 
-		ln = tls.NewListener(ln, config)
+		srv.devTLS.Store(config)
+
+		// Look up the config for each handshake, so that the certificates
+		// can be reloaded at runtime.
+		ln = tls.NewListener(ln, &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return srv.devTLS.Load(), nil
+			},
+		})
 
 		log.Info().Msgf("Listen devices on: %s SSL on", ln.Addr().(*net.TCPAddr))
 	} else {
 		log.Info().Msgf("Listen devices on: %s SSL off", ln.Addr().(*net.TCPAddr))
 	}
 
+	return ln, nil
+}
+
+func loadDeviceTLSConfig(cfg *Config) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Device.SSL.Cert, cfg.Device.SSL.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.Device.SSL.CaCert != "" {
+		caCert, err := os.ReadFile(cfg.Device.SSL.CaCert)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		caCertPool.AppendCertsFromPEM(caCert)
+		config.ClientCAs = caCertPool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func (srv *RttyServer) serveDevices(ln net.Listener) error {
+	if !srv.trackListener(ln) {
+		return net.ErrClosed
+	}
+	defer ln.Close()
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Error().Msg(err.Error())
 			continue
 		}
@@ -143,7 +203,7 @@ func (srv *RttyServer) ListenDevices() {
 }
 
 func handleDeviceConnection(srv *RttyServer, conn net.Conn) {
-	defer logPanic()
+	defer xlog.LogPanic()
 
 	dev := &Device{
 		conn:      conn,
@@ -158,6 +218,11 @@ func handleDeviceConnection(srv *RttyServer, conn net.Conn) {
 
 	log.Debug().Msgf("new device '%s' connected", conn.RemoteAddr())
 
+	if !ipAllowed(srv.config().Device.AllowedCIDRs, conn.RemoteAddr()) {
+		log.Error().Msgf("device from '%s' not allowed", conn.RemoteAddr())
+		return
+	}
+
 	conn.SetReadDeadline(time.Now().Add(WaitRegistTimeout))
 
 	typ, data, err := dev.ReadMsg()
@@ -177,6 +242,8 @@ func handleDeviceConnection(srv *RttyServer, conn net.Conn) {
 		return
 	}
 
+	dev.limiter = newRateLimiter(func() int { return srv.rateLimits(dev.group).Device })
+
 	code := dev.Register(srv)
 
 	err = dev.WriteMsg(proto.MsgTypeRegister, code, DevRegErrMsg[code])
@@ -192,12 +259,14 @@ func handleDeviceConnection(srv *RttyServer, conn net.Conn) {
 	log.Info().Msgf("device '%s' registered, group '%s' proto %d, heartbeat %v",
 		dev.id, dev.group, dev.proto, dev.heartbeat)
 
+	go srv.resumePushJobs(dev)
+
 	for {
 		conn.SetReadDeadline(time.Now().Add(dev.heartbeat * 3 / 2))
 
 		typ, data, err = dev.ReadMsg()
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
 				log.Error().Msgf("read msg from device '%s' fail: %v", dev.id, err)
 			}
 			return
@@ -227,6 +296,46 @@ func (dev *Device) WriteMsg(typ byte, data ...any) error {
 	return dev.msg.Write(typ, data...)
 }
 
+func (dev *Device) ID() string {
+	return dev.id
+}
+
+func (dev *Device) Group() string {
+	return dev.group
+}
+
+func (dev *Device) Info() *DeviceInfo {
+	return &DeviceInfo{
+		Group:     dev.group,
+		ID:        dev.id,
+		Desc:      dev.desc,
+		Connected: uint32(time.Now().Unix() - dev.timestamp),
+		Uptime:    dev.uptime,
+		Proto:     dev.proto,
+		Caps:      dev.caps,
+		IPaddr:    dev.conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+	}
+}
+
+// idle reports whether the device has no terminal sessions, HTTP proxy
+// connections or commands in flight.
+func (dev *Device) idle() bool {
+	for _, m := range []*sync.Map{&dev.users, &dev.pending, &dev.commands, &dev.https, &dev.transfers} {
+		empty := true
+
+		m.Range(func(key, value any) bool {
+			empty = false
+			return false
+		})
+
+		if !empty {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (dev *Device) Close(srv *RttyServer) {
 	dev.close.Do(func() {
 		log.Error().Msgf("device '%s' disconnected", dev.id)
@@ -257,6 +366,10 @@ func (dev *Device) ParseRegister(b []byte) error {
 				dev.token = string(val)
 			case proto.MsgRegAttrGroup:
 				dev.group = string(val)
+			case MsgRegAttrCaps:
+				if len(val) > 0 {
+					dev.caps = val[0]
+				}
 			}
 		}
 	} else {
@@ -293,19 +406,19 @@ func (dev *Device) ParseRegister(b []byte) error {
 }
 
 func (dev *Device) Register(srv *RttyServer) byte {
-	cfg := &srv.cfg
+	cfg := srv.config()
 
 	if dev.proto < RttyProtoRequired {
 		log.Error().Msgf("minimum proto required %d, found %d for device '%s'", RttyProtoRequired, dev.proto, dev.id)
 		return devRegErrHookFailed
 	}
 
-	if cfg.Token != "" && dev.token != cfg.Token {
+	if len(cfg.Device.Tokens) > 0 && !slices.Contains(cfg.Device.Tokens, dev.token) {
 		log.Error().Msgf("invalid token for device '%s'", dev.id)
 		return devRegErrInvalidToken
 	}
 
-	devHookUrl := cfg.DevHookUrl
+	devHookUrl := cfg.Device.HookUrl
 	if devHookUrl != "" {
 		cli := &http.Client{
 			Timeout: 3 * time.Second,
@@ -369,6 +482,8 @@ func handleLogoutMsg(dev *Device, data []byte) error {
 	if val, loaded := dev.users.LoadAndDelete(sid); loaded {
 		user := val.(*User)
 		user.Close()
+	} else if val, loaded := dev.transfers.LoadAndDelete(sid); loaded {
+		val.(*FileTransfer).cancel(errFileTermClosed)
 	}
 
 	return nil
@@ -393,12 +508,14 @@ func handleLoginMsg(dev *Device, data []byte) error {
 		}
 
 		if errCode == 0 {
-			user.WriteMsg(websocket.TextMessage, []byte(fmt.Appendf(nil, `{"type":"login"}`)))
+			user.WriteMsg(websocket.TextMessage, user.loginMsg())
 		} else {
 			user.SendCloseMsg(LoginErrorBusy, "device busy")
 		}
 
 		user.pending <- ok
+	} else if val, ok := dev.transfers.Load(sid); ok {
+		val.(*FileTransfer).login <- code == 0
 	}
 
 	return nil
@@ -410,7 +527,9 @@ func handleTermDataMsg(dev *Device, data []byte) error {
 	if val, ok := dev.users.Load(sid); ok {
 		user := val.(*User)
 		data[31] = 0
-		user.WriteMsg(websocket.BinaryMessage, data[31:])
+		user.writeTerm(data[31:])
+	} else if val, ok := dev.transfers.Load(sid); ok {
+		val.(*FileTransfer).recvTerm(data[32:])
 	}
 
 	return nil
@@ -425,22 +544,33 @@ func handleFileMsg(dev *Device, data []byte) error {
 
 		switch typ {
 		case proto.MsgTypeFileSend:
-			user.WriteMsg(websocket.TextMessage,
-				fmt.Appendf(nil, `{"type":"sendfile", "name": "%s"}`, string(data[33:])))
+			if user.fileSend(string(data[33:])) {
+				user.WriteMsg(websocket.TextMessage,
+					fmt.Appendf(nil, `{"type":"sendfile", "name": "%s"}`, string(data[33:])))
+			}
 
 		case proto.MsgTypeFileRecv:
-			user.WriteMsg(websocket.TextMessage, []byte(`{"type":"recvfile"}`))
+			if user.fileRecv() {
+				user.WriteMsg(websocket.TextMessage, []byte(`{"type":"recvfile"}`))
+			}
 
 		case proto.MsgTypeFileData:
-			data[32] = 1
-			user.WriteMsg(websocket.BinaryMessage, data[32:])
+			if user.downloadData(data[33:]) {
+				user.fileUnacked.Add(int64(len(data) - 33))
+				data[32] = 1
+				user.WriteMsg(websocket.BinaryMessage, data[32:])
+			}
 
 		case proto.MsgTypeFileAck:
 			user.WriteMsg(websocket.TextMessage, []byte(`{"type":"fileAck"}`))
 
 		case proto.MsgTypeFileAbort:
-			user.WriteMsg(websocket.BinaryMessage, []byte{1})
+			if user.fileAbort() {
+				user.WriteMsg(websocket.BinaryMessage, []byte{1})
+			}
 		}
+	} else if val, ok := dev.transfers.Load(sid); ok {
+		val.(*FileTransfer).recvFile(typ, data[33:])
 	}
 
 	return nil
@@ -454,12 +584,8 @@ func handleHttpMsg(dev *Device, data []byte) error {
 	data = data[18:]
 
 	if c, ok := dev.https.Load(saddr); ok {
-		c := c.(net.Conn)
-		if len(data) == 0 {
-			c.Close()
-		} else {
-			c.Write(data)
-		}
+		// Empty data closes the connection
+		c.(*deviceConn).queue(data)
 	}
 
 	return nil
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+func regAttr(typ byte, val string) []byte {
+	b := []byte{typ}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(val)))
+	return append(b, val...)
+}
+
+func TestParseRegisterCaps(t *testing.T) {
+	devid := regAttr(proto.MsgRegAttrDevid, "dev1")
+
+	tests := []struct {
+		name string
+		msg  []byte
+		caps uint8
+	}{
+		{"no caps", append([]byte{5}, devid...), 0},
+		{"addr", append(append([]byte{5}, devid...), regAttr(MsgRegAttrCaps, "\x01")...), DevCapHttpDestAddr},
+		{"addr and name", append(append([]byte{5}, regAttr(MsgRegAttrCaps, "\x03")...), devid...),
+			DevCapHttpDestAddr | DevCapHttpDestName},
+		{"empty caps", append(append([]byte{5}, devid...), regAttr(MsgRegAttrCaps, "")...), 0},
+		{"legacy", []byte("\x04dev1\x00desc\x00token\x00"), 0},
+	}
+
+	for _, tt := range tests {
+		dev := &Device{}
+
+		if err := dev.ParseRegister(tt.msg); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+
+		if dev.id != "dev1" || dev.caps != tt.caps {
+			t.Errorf("%s: id %q caps %d, want dev1 and %d", tt.name, dev.id, dev.caps, tt.caps)
+		}
+	}
+}
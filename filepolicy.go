@@ -0,0 +1,486 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+
+	"github.com/gorilla/websocket"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// How a file is transferred
+const (
+	fileViaTerminal = "terminal"
+	fileViaAPI      = "api"
+	fileViaPush     = "push"
+)
+
+// Outcomes of the file transfers
+const (
+	fileOutcomeSuccess  = "success"
+	fileOutcomeDenied   = "denied"
+	fileOutcomeCanceled = "canceled"
+	fileOutcomeAborted  = "aborted"
+	fileOutcomeFailed   = "failed"
+)
+
+type fileLogEntry struct {
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username"`
+	Group       string    `json:"group"`
+	Devid       string    `json:"devid"`
+	Session     string    `json:"session"`
+	Via         string    `json:"via"`
+	Direction   string    `json:"direction"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Transferred int64     `json:"transferred"`
+	Sha256      string    `json:"sha256"`
+	Outcome     string    `json:"outcome"`
+	Err         string    `json:"err,omitempty"`
+	Duration    int64     `json:"duration"`
+}
+
+// filePolicy returns the file transfer policy of the devices in the group
+func (srv *RttyServer) filePolicy(group string) FilePolicy {
+	cfg := srv.config()
+
+	if policy, ok := cfg.FileTransfer.Groups[group]; ok {
+		return policy
+	}
+
+	return cfg.FileTransfer.Default
+}
+
+// check returns errFileDenied if the file isn't allowed to be transferred
+// in the direction. The name and the size are not checked if unknown yet.
+func (p *FilePolicy) check(upload bool, name string, size int64) error {
+	switch p.Direction {
+	case FileDirectionNone:
+		return fmt.Errorf("%w: file transfers not allowed", errFileDenied)
+	case FileDirectionUpload:
+		if !upload {
+			return fmt.Errorf("%w: downloads not allowed", errFileDenied)
+		}
+	case FileDirectionDownload:
+		if upload {
+			return fmt.Errorf("%w: uploads not allowed", errFileDenied)
+		}
+	}
+
+	if p.MaxSize > 0 && size > int64(p.MaxSize) {
+		return fmt.Errorf("%w: file larger than %d bytes", errFileDenied, p.MaxSize)
+	}
+
+	if name == "" || len(p.Names) == 0 {
+		return nil
+	}
+
+	for _, pattern := range p.Names {
+		if ok, _ := path.Match(pattern, name); ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: file name '%s' not allowed", errFileDenied, name)
+}
+
+func fileOutcome(err error) string {
+	switch {
+	case err == nil:
+		return fileOutcomeSuccess
+	case errors.Is(err, errFileDenied):
+		return fileOutcomeDenied
+	case errors.Is(err, errFileCanceled), errors.Is(err, context.Canceled):
+		return fileOutcomeCanceled
+	case errors.Is(err, errFileAborted):
+		return fileOutcomeAborted
+	default:
+		return fileOutcomeFailed
+	}
+}
+
+func fileDirection(upload bool) string {
+	if upload {
+		return FileDirectionUpload
+	}
+	return FileDirectionDownload
+}
+
+// logFileTransfer logs the transfer, and writes it to the file of
+// file-transfer.log in JSON.
+func (srv *RttyServer) logFileTransfer(e *fileLogEntry) {
+	ev := log.Info()
+	if e.Outcome != fileOutcomeSuccess {
+		ev = log.Warn()
+	}
+
+	outcome := e.Outcome
+	if e.Err != "" {
+		outcome += ": " + e.Err
+	}
+
+	ev.Msgf("file %s '%s' (%d bytes) of device '%s' by '%s' via %s: %s",
+		e.Direction, e.Name, e.Size, e.Devid, e.Username, e.Via, outcome)
+
+	cfg := srv.config()
+
+	if cfg.FileTransfer.Log == "" {
+		return
+	}
+
+	line, _ := jsoniter.Marshal(e)
+	line = append(line, '\n')
+
+	srv.fileLog.output(cfg.FileTransfer.Log, line)
+}
+
+// log logs the transfer driven by the server with its result
+func (t *FileTransfer) log(srv *RttyServer, sum string, err error) {
+	e := &fileLogEntry{
+		Time:        t.created,
+		Username:    t.username,
+		Group:       t.dev.group,
+		Devid:       t.dev.id,
+		Session:     t.id,
+		Via:         t.via,
+		Direction:   fileDirection(t.upload),
+		Name:        t.path,
+		Size:        t.size,
+		Transferred: t.transferred.Load(),
+		Sha256:      sum,
+		Outcome:     fileOutcome(err),
+		Duration:    time.Since(t.created).Milliseconds(),
+	}
+
+	if err != nil {
+		e.Err = err.Error()
+	}
+
+	srv.logFileTransfer(e)
+}
+
+// fileRelay follows the file transfer relayed between the device and the
+// user of a terminal session, to apply the file policy and to log it.
+type fileRelay struct {
+	mu sync.Mutex
+
+	// Upload is not running until the user chooses the file
+	running bool
+	upload  bool
+
+	name        string
+	size        int64
+	transferred int64
+	hash        hash.Hash
+	start       time.Time
+
+	// Drop the data of the denied transfer until the next one
+	denied bool
+
+	// The upload is complete but for the empty data ending it
+	ending bool
+}
+
+// begin starts to follow a new transfer, which is running if the file
+// is known.
+func (r *fileRelay) begin(upload, running bool, name string, size int64) {
+	r.upload = upload
+	r.running = running
+	r.denied = false
+	r.ending = false
+	r.name = name
+	r.size = size
+	r.transferred = 0
+	r.hash = sha256.New()
+	r.start = time.Now()
+}
+
+func (r *fileRelay) reset() {
+	r.running = false
+	r.ending = false
+	r.hash = nil
+}
+
+// finish logs the transfer and resets the relay
+func (user *User) finishFile(r *fileRelay, err error) {
+	e := &fileLogEntry{
+		Time:        r.start,
+		Username:    user.username,
+		Group:       user.dev.group,
+		Devid:       user.dev.id,
+		Session:     user.sid,
+		Via:         fileViaTerminal,
+		Direction:   fileDirection(r.upload),
+		Name:        r.name,
+		Size:        r.size,
+		Transferred: r.transferred,
+		Outcome:     fileOutcome(err),
+		Duration:    time.Since(r.start).Milliseconds(),
+	}
+
+	if err == nil {
+		e.Sha256 = hex.EncodeToString(r.hash.Sum(nil))
+	} else {
+		e.Err = err.Error()
+	}
+
+	r.reset()
+
+	user.srv.logFileTransfer(e)
+}
+
+// denyFile aborts the transfer on the device and tells the user why
+func (user *User) denyFile(r *fileRelay, err error) {
+	r.denied = true
+
+	user.finishFile(r, err)
+
+	user.dev.WriteMsg(proto.MsgTypeFile, user.sid, proto.MsgTypeFileAbort)
+
+	msg, _ := jsoniter.Marshal(map[string]string{"type": "fileDenied", "reason": err.Error()})
+	user.WriteMsg(websocket.TextMessage, msg)
+}
+
+// fileRecv is called when the device requests a file to be uploaded. It
+// reports whether to let the user choose the file.
+func (user *User) fileRecv() bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.begin(true, false, "", 0)
+
+	if user.bcast != nil {
+		user.denyFile(r, fmt.Errorf("%w: not supported by broadcast", errFileDenied))
+		return false
+	}
+
+	policy := user.srv.filePolicy(user.dev.group)
+
+	if err := policy.check(true, "", 0); err != nil {
+		user.denyFile(r, err)
+		return false
+	}
+
+	return true
+}
+
+// fileInfo is called with the file chosen by the user to upload. It
+// reports whether to send the info to the device.
+func (user *User) fileInfo(size uint32, name string) bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.begin(true, true, name, int64(size))
+
+	policy := user.srv.filePolicy(user.dev.group)
+
+	if err := policy.check(true, path.Base(name), r.size); err != nil {
+		user.denyFile(r, err)
+		return false
+	}
+
+	return true
+}
+
+// uploadData is called with the file data from the user. It reports
+// whether to send it to the device.
+func (user *User) uploadData(data []byte) bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.denied {
+		return false
+	}
+
+	// The empty data ending the upload
+	if r.ending && len(data) == 0 {
+		r.ending = false
+		return true
+	}
+
+	// Only the data of an upload allowed by the policy are sent
+	if !r.running || !r.upload {
+		return false
+	}
+
+	if len(data) == 0 {
+		if r.transferred < r.size {
+			user.denyFile(r, fmt.Errorf("%w: less data than the file size", errFileDenied))
+			return false
+		}
+
+		user.finishFile(r, nil)
+		return true
+	}
+
+	r.transferred += int64(len(data))
+
+	if r.transferred > r.size {
+		user.denyFile(r, fmt.Errorf("%w: more data than the file size", errFileDenied))
+		return false
+	}
+
+	r.hash.Write(data)
+
+	if r.transferred == r.size {
+		user.finishFile(r, nil)
+		r.ending = true
+	}
+
+	return true
+}
+
+// fileInput is called with the file messages sent by the user in binary,
+// which are checked like the JSON ones. It reports whether to send the
+// message to the device.
+func (user *User) fileInput(data []byte) bool {
+	if len(data) < 1 {
+		return false
+	}
+
+	switch data[0] {
+	case proto.MsgTypeFileData:
+		return user.uploadData(data[1:])
+
+	case proto.MsgTypeFileInfo:
+		// The size on 4 bytes followed by the name
+		if len(data) < 5 {
+			return false
+		}
+		return user.fileInfo(binary.BigEndian.Uint32(data[1:5]), string(data[5:]))
+
+	case proto.MsgTypeFileAbort:
+		user.fileCanceled()
+		return true
+
+	case proto.MsgTypeFileAck:
+		// Delayed by the rate limits
+		user.ackFile()
+		return false
+	}
+
+	return false
+}
+
+// fileCanceled is called when the user cancels the upload
+func (user *User) fileCanceled() {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		user.finishFile(r, errFileCanceled)
+	}
+
+	r.reset()
+}
+
+// fileSend is called when the device starts to send the file. It reports
+// whether to let the user download it.
+func (user *User) fileSend(name string) bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.begin(false, true, name, 0)
+
+	if user.bcast != nil {
+		user.denyFile(r, fmt.Errorf("%w: not supported by broadcast", errFileDenied))
+		return false
+	}
+
+	policy := user.srv.filePolicy(user.dev.group)
+
+	if err := policy.check(false, path.Base(name), 0); err != nil {
+		user.denyFile(r, err)
+		return false
+	}
+
+	return true
+}
+
+// downloadData is called with the file data from the device, which is
+// empty at the end of the file. It reports whether to send it to the
+// user.
+func (user *User) downloadData(data []byte) bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.denied {
+		return false
+	}
+
+	if !r.running || r.upload {
+		return true
+	}
+
+	if len(data) == 0 {
+		r.size = r.transferred
+		user.finishFile(r, nil)
+		return true
+	}
+
+	r.transferred += int64(len(data))
+	r.size = r.transferred
+
+	policy := user.srv.filePolicy(user.dev.group)
+
+	if err := policy.check(false, "", r.transferred); err != nil {
+		user.denyFile(r, err)
+		return false
+	}
+
+	r.hash.Write(data)
+
+	return true
+}
+
+// fileAbort is called when the device aborts the transfer. It reports
+// whether to tell the user.
+func (user *User) fileAbort() bool {
+	r := &user.file
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Aborted by the server
+	if r.denied {
+		r.denied = false
+		return false
+	}
+
+	if r.running {
+		user.finishFile(r, errFileAborted)
+	}
+
+	r.reset()
+
+	return true
+}
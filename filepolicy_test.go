@@ -0,0 +1,77 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFilePolicyCheck(t *testing.T) {
+	conf := FilePolicy{MaxSize: 1024, Direction: FileDirectionUpload, Names: []string{"*.conf", "config-?"}}
+
+	tests := []struct {
+		name   string
+		policy FilePolicy
+		upload bool
+		file   string
+		size   int64
+		denied bool
+	}{
+		{"no policy", FilePolicy{}, true, "a.bin", 1 << 30, false},
+		{"both", FilePolicy{Direction: FileDirectionBoth}, false, "a.bin", 1, false},
+		{"none upload", FilePolicy{Direction: FileDirectionNone}, true, "a.bin", 1, true},
+		{"none download", FilePolicy{Direction: FileDirectionNone}, false, "a.bin", 1, true},
+		{"upload only", FilePolicy{Direction: FileDirectionUpload}, true, "a.bin", 1, false},
+		{"upload only download", FilePolicy{Direction: FileDirectionUpload}, false, "a.bin", 1, true},
+		{"download only", FilePolicy{Direction: FileDirectionDownload}, false, "a.bin", 1, false},
+		{"download only upload", FilePolicy{Direction: FileDirectionDownload}, true, "a.bin", 1, true},
+
+		{"max size", conf, true, "a.conf", 1024, false},
+		{"over max size", conf, true, "a.conf", 1025, true},
+		{"size unknown", conf, true, "a.conf", 0, false},
+		{"name", conf, true, "config-1", 1, false},
+		{"name not matched", conf, true, "a.bin", 1, true},
+		{"name not matched in dir", conf, true, "etc/a.conf", 1, true},
+		{"name unknown", conf, true, "", 1, false},
+		{"direction first", conf, false, "a.conf", 1, true},
+	}
+
+	for _, tt := range tests {
+		err := tt.policy.check(tt.upload, tt.file, tt.size)
+
+		if tt.denied {
+			if !errors.Is(err, errFileDenied) {
+				t.Errorf("%s: error %v, want denied", tt.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestFilePolicyGroup(t *testing.T) {
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{FileTransfer: FileTransferConfig{
+		Default: FilePolicy{MaxSize: 1},
+		Groups:  map[string]FilePolicy{"prod": {Direction: FileDirectionNone}},
+	}})
+
+	if p := srv.filePolicy("prod"); p.Direction != FileDirectionNone || p.MaxSize != 0 {
+		t.Errorf("prod: got %+v, want the group policy", p)
+	}
+
+	if p := srv.filePolicy("lab"); p.MaxSize != 1 {
+		t.Errorf("lab: got %+v, want the default", p)
+	}
+
+	if p := srv.filePolicy(""); p.MaxSize != 1 {
+		t.Errorf("no group: got %+v, want the default", p)
+	}
+}
@@ -0,0 +1,838 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+	"github.com/zhaojh329/rttys/v5/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// FileTransfer transfers a file from or to a device without a user in a
+// browser terminal. It opens a terminal session on the device, runs
+// "rtty -R" or "rtty -S" in the shell and exchanges the file messages
+// like the web terminal does: each chunk is acknowledged before the
+// next one is sent.
+//
+// The session counts against the limits of the terminal sessions. The
+// commands are run by the server, not typed by the user, so the command
+// filter doesn't apply, nor the idle timeout and lifetime of the
+// terminals: each step has its own timeout instead. A transfer is not
+// resumable, see handleFileGet.
+type FileTransfer struct {
+	id       string
+	sid      string
+	dev      *Device
+	path     string
+	upload   bool
+	username string
+	owner    string
+	size     int64
+	created  time.Time
+
+	// Replace the file if it exists on upload
+	overwrite bool
+
+	// Where the transfer is requested, for the log
+	via string
+
+	// File policy of the device
+	policy FilePolicy
+
+	transferred atomic.Int64
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// Filled by the read loop of the device without blocking. The term
+	// channel is larger as the window of the terminal acks is in bytes,
+	// which may come in many small messages.
+	login chan bool
+	term  chan []byte
+	file  chan fileMsg
+
+	// Terminal output since the last command was typed
+	out bytes.Buffer
+	seq int
+
+	// Counted for the session limits
+	slot termSlot
+}
+
+type fileMsg struct {
+	typ  byte
+	data []byte
+}
+
+type FileTransferInfo struct {
+	ID          string `json:"id"`
+	Devid       string `json:"devid"`
+	Group       string `json:"group"`
+	Path        string `json:"path"`
+	Upload      bool   `json:"upload"`
+	Username    string `json:"username"`
+	Size        int64  `json:"size"`
+	Transferred int64  `json:"transferred"`
+	Created     int64  `json:"created"`
+}
+
+const (
+	fileChunkSize = 63 * 1024
+
+	// Sizes are carried in 32 bits by the protocol
+	fileSizeLimit = 0xffffffff
+
+	// Maximum time to wait for the device in each step
+	fileStepTimeout = 30 * time.Second
+
+	// Maximum time to get a shell after the terminal is opened
+	fileShellTimeout = 15 * time.Second
+)
+
+var (
+	errFileDevOffline  = errors.New("device offline")
+	errFileNotFound    = errors.New("no such file")
+	errFileExists      = errors.New("file already exists")
+	errFileLogin       = errors.New("login to the device fail")
+	errFileBusy        = errors.New("device busy")
+	errFileTimeout     = errors.New("timeout")
+	errFileTermClosed  = errors.New("terminal closed by the device")
+	errFileAborted     = errors.New("transfer aborted by the device")
+	errFileCanceled    = errors.New("transfer canceled")
+	errFileChecksum    = errors.New("checksum mismatch")
+	errFileFailed      = errors.New("transfer fail")
+	errFileInvalidPath = errors.New("absolute file path required")
+	errFileDenied      = errors.New("file transfer denied")
+	errFileOverflow    = errors.New("too many pending messages from the device")
+	errFileNoResume    = errors.New("partial transfers not supported")
+)
+
+var fileErrStatus = map[error]int{
+	errFileNotFound:    http.StatusNotFound,
+	errFileExists:      http.StatusConflict,
+	errFileLogin:       http.StatusForbidden,
+	errFileDevOffline:  http.StatusNotFound,
+	errFileBusy:        http.StatusServiceUnavailable,
+	errFileTimeout:     http.StatusGatewayTimeout,
+	errFileInvalidPath: http.StatusBadRequest,
+	errFileDenied:      http.StatusForbidden,
+	errTermLimit:       http.StatusTooManyRequests,
+}
+
+var (
+	loginPromptRe    = regexp.MustCompile(`(?i)login:\s*$`)
+	passwordPromptRe = regexp.MustCompile(`(?i)password:\s*$`)
+	ansiEscapeRe     = regexp.MustCompile(`\x1b\[[0-9;?]*[a-zA-Z]`)
+	sha256Re         = regexp.MustCompile(`\b[0-9a-f]{64}\b`)
+)
+
+func (t *FileTransfer) Info() *FileTransferInfo {
+	return &FileTransferInfo{
+		ID:          t.id,
+		Devid:       t.dev.id,
+		Group:       t.dev.group,
+		Path:        t.path,
+		Upload:      t.upload,
+		Username:    t.username,
+		Size:        t.size,
+		Transferred: t.transferred.Load(),
+		Created:     t.created.Unix(),
+	}
+}
+
+// FileTransfers returns the file transfers in progress
+func (srv *RttyServer) FileTransfers() []*FileTransfer {
+	transfers := make([]*FileTransfer, 0)
+
+	srv.fileTransfers.Range(func(key, value any) bool {
+		transfers = append(transfers, value.(*FileTransfer))
+		return true
+	})
+
+	return transfers
+}
+
+func (srv *RttyServer) newFileTransfer(ctx context.Context, dev *Device, path string, upload bool, username, owner string) *FileTransfer {
+	t := &FileTransfer{
+		id:       utils.GenUniqueID(),
+		sid:      utils.GenUniqueID(),
+		dev:      dev,
+		path:     path,
+		upload:   upload,
+		username: username,
+		owner:    owner,
+		created:  time.Now(),
+		via:      fileViaAPI,
+		policy:   srv.filePolicy(dev.group),
+		login:    make(chan bool, 1),
+		term:     make(chan []byte, 256),
+		file:     make(chan fileMsg, 16),
+	}
+
+	t.ctx, t.cancel = context.WithCancelCause(ctx)
+
+	go func() {
+		select {
+		case <-t.ctx.Done():
+		case <-dev.ctx.Done():
+			t.cancel(errFileDevOffline)
+		}
+	}()
+
+	srv.fileTransfers.Store(t.id, t)
+
+	return t
+}
+
+func (t *FileTransfer) close(srv *RttyServer) {
+	if _, loaded := t.dev.transfers.LoadAndDelete(t.sid); loaded {
+		t.dev.WriteMsg(proto.MsgTypeLogout, t.sid)
+	}
+
+	t.cancel(context.Canceled)
+	srv.fileTransfers.Delete(t.id)
+	srv.releaseTerm(&t.slot)
+}
+
+// recvTerm is called with the terminal output from the device. It must
+// not block the read loop of the device: the device waits for the acks,
+// so the channel only fills up if the transfer is stuck, which is
+// canceled then.
+func (t *FileTransfer) recvTerm(data []byte) {
+	select {
+	case t.term <- bytes.Clone(data):
+	default:
+		t.cancel(errFileOverflow)
+	}
+}
+
+// recvFile is called with the file messages from the device, like
+// recvTerm.
+func (t *FileTransfer) recvFile(typ byte, data []byte) {
+	select {
+	case t.file <- fileMsg{typ, bytes.Clone(data)}:
+	default:
+		t.cancel(errFileOverflow)
+	}
+}
+
+// open opens the terminal session and answers the prompts of login(1)
+// with the given credentials, unless the device logs in automatically.
+// The size must be set before for an upload.
+func (t *FileTransfer) open(srv *RttyServer, username, password string) error {
+	if err := t.policy.check(t.upload, path.Base(t.path), t.size); err != nil {
+		return err
+	}
+
+	if err := srv.acquireTerm(&t.slot, t.dev, t.owner); err != nil {
+		return err
+	}
+
+	t.dev.transfers.Store(t.sid, t)
+
+	if err := t.dev.WriteMsg(proto.MsgTypeLogin, t.sid); err != nil {
+		return err
+	}
+
+	select {
+	case ok := <-t.login:
+		if !ok {
+			return errFileBusy
+		}
+		srv.termLoggedIn(&t.slot)
+	case <-time.After(TermLoginTimeout):
+		return errFileTimeout
+	case <-t.ctx.Done():
+		return context.Cause(t.ctx)
+	}
+
+	deadline := time.Now().Add(fileShellTimeout)
+	sentUser := false
+	sentPassword := false
+
+	for time.Now().Before(deadline) {
+		// Look at the output once it settles
+		if _, err := t.next(500 * time.Millisecond); err != errFileTimeout {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		last := t.lastLine()
+
+		switch {
+		case loginPromptRe.MatchString(last):
+			if username == "" || sentUser {
+				return errFileLogin
+			}
+			sentUser = true
+			t.out.Reset()
+			t.write(username + "\n")
+
+		case passwordPromptRe.MatchString(last):
+			if sentPassword {
+				return errFileLogin
+			}
+			sentPassword = true
+			t.out.Reset()
+			t.write(password + "\n")
+
+		default:
+			// Keep the commands typed below out of the output
+			if _, _, err := t.run("stty -echo", 2*time.Second); err == nil {
+				return nil
+			} else if err != errFileTimeout {
+				return err
+			}
+		}
+	}
+
+	return errFileTimeout
+}
+
+// next waits for a message of the terminal session. The terminal output
+// is appended to t.out and acknowledged, file messages are returned.
+func (t *FileTransfer) next(timeout time.Duration) (*fileMsg, error) {
+	tmr := time.NewTimer(timeout)
+	defer tmr.Stop()
+
+	select {
+	case data := <-t.term:
+		// Only the end of the output is needed to find the markers
+		if t.out.Len() > 64*1024 {
+			tail := bytes.Clone(t.out.Bytes()[t.out.Len()-4096:])
+			t.out.Reset()
+			t.out.Write(tail)
+		}
+
+		t.out.Write(data)
+		t.dev.WriteMsg(proto.MsgTypeAck, t.sid, uint16(len(data)))
+
+		return nil, nil
+
+	case msg := <-t.file:
+		return &msg, nil
+
+	case <-tmr.C:
+		return nil, errFileTimeout
+
+	case <-t.ctx.Done():
+		return nil, context.Cause(t.ctx)
+	}
+}
+
+func (t *FileTransfer) write(s string) error {
+	return t.dev.WriteMsg(proto.MsgTypeTermData, t.sid, s)
+}
+
+func (t *FileTransfer) lastLine() string {
+	out := strings.TrimRight(ansiEscapeRe.ReplaceAllString(t.out.String(), ""), "\r\n")
+	return out[strings.LastIndexAny(out, "\r\n")+1:]
+}
+
+// start types the command followed by an echo of its exit status, and
+// returns the pattern of the echo.
+func (t *FileTransfer) start(cmd string) *regexp.Regexp {
+	t.seq++
+	t.out.Reset()
+
+	// The marker is split by quotes, so that the echo of the command
+	// line doesn't match
+	t.write(fmt.Sprintf("%s; echo \"__RTTYS_\"\"%d_$?\"\n", cmd, t.seq))
+
+	return regexp.MustCompile(fmt.Sprintf(`__RTTYS_%d_(\d+)`, t.seq))
+}
+
+// done returns the output and the exit status of the command started
+// with the marker, if it has exited.
+func (t *FileTransfer) done(marker *regexp.Regexp) (string, int, bool) {
+	out := t.out.Bytes()
+
+	loc := marker.FindSubmatchIndex(out)
+	if loc == nil {
+		return "", 0, false
+	}
+
+	status, _ := strconv.Atoi(string(out[loc[2]:loc[3]]))
+
+	return strings.TrimSpace(ansiEscapeRe.ReplaceAllString(string(out[:loc[0]]), "")), status, true
+}
+
+// run runs the command in the shell and returns its output and exit
+// status. timeout is the maximum time without output.
+func (t *FileTransfer) run(cmd string, timeout time.Duration) (string, int, error) {
+	marker := t.start(cmd)
+
+	for {
+		if _, err := t.next(timeout); err != nil {
+			return "", 0, err
+		}
+
+		if out, status, ok := t.done(marker); ok {
+			return out, status, nil
+		}
+	}
+}
+
+// wait waits for the file message of typ, while the command started
+// with the marker runs.
+func (t *FileTransfer) wait(marker *regexp.Regexp, typ byte) (*fileMsg, error) {
+	for {
+		msg, err := t.next(fileStepTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		if msg == nil {
+			if out, _, ok := t.done(marker); ok {
+				return nil, fmt.Errorf("%w: %s", errFileFailed, lastLine(out))
+			}
+			continue
+		}
+
+		if msg.typ == typ {
+			return msg, nil
+		}
+
+		if msg.typ == proto.MsgTypeFileAbort {
+			return nil, errFileAborted
+		}
+	}
+}
+
+// wait for the command started with the marker to exit
+func (t *FileTransfer) waitDone(marker *regexp.Regexp) (string, error) {
+	for {
+		if out, _, ok := t.done(marker); ok {
+			return out, nil
+		}
+
+		if _, err := t.next(fileStepTimeout); err != nil {
+			return "", err
+		}
+	}
+}
+
+// checksum returns the SHA-256 of the file computed by the device, or an
+// empty string if sha256sum isn't available.
+func (t *FileTransfer) checksum(name string) (string, error) {
+	out, status, err := t.run("sha256sum "+shellQuote(name), fileStepTimeout)
+	if err != nil || status != 0 {
+		return "", err
+	}
+
+	return sha256Re.FindString(out), nil
+}
+
+// doUpload writes the data of r to the path on the device, and returns
+// the checksum of the data. With overwrite, the data are written next to
+// the file, which is replaced once the checksum is verified.
+func (t *FileTransfer) doUpload(r io.Reader) (string, error) {
+	if !t.overwrite {
+		if _, status, err := t.run("[ ! -e "+shellQuote(t.path)+" ]", fileStepTimeout); err != nil {
+			return "", err
+		} else if status != 0 {
+			return "", errFileExists
+		}
+
+		return t.receive(t.path, r)
+	}
+
+	dir, name := path.Split(t.path)
+	tmp := dir + "." + name + ".rttys-" + t.id[:8]
+
+	sum, err := t.receive(tmp, r)
+	if err != nil {
+		if t.ctx.Err() == nil {
+			t.run("rm -f "+shellQuote(tmp), fileStepTimeout)
+		}
+		return "", err
+	}
+
+	out, status, err := t.run("mv -f "+shellQuote(tmp)+" "+shellQuote(t.path), fileStepTimeout)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 0 {
+		t.run("rm -f "+shellQuote(tmp), fileStepTimeout)
+		return "", fmt.Errorf("%w: %s", errFileFailed, lastLine(out))
+	}
+
+	return sum, nil
+}
+
+// receive runs "rtty -R" to write the data of r to the file of the path
+func (t *FileTransfer) receive(filePath string, r io.Reader) (string, error) {
+	dir, name := path.Split(filePath)
+
+	marker := t.start("cd " + shellQuote(dir) + " && rtty -R")
+
+	if _, err := t.wait(marker, proto.MsgTypeFileRecv); err != nil {
+		return "", err
+	}
+
+	err := t.dev.WriteMsg(proto.MsgTypeFile, t.sid, proto.MsgTypeFileInfo, uint32(t.size), name)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	buf := make([]byte, fileChunkSize)
+	remain := t.size
+
+	for remain > 0 {
+		n := int(min(remain, fileChunkSize))
+
+		if _, err := io.ReadFull(r, buf[:n]); err != nil {
+			t.dev.WriteMsg(proto.MsgTypeFile, t.sid, proto.MsgTypeFileAbort)
+			return "", err
+		}
+
+		h.Write(buf[:n])
+
+		if err := t.dev.limiter.wait(t.ctx, n); err != nil {
+			return "", context.Cause(t.ctx)
+		}
+
+		err := t.dev.WriteMsg(proto.MsgTypeFile, t.sid, proto.MsgTypeFileData, buf[:n])
+		if err != nil {
+			return "", err
+		}
+
+		remain -= int64(n)
+		t.transferred.Add(int64(n))
+
+		// The device doesn't acknowledge the last chunk
+		if remain > 0 {
+			if _, err := t.wait(marker, proto.MsgTypeFileAck); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if t.size == 0 {
+		t.dev.WriteMsg(proto.MsgTypeFile, t.sid, proto.MsgTypeFileData)
+	}
+
+	// rtty -R exits once the file is written
+	if _, err := t.waitDone(marker); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	devSum, err := t.checksum(filePath)
+	if err != nil {
+		return "", err
+	}
+
+	if devSum != "" && devSum != sum {
+		return "", errFileChecksum
+	}
+
+	return sum, nil
+}
+
+// stat returns the size of the file
+func (t *FileTransfer) stat() error {
+	out, status, err := t.run("wc -c < "+shellQuote(t.path), fileStepTimeout)
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return fmt.Errorf("%w: %s", errFileNotFound, lastLine(out))
+	}
+
+	fields := strings.Fields(out)
+	if len(fields) == 0 {
+		return errFileFailed
+	}
+
+	size, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errFileFailed, lastLine(out))
+	}
+
+	t.size = size
+
+	return nil
+}
+
+// doDownload writes the file to w and returns its checksum, with the
+// headers set once the device starts to send. The checksum computed by
+// the device is sent in the X-Checksum-Sha256 header and compared with
+// the received data.
+func (t *FileTransfer) doDownload(w http.ResponseWriter) (string, bool, error) {
+	if err := t.stat(); err != nil {
+		return "", false, err
+	}
+
+	if t.size > fileSizeLimit {
+		return "", false, fmt.Errorf("%w: file too large", errFileFailed)
+	}
+
+	if err := t.policy.check(false, "", t.size); err != nil {
+		return "", false, err
+	}
+
+	devSum, err := t.checksum(t.path)
+	if err != nil {
+		return "", false, err
+	}
+
+	marker := t.start("rtty -S " + shellQuote(t.path))
+
+	if _, err := t.wait(marker, proto.MsgTypeFileSend); err != nil {
+		return "", false, err
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(t.size, 10))
+	w.Header().Set("Accept-Ranges", "none")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(t.path)))
+	if devSum != "" {
+		w.Header().Set("X-Checksum-Sha256", devSum)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	h := sha256.New()
+
+	for {
+		if err := t.dev.WriteMsg(proto.MsgTypeFile, t.sid, proto.MsgTypeFileAck); err != nil {
+			return "", true, err
+		}
+
+		msg, err := t.wait(marker, proto.MsgTypeFileData)
+		if err != nil {
+			return "", true, err
+		}
+
+		if len(msg.data) == 0 {
+			break
+		}
+
+		if _, err := w.Write(msg.data); err != nil {
+			return "", true, err
+		}
+
+		h.Write(msg.data)
+		t.transferred.Add(int64(len(msg.data)))
+
+		// The device waits for the ack to send more
+		if err := t.dev.limiter.wait(t.ctx, len(msg.data)); err != nil {
+			return "", true, err
+		}
+	}
+
+	if _, err := t.waitDone(marker); err != nil {
+		return "", true, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	if t.transferred.Load() != t.size || (devSum != "" && devSum != sum) {
+		return "", true, errFileChecksum
+	}
+
+	return sum, true, nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	return s[strings.LastIndexAny(s, "\r\n")+1:]
+}
+
+func fileErrResp(c *gin.Context, err error) {
+	status := http.StatusBadGateway
+
+	for e, s := range fileErrStatus {
+		if errors.Is(err, e) {
+			status = s
+			break
+		}
+	}
+
+	c.JSON(status, gin.H{"err": err.Error()})
+}
+
+// filePath returns the cleaned absolute path of the path query
+func filePath(c *gin.Context) (string, error) {
+	p := c.Query("path")
+
+	if !path.IsAbs(p) {
+		return "", errFileInvalidPath
+	}
+
+	return path.Clean(p), nil
+}
+
+func (a *APIServer) fileTransfer(c *gin.Context, upload bool, size int64) (*FileTransfer, bool) {
+	if !a.callUserHookUrl(c) {
+		c.Status(http.StatusForbidden)
+		return nil, false
+	}
+
+	p, err := filePath(c)
+	if err != nil || (upload && p == "/") {
+		fileErrResp(c, errFileInvalidPath)
+		return nil, false
+	}
+
+	dev := a.srv.GetDevice(c.Query("group"), c.Param("devid"))
+	if dev == nil {
+		fileErrResp(c, errFileDevOffline)
+		return nil, false
+	}
+
+	t := a.srv.newFileTransfer(c.Request.Context(), dev, p, upload, a.sessionUser(c), a.sessionOwner(c))
+	t.size = size
+
+	err = t.open(a.srv, c.GetHeader("X-Device-Username"), c.GetHeader("X-Device-Password"))
+	if err != nil {
+		log.Error().Msgf("open terminal for file transfer on device '%s' fail: %v", dev.id, err)
+		t.close(a.srv)
+		t.log(a.srv, "", err)
+		fileErrResp(c, err)
+		return nil, false
+	}
+
+	return t, true
+}
+
+// handleFilePut uploads the request body to the path on the device. A
+// partial upload by Content-Range is rejected rather than written as the
+// whole file.
+func (a *APIServer) handleFilePut(c *gin.Context) {
+	if c.GetHeader("Content-Range") != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"err": errFileNoResume.Error()})
+		return
+	}
+
+	size := c.Request.ContentLength
+	if size < 0 {
+		c.Status(http.StatusLengthRequired)
+		return
+	}
+
+	if size > fileSizeLimit {
+		c.Status(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	t, ok := a.fileTransfer(c, true, size)
+	if !ok {
+		return
+	}
+	defer t.close(a.srv)
+
+	t.overwrite = c.Query("overwrite") == "1"
+
+	log.Info().Msgf("upload file '%s' (%d bytes) to device '%s'", t.path, size, t.dev.id)
+
+	sum, err := t.doUpload(c.Request.Body)
+
+	t.log(a.srv, sum, err)
+
+	if err != nil {
+		log.Error().Msgf("upload file '%s' to device '%s' fail: %v", t.path, t.dev.id, err)
+		fileErrResp(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"path":   t.path,
+		"size":   size,
+		"sha256": sum,
+	})
+}
+
+// handleFileGet downloads the file of the path from the device. Range
+// requests aren't supported, the whole file is always sent: "rtty -S"
+// has no offset, and skipping to it on the device would need a copy of
+// the rest of the file there.
+func (a *APIServer) handleFileGet(c *gin.Context) {
+	t, ok := a.fileTransfer(c, false, 0)
+	if !ok {
+		return
+	}
+	defer t.close(a.srv)
+
+	sum, started, err := t.doDownload(c.Writer)
+
+	t.log(a.srv, sum, err)
+
+	if err == nil {
+		return
+	}
+
+	log.Error().Msgf("download file '%s' from device '%s' fail: %v", t.path, t.dev.id, err)
+
+	// Once started, the body is shorter than the Content-Length, so the
+	// connection is closed and the client sees an incomplete response
+	if !started {
+		fileErrResp(c, err)
+	}
+}
+
+// handleFileTransfers lists the file transfers in progress, all for
+// admins and the own transfers for the others.
+func (a *APIServer) handleFileTransfers(c *gin.Context) {
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	infos := make([]*FileTransferInfo, 0)
+
+	for _, t := range a.srv.FileTransfers() {
+		if (admin || t.username == username) && tokenGroupAllowed(c, t.dev.group) {
+			infos = append(infos, t.Info())
+		}
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handleFileTransferCancel(c *gin.Context) {
+	v, ok := a.srv.fileTransfers.Load(c.Param("id"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	t := v.(*FileTransfer)
+
+	if (!a.isAdmin(c) && t.username != a.sessionUser(c)) || !tokenGroupAllowed(c, t.dev.group) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	t.cancel(errFileCanceled)
+
+	c.Status(http.StatusOK)
+}
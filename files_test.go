@@ -0,0 +1,76 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFileTransferTermLimit(t *testing.T) {
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{Term: TermConfig{MaxPerUser: 1}})
+
+	dev, peer := newTestDevice(t, "dev1", 4)
+	go io.Copy(io.Discard, peer)
+
+	total := func() int {
+		srv.termsMu.Lock()
+		defer srv.termsMu.Unlock()
+		return srv.terms.total
+	}
+
+	// A terminal session of the user
+	var term termSlot
+
+	if err := srv.acquireTerm(&term, dev, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := srv.newFileTransfer(context.Background(), dev, "/tmp/a", false, "alice", "alice")
+
+	if err := tr.open(srv, "", ""); !errors.Is(err, errTermLimit) {
+		t.Errorf("over the limit: error %v, want %v", err, errTermLimit)
+	}
+	tr.close(srv)
+
+	if n := total(); n != 1 {
+		t.Errorf("over the limit: %d sessions, want 1", n)
+	}
+
+	// Counted once the terminal session ends
+	srv.releaseTerm(&term)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tr = srv.newFileTransfer(ctx, dev, "/tmp/a", false, "alice", "alice")
+
+	done := make(chan error, 1)
+	go func() { done <- tr.open(srv, "", "") }()
+
+	for i := 0; total() != 1; i++ {
+		if i == 100 {
+			t.Fatal("transfer not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	var other termSlot
+
+	if err := srv.acquireTerm(&other, dev, "alice"); !errors.Is(err, errTermLimit) {
+		t.Errorf("terminal during the transfer: error %v, want %v", err, errTermLimit)
+	}
+
+	cancel()
+	<-done
+	tr.close(srv)
+
+	if n := total(); n != 0 {
+		t.Errorf("transfer closed: %d sessions, want 0", n)
+	}
+}
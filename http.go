@@ -3,10 +3,9 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
@@ -16,6 +15,7 @@ import (
 	"io/fs"
 	"net"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"strconv"
 	"strings"
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/zhaojh329/rtty-go/proto"
+	xlog "github.com/zhaojh329/rttys/v5/log"
 	"github.com/zhaojh329/rttys/v5/utils"
 
 	"github.com/gin-gonic/gin"
@@ -35,223 +36,199 @@ type HttpProxySession struct {
 	expire   atomic.Int64
 	ctx      context.Context
 	cancel   context.CancelFunc
+	id       string
 	devid    string
 	group    string
 	destaddr string
+	dest     *httpProxyDest
 	https    bool
-}
 
-var httpProxySessions = sync.Map{}
+	// The user who created the session, and the sid of the user's
+	// login session which revokes it on signout
+	username string
+	loginSid string
+	clientIP string
+	created  time.Time
 
-const httpProxySessionsExpire = 15 * time.Minute
+	// The share link the session of a guest is created by, who can only
+	// view the pages
+	share    string
+	readOnly bool
 
-func (ses *HttpProxySession) Expire() {
-	ses.expire.Store(time.Now().Add(httpProxySessionsExpire).Unix())
-}
+	idleTimeout time.Duration
+	deadline    time.Time // zero for no absolute lifetime
 
-func (ses *HttpProxySession) String() string {
-	return fmt.Sprintf("{devid: %s, group: %s, destaddr: %s, https: %v}",
-		ses.devid, ses.group, ses.destaddr, ses.https)
-}
-
-func (srv *RttyServer) ListenHttpProxy() {
-	cfg := &srv.cfg
+	// Bytes sent to and received from the device
+	tx atomic.Uint64
+	rx atomic.Uint64
 
-	if cfg.AddrHttpProxy != "" {
-		addr, err := net.ResolveTCPAddr("tcp", cfg.AddrHttpProxy)
-		if err != nil {
-			log.Warn().Msg("invalid http proxy addr: " + err.Error())
-		} else {
-			srv.httpProxyPort = addr.Port
-		}
-	}
-
-	ln, err := net.Listen("tcp", cfg.AddrHttpProxy)
-	if err != nil {
-		log.Fatal().Msg(err.Error())
-	}
-	defer ln.Close()
-
-	srv.httpProxyPort = ln.Addr().(*net.TCPAddr).Port
-
-	log.Info().Msgf("Listen http proxy on: %s", ln.Addr().(*net.TCPAddr))
+	limiter *rateLimiter
 
-	go httpProxySessionsClean()
+	transportOnce sync.Once
+	transport     *http.Transport
+}
 
-	for {
-		c, err := ln.Accept()
-		if err != nil {
-			log.Error().Msg(err.Error())
-			continue
-		}
+// Used if http-proxy.session-idle-timeout is not set
+const httpProxySessionsExpire = 15 * time.Minute
 
-		go doHttpProxy(srv, c)
-	}
+type HttpProxySessionInfo struct {
+	ID       string `json:"id"`
+	Devid    string `json:"devid"`
+	Group    string `json:"group"`
+	Dest     string `json:"dest"`
+	Https    bool   `json:"https"`
+	Username string `json:"username"`
+	ClientIP string `json:"clientIP"`
+	Created  int64  `json:"created"`
+	Expire   int64  `json:"expire"`
+	Tx       uint64 `json:"tx"`
+	Rx       uint64 `json:"rx"`
+	Share    string `json:"share,omitempty"`
+	ReadOnly bool   `json:"readOnly"`
 }
 
-func httpProxySessionsClean() {
-	for {
-		time.Sleep(time.Second * 30)
+func (ses *HttpProxySession) Expire() {
+	expire := time.Now().Add(ses.idleTimeout)
 
-		httpProxySessions.Range(func(key, value any) bool {
-			ses := value.(*HttpProxySession)
-			if time.Now().Unix() > ses.expire.Load() {
-				log.Debug().Msgf("Http proxy session '%s' expired", key)
-				ses.cancel()
-				httpProxySessions.Delete(key)
-			}
-			return true
-		})
+	if !ses.deadline.IsZero() && expire.After(ses.deadline) {
+		expire = ses.deadline
 	}
-}
 
-var httpBufPool = sync.Pool{
-	New: func() any {
-		return &HttpBuf{
-			buf: make([]byte, 1024*32),
-		}
-	},
+	ses.expire.Store(expire.Unix())
 }
 
-type HttpBuf struct {
-	buf []byte
+func (ses *HttpProxySession) String() string {
+	return fmt.Sprintf("{devid: %s, group: %s, destaddr: %s, https: %v, user: %s, ip: %s}",
+		ses.devid, ses.group, ses.destaddr, ses.https, ses.username, ses.clientIP)
 }
 
-func doHttpProxy(srv *RttyServer, c net.Conn) {
-	defer logPanic()
-	defer c.Close()
-
-	head := bytebufferpool.Get()
-	defer bytebufferpool.Put(head)
-
-	br := bufio.NewReader(c)
-
-	ses := httpReadRequest(c, br, head)
-	if ses == nil {
-		return
+func (ses *HttpProxySession) Info() *HttpProxySessionInfo {
+	return &HttpProxySessionInfo{
+		ID:       ses.id,
+		Devid:    ses.devid,
+		Group:    ses.group,
+		Dest:     ses.destaddr,
+		Https:    ses.https,
+		Username: ses.username,
+		ClientIP: ses.clientIP,
+		Created:  ses.created.Unix(),
+		Expire:   ses.expire.Load(),
+		Tx:       ses.tx.Load(),
+		Rx:       ses.rx.Load(),
+		Share:    ses.share,
+		ReadOnly: ses.readOnly,
 	}
+}
 
-	dev := srv.GetDevice(ses.group, ses.devid)
-	if dev == nil {
-		log.Debug().Msgf(`device "%s" group "%s" offline`, ses.devid, ses.group)
-		sendHTTPErrorResponse(c, "offline")
-		return
+// allowed reports whether the session can be used from the client
+// address. With session-bind-ip, only the client IP which created the
+// session is allowed.
+func (ses *HttpProxySession) allowed(srv *RttyServer, remoteAddr string) bool {
+	if !srv.config().HttpProxy.SessionBindIP {
+		return true
 	}
 
-	destAddr, host := genDestAddrAndHost(ses.destaddr, ses.https)
+	return remoteIP(remoteAddr) == ses.clientIP
+}
 
-	var srcAddr [18]byte
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
 
-	tcpAddr2Bytes(c.RemoteAddr().(*net.TCPAddr), srcAddr[:])
+// ServeHttpProxy serves the HTTP proxy on the listener until the server
+// is stopped. The session of each request is given by the cookie
+// "rtty-http-sid".
+func (srv *RttyServer) ServeHttpProxy(ln net.Listener) error {
+	hs := &http.Server{
+		Handler:           http.HandlerFunc(srv.handleHttpProxy),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       90 * time.Second,
+	}
 
-	ctx, cancel := context.WithCancel(ses.ctx)
-	defer cancel()
+	if !srv.trackServer(hs) {
+		ln.Close()
+		return net.ErrClosed
+	}
 
-	go func() {
-		<-ctx.Done()
-		c.Close()
-		log.Debug().Msgf("http proxy conn closed: %s", ses)
-		dev.https.Delete(srcAddr)
-		sendHttpReq(dev, ses.https, srcAddr[:], destAddr, nil)
-	}()
+	srv.httpProxyPort.Store(int32(ln.Addr().(*net.TCPAddr).Port))
 
-	log.Debug().Msgf("new http proxy conn: %s", ses)
+	log.Info().Msgf("Listen http proxy on: %s", ln.Addr().(*net.TCPAddr))
 
-	dev.https.Store(srcAddr, c)
+	err := hs.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
 
-	// Rewrite the HTTP host
-	head.WriteString("Host: " + host + "\r\n")
+	return err
+}
 
-	sendHttpReq(dev, ses.https, srcAddr[:], destAddr, head.B)
+func (srv *RttyServer) handleHttpProxy(w http.ResponseWriter, r *http.Request) {
+	defer xlog.LogPanic()
 
-	hb := httpBufPool.Get().(*HttpBuf)
-	defer httpBufPool.Put(hb)
+	addr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
 
-	for {
-		n, err := br.Read(hb.buf)
-		if err != nil {
-			return
-		}
-		sendHttpReq(dev, ses.https, srcAddr[:], destAddr, hb.buf[:n])
-		ses.Expire()
+	if !ipAllowed(srv.config().User.AllowedCIDRs, addr) {
+		log.Debug().Msgf("http proxy from %s not allowed", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
 	}
-}
 
-func httpReadRequest(conn net.Conn, br *bufio.Reader, head *bytebufferpool.ByteBuffer) *HttpProxySession {
-	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if srv.config().HttpProxy.Mode == HttpProxyModePath {
+		srv.serveHttpProxyPath(w, r)
+		return
+	}
 
-	// First line: GET /index.html HTTP/1.0
-	line, err := br.ReadString('\n')
+	cookie, err := r.Cookie("rtty-http-sid")
 	if err != nil {
-		return nil
+		log.Debug().Msgf(`not found cookie "rtty-http-sid"`)
+		writeHTTPErrorPage(w, "unauthorized")
+		return
 	}
 
-	head.WriteString(line)
+	srv.serveHttpProxy(w, r, cookie.Value, "", r.URL.Path)
+}
 
-	sid := ""
+func (srv *RttyServer) httpProxySessionsClean() {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
 
 	for {
-		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-
-		line, err := br.ReadString('\n')
-		if err != nil {
-			return nil
-		}
-		if line == "\r\n" {
-			break
-		}
-
-		k, v, ok := strings.Cut(line, ":")
-		if !ok {
-			break
-		}
-
-		k = strings.ToLower(k)
-		v = strings.TrimLeft(v, " \t")
-
-		if k == "host" {
-			continue
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-ticker.C:
 		}
 
-		head.WriteString(line)
-
-		if k == "cookie" {
-			cookies, err := http.ParseCookie(v)
-			if err != nil {
-				break
-			}
-
-			for _, cookie := range cookies {
-				if cookie.Name == "rtty-http-sid" {
-					sid = cookie.Value
-					break
-				}
+		srv.httpProxySessions.Range(func(key, value any) bool {
+			ses := value.(*HttpProxySession)
+			if time.Now().Unix() > ses.expire.Load() {
+				log.Debug().Msgf("Http proxy session '%s' expired", key)
+				ses.cancel()
+				srv.httpProxySessions.Delete(key)
 			}
-			break
-		}
-	}
-
-	if sid == "" {
-		log.Debug().Msgf(`not found cookie "rtty-http-sid"`)
-		sendHTTPErrorResponse(conn, "unauthorized")
-		return nil
-	}
-
-	ses, ok := httpProxySessions.Load(sid)
-	if !ok {
-		log.Debug().Msgf(`not found httpProxySession "%s"`, sid)
-		sendHTTPErrorResponse(conn, "unauthorized")
-		return nil
+			return true
+		})
 	}
+}
 
-	conn.SetReadDeadline(time.Time{})
+var httpBufPool = sync.Pool{
+	New: func() any {
+		return &HttpBuf{
+			buf: make([]byte, 1024*32),
+		}
+	},
+}
 
-	return ses.(*HttpProxySession)
+type HttpBuf struct {
+	buf []byte
 }
 
 func httpProxyRedirect(a *APIServer, c *gin.Context, group string) {
 	srv := a.srv
-	cfg := &srv.cfg
 
 	devid := c.Param("devid")
 	proto := c.Param("proto")
@@ -265,7 +242,7 @@ func httpProxyRedirect(a *APIServer, c *gin.Context, group string) {
 
 	log.Debug().Msgf("httpProxyRedirect devid: %s, proto: %s, addr: %s, path: %s", devid, proto, addr, rawPath)
 
-	_, _, err := httpProxyVaildAddr(addr, proto == "https")
+	dest, err := parseHttpProxyDest(addr, proto == "https")
 	if err != nil {
 		log.Debug().Msgf("invalid addr: %s", addr)
 		c.Status(http.StatusBadRequest)
@@ -285,9 +262,61 @@ func httpProxyRedirect(a *APIServer, c *gin.Context, group string) {
 		return
 	}
 
+	if _, err := dest.encode(dev.caps); err != nil {
+		log.Debug().Msgf("http proxy to %s for device '%s': %v", addr, devid, err)
+		if err == errHttpProxyNameUnsupported {
+			c.Redirect(http.StatusFound, "/error/hostname")
+		} else {
+			c.Redirect(http.StatusFound, "/error/unsupported")
+		}
+		return
+	}
+
+	sid, _ := srv.newHttpProxySession(dev, addr, dest, c.Request.RemoteAddr, a.sessionUser(c), loginSid(c), nil)
+
+	log.Debug().Msgf(`new httpProxySession "%s" for device "%s"`, sid, devid)
+
+	httpProxyRedirectSession(srv, c, sid, devid, path)
+}
+
+// httpProxyRedirectSession redirects the client to the path on the HTTP
+// proxy of the session with the sid, which replaces the old session of
+// the client in port mode.
+func httpProxyRedirectSession(srv *RttyServer, c *gin.Context, sid, devid string, path *url.URL) {
+	cfg := srv.config()
+
+	query := fmt.Sprintf("?_=%d", time.Now().Unix())
+
+	if path.RawQuery != "" {
+		query += "&" + path.RawQuery
+	}
+
+	mode := cfg.HttpProxy.Mode
+
+	if mode == HttpProxyModePort || mode == "" {
+		if old, err := c.Cookie("rtty-http-sid"); err == nil && old != sid {
+			if v, loaded := srv.httpProxySessions.LoadAndDelete(old); loaded {
+				s := v.(*HttpProxySession)
+				s.cancel()
+				log.Debug().Msgf(`del old httpProxySession "%s" for device "%s"`, old, devid)
+			}
+		}
+	}
+
+	if mode == HttpProxyModeSubdomain {
+		host := sid + "." + cfg.HttpProxy.Domain
+
+		if _, port, err := net.SplitHostPort(c.Request.Host); err == nil {
+			host = net.JoinHostPort(host, port)
+		}
+
+		c.Redirect(http.StatusFound, requestScheme(c.Request)+"://"+host+path.Path+query)
+		return
+	}
+
 	location := c.Request.Header.Get("HttpProxyRedir")
 	if location == "" {
-		location = cfg.HttpProxyRedirURL
+		location = cfg.HttpProxy.RedirURL
 		if location != "" {
 			log.Debug().Msgf("use HttpProxyRedirURL from config: %s, devid: %s", location, devid)
 		}
@@ -303,65 +332,200 @@ func httpProxyRedirect(a *APIServer, c *gin.Context, group string) {
 
 		location = "http://" + host
 
-		if srv.httpProxyPort != 80 {
-			location += fmt.Sprintf(":%d", srv.httpProxyPort)
+		if port := srv.httpProxyPort.Load(); port != 80 {
+			location += fmt.Sprintf(":%d", port)
 		}
 	}
 
-	location += path.Path
+	// The session is in the path, not in a cookie
+	if mode == HttpProxyModePath {
+		c.Redirect(http.StatusFound, location+httpProxyPathPrefix+sid+path.Path+query)
+		return
+	}
 
-	location += fmt.Sprintf("?_=%d", time.Now().Unix())
+	location += path.Path + query
 
-	if path.RawQuery != "" {
-		location += "&" + path.RawQuery
+	domain := c.Request.Header.Get("HttpProxyRedirDomain")
+	if domain == "" {
+		domain = cfg.HttpProxy.RedirDomain
+		if domain != "" {
+			log.Debug().Msgf("set cookie domain from config: %s, devid: %s", domain, devid)
+		}
+	} else {
+		log.Debug().Msgf("set cookie domain from HTTP header: %s, devid: %s", domain, devid)
 	}
 
-	sid, err := c.Cookie("rtty-http-sid")
-	if err == nil {
-		if v, loaded := httpProxySessions.LoadAndDelete(sid); loaded {
-			s := v.(*HttpProxySession)
-			s.cancel()
-			log.Debug().Msgf(`del old httpProxySession "%s" for device "%s"`, sid, devid)
-		}
+	cookie := &http.Cookie{
+		Name:     "rtty-http-sid",
+		Value:    sid,
+		Path:     "/",
+		Domain:   domain,
+		HttpOnly: true,
 	}
 
-	sid = utils.GenUniqueID()
+	// The cookie is only sent back over TLS if the proxy is served over TLS
+	if strings.HasPrefix(location, "https://") {
+		cookie.Secure = true
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+
+	http.SetCookie(c.Writer, cookie)
+	c.Redirect(http.StatusFound, location)
+}
+
+func loginSid(c *gin.Context) string {
+	sid, _ := c.Cookie("sid")
+	return sid
+}
+
+func (srv *RttyServer) newHttpProxySession(dev *Device, addr string, dest *httpProxyDest,
+	remoteAddr, username, loginSid string, share *Share) (string, *HttpProxySession) {
+	cfg := srv.config()
+
+	sid := utils.GenUniqueID()
 
 	ctx, cancel := context.WithCancel(dev.ctx)
 
 	ses := &HttpProxySession{
-		ctx:      ctx,
-		cancel:   cancel,
-		devid:    devid,
-		group:    group,
-		destaddr: addr,
-		https:    proto == "https",
+		ctx:         ctx,
+		cancel:      cancel,
+		id:          utils.GenUniqueID(),
+		devid:       dev.id,
+		group:       dev.group,
+		destaddr:    addr,
+		dest:        dest,
+		https:       dest.https,
+		username:    username,
+		loginSid:    loginSid,
+		clientIP:    remoteIP(remoteAddr),
+		created:     time.Now(),
+		idleTimeout: time.Duration(cfg.HttpProxy.SessionIdleTimeout) * time.Second,
+	}
+
+	if ses.idleTimeout <= 0 {
+		ses.idleTimeout = httpProxySessionsExpire
+	}
+
+	ses.limiter = newRateLimiter(func() int { return srv.rateLimits(ses.group).HttpProxy })
+
+	if cfg.HttpProxy.SessionLifetime > 0 {
+		ses.deadline = ses.created.Add(time.Duration(cfg.HttpProxy.SessionLifetime) * time.Second)
+	}
+
+	// Guests of a share can only view the pages until the share ends
+	if share != nil {
+		ses.share = share.id
+		ses.readOnly = true
+
+		if ses.deadline.IsZero() || share.expire.Before(ses.deadline) {
+			ses.deadline = share.expire
+		}
 	}
+
 	ses.Expire()
-	httpProxySessions.Store(sid, ses)
+	srv.httpProxySessions.Store(sid, ses)
 
 	go func() {
 		<-ctx.Done()
-		httpProxySessions.Delete(sid)
+		srv.httpProxySessions.Delete(sid)
 	}()
 
-	log.Debug().Msgf(`new httpProxySession "%s" for device "%s"`, sid, devid)
+	return sid, ses
+}
 
-	domain := c.Request.Header.Get("HttpProxyRedirDomain")
-	if domain == "" {
-		domain = cfg.HttpProxyRedirDomain
-		if domain != "" {
-			log.Debug().Msgf("set cookie domain from config: %s, devid: %s", domain, devid)
+// HttpProxySessions returns all HTTP proxy sessions.
+func (srv *RttyServer) HttpProxySessions() []*HttpProxySession {
+	sessions := make([]*HttpProxySession, 0)
+
+	srv.httpProxySessions.Range(func(key, value any) bool {
+		sessions = append(sessions, value.(*HttpProxySession))
+		return true
+	})
+
+	return sessions
+}
+
+func (srv *RttyServer) getHttpProxySession(id string) *HttpProxySession {
+	for _, ses := range srv.HttpProxySessions() {
+		if ses.id == id {
+			return ses
 		}
-	} else {
-		log.Debug().Msgf("set cookie domain from HTTP header: %s, devid: %s", domain, devid)
 	}
 
-	c.SetCookie("rtty-http-sid", sid, 0, "", domain, false, true)
-	c.Redirect(http.StatusFound, location)
+	return nil
 }
 
+// RevokeHttpProxySession closes the HTTP proxy session with the id.
+func (srv *RttyServer) RevokeHttpProxySession(id string) bool {
+	ses := srv.getHttpProxySession(id)
+	if ses == nil {
+		return false
+	}
+
+	log.Info().Msgf("http proxy session '%s' revoked: %s", id, ses)
+	ses.cancel()
+
+	return true
+}
+
+// revokeLoginHttpProxySessions closes the HTTP proxy sessions created
+// by the login session.
+func (srv *RttyServer) revokeLoginHttpProxySessions(loginSid string) {
+	if loginSid == "" {
+		return
+	}
+
+	for _, ses := range srv.HttpProxySessions() {
+		if ses.loginSid == loginSid {
+			ses.cancel()
+		}
+	}
+}
+
+// handleHttpProxySessions lists the HTTP proxy sessions, all for admins
+// and the own sessions for the others.
+func (a *APIServer) handleHttpProxySessions(c *gin.Context) {
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	infos := make([]*HttpProxySessionInfo, 0)
+
+	for _, ses := range a.srv.HttpProxySessions() {
+		if (admin || ses.username == username) && tokenGroupAllowed(c, ses.group) {
+			infos = append(infos, ses.Info())
+		}
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handleHttpProxySessionRevoke(c *gin.Context) {
+	ses := a.srv.getHttpProxySession(c.Param("id"))
+	if ses == nil || (!a.isAdmin(c) && ses.username != a.sessionUser(c)) || !tokenGroupAllowed(c, ses.group) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	a.srv.RevokeHttpProxySession(ses.id)
+
+	c.Status(http.StatusOK)
+}
+
+// sendHttpReq sends the data of a proxied connection to the device. The
+// body of the MsgTypeHttp message is:
+//
+//	[1-byte https][18-byte source][destination][data]
+//
+// The https flag, 1 for TLS to the destination, is only sent to devices
+// with proto > 3. The source identifies the connection: a 2-byte
+// connection number followed by the 16-byte client IP. The destination
+// is encoded by httpProxyDest.encode. Empty data closes the connection.
+//
+// The device answers with MsgTypeHttp messages of the source followed by
+// the data received from the destination, empty when it's closed.
 func sendHttpReq(dev *Device, https bool, srcAddr []byte, destAddr []byte, data []byte) {
+	dev.limiter.wait(dev.ctx, len(data))
+
 	bb := bytebufferpool.Get()
 	defer bytebufferpool.Put(bb)
 
@@ -380,83 +544,205 @@ func sendHttpReq(dev *Device, https bool, srcAddr []byte, destAddr []byte, data
 	dev.WriteMsg(proto.MsgTypeHttp, bb)
 }
 
-func genDestAddrAndHost(addr string, https bool) ([]byte, string) {
-	destIP, destPort, err := httpProxyVaildAddr(addr, https)
+// Types of the destination address in the HTTP proxy message, used
+// by devices with DevCapHttpDestAddr.
+const (
+	httpDestAddrIPv4 = 1
+	httpDestAddrIPv6 = 2
+	httpDestAddrName = 3
+)
+
+var (
+	errHttpProxyDestUnsupported = errors.New("destination not supported by the device")
+	errHttpProxyNameUnsupported = errors.New("hostname resolution not supported by the device")
+)
+
+type httpProxyDest struct {
+	addr  netip.Addr
+	name  string // hostname resolved by the device, addr is invalid if set
+	port  uint16
+	https bool
+}
+
+// parseHttpProxyDest parses the destination of the HTTP proxy. It accepts
+// IPv4 and IPv6 literals or hostnames with optional port, e.g.
+// "192.168.1.1:8080", "[fe80::1%eth0]:8080", "fd00::1" or "printer.lan".
+// The port defaults to 80 or 443.
+func parseHttpProxyDest(addr string, https bool) (*httpProxyDest, error) {
+	host, ports, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, ""
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+
+		if https {
+			ports = "443"
+		} else {
+			ports = "80"
+		}
+	}
+
+	port, err := strconv.ParseUint(ports, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid port in addr '%s'", addr)
+	}
+
+	dest := &httpProxyDest{
+		port:  uint16(port),
+		https: https,
 	}
 
-	b := make([]byte, 6)
-	copy(b, destIP)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		if !isValidHostname(host) {
+			return nil, fmt.Errorf("invalid addr '%s'", addr)
+		}
 
-	binary.BigEndian.PutUint16(b[4:], destPort)
+		dest.name = strings.TrimSuffix(host, ".")
 
-	host := addr
+		return dest, nil
+	}
 
-	ips, ports, _ := net.SplitHostPort(addr)
-	if ports == "80" || ports == "443" {
-		host = ips
+	if len(ip.Zone()) > 255 {
+		return nil, fmt.Errorf("zone too long in addr '%s'", addr)
 	}
 
-	return b, host
+	dest.addr = ip.Unmap()
+
+	return dest, nil
 }
 
-func tcpAddr2Bytes(addr *net.TCPAddr, b []byte) {
-	binary.BigEndian.PutUint16(b[:2], uint16(addr.Port))
-	copy(b[2:], addr.IP)
+func isValidHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
 }
 
-func httpProxyVaildAddr(addr string, https bool) (net.IP, uint16, error) {
-	ips, ports, err := net.SplitHostPort(addr)
-	if err != nil {
-		ips = addr
+// encode encodes the destination for a device with the given
+// capabilities. Integers are big endian.
+//
+// Legacy devices only support IPv4:
+//
+//	[4-byte IPv4][2-byte port]
+//
+// Devices with DevCapHttpDestAddr or DevCapHttpDestName:
+//
+//	[1-byte type][address][2-byte port]
+//
+// with the type and address:
+//
+//	1 (httpDestAddrIPv4): [4-byte IPv4]
+//	2 (httpDestAddrIPv6): [16-byte IPv6][1-byte zone length][zone]
+//	3 (httpDestAddrName): [1-byte name length][name]
+//
+// The zone is the interface of a link-local address, e.g. "eth0", empty
+// otherwise. IPv4-mapped IPv6 addresses are sent as IPv4. Hostnames are
+// only sent to devices with DevCapHttpDestName, which resolve them,
+// without the trailing dot.
+func (d *httpProxyDest) encode(caps uint8) ([]byte, error) {
+	if d.name != "" && caps&DevCapHttpDestName == 0 {
+		return nil, errHttpProxyNameUnsupported
+	}
 
-		if https {
-			ports = "443"
-		} else {
-			ports = "80"
+	if caps&(DevCapHttpDestAddr|DevCapHttpDestName) == 0 {
+		if !d.addr.Is4() {
+			return nil, errHttpProxyDestUnsupported
 		}
+
+		b := d.addr.AsSlice()
+		return binary.BigEndian.AppendUint16(b, d.port), nil
+	}
+
+	var b []byte
+
+	if d.name != "" {
+		b = append(b, httpDestAddrName)
+		b = append(b, byte(len(d.name)))
+		b = append(b, d.name...)
+		b = binary.BigEndian.AppendUint16(b, d.port)
+	} else if d.addr.Is4() {
+		b = append(b, httpDestAddrIPv4)
+		b = append(b, d.addr.AsSlice()...)
+		b = binary.BigEndian.AppendUint16(b, d.port)
+	} else {
+		b = append(b, httpDestAddrIPv6)
+		b = append(b, d.addr.AsSlice()...)
+		b = append(b, byte(len(d.addr.Zone())))
+		b = append(b, d.addr.Zone()...)
+		b = binary.BigEndian.AppendUint16(b, d.port)
 	}
 
-	ip := net.ParseIP(ips)
-	if ip == nil {
-		return nil, 0, errors.New("invalid IPv4 Addr")
+	return b, nil
+}
+
+// host returns the value of the Host header sent to the destination.
+// The zone is not part of it and the default port is omitted.
+func (d *httpProxyDest) host() string {
+	defaultPort := (d.https && d.port == 443) || (!d.https && d.port == 80)
+
+	if d.name != "" {
+		if defaultPort {
+			return d.name
+		}
+		return net.JoinHostPort(d.name, strconv.Itoa(int(d.port)))
 	}
 
-	ip = ip.To4()
-	if ip == nil {
-		return nil, 0, errors.New("invalid IPv4 Addr")
+	ip := d.addr.WithZone("")
+
+	if defaultPort {
+		if ip.Is6() {
+			return "[" + ip.String() + "]"
+		}
+		return ip.String()
 	}
 
-	port, _ := strconv.Atoi(ports)
+	return netip.AddrPortFrom(ip, d.port).String()
+}
+
+func writeHTTPErrorPage(w http.ResponseWriter, errorType string) {
+	content := httpErrorPage(errorType)
+	if content == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	return ip, uint16(port), nil
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(content)
 }
 
-func sendHTTPErrorResponse(conn net.Conn, errorType string) {
+func httpErrorPage(errorType string) []byte {
 	fs, _ := fs.Sub(staticFs, "assets")
 
 	f, err := fs.Open("http-proxy-err.html")
 	if err != nil {
 		fmt.Println(err)
-		return
+		return nil
 	}
 	defer f.Close()
 
 	content, err := io.ReadAll(f)
 	if err != nil {
 		fmt.Println(err)
-		return
+		return nil
 	}
 
-	content = bytes.ReplaceAll(content, []byte("{{.}}"), []byte(errorType))
-
-	response := "HTTP/1.1 200 OK\r\n"
-	response += "Content-Type: text/html; charset=utf-8\r\n"
-	response += fmt.Sprintf("Content-Length: %d\r\n", len(content))
-	response += "Connection: close\r\n"
-	response += "\r\n"
-
-	conn.Write([]byte(response))
-	conn.Write(content)
+	return bytes.ReplaceAll(content, []byte("{{.}}"), []byte(errorType))
 }
@@ -0,0 +1,146 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseHttpProxyDest(t *testing.T) {
+	tests := []struct {
+		addr  string
+		https bool
+		ip    string
+		name  string
+		port  uint16
+		err   bool
+	}{
+		{addr: "192.168.1.1", ip: "192.168.1.1", port: 80},
+		{addr: "192.168.1.1", https: true, ip: "192.168.1.1", port: 443},
+		{addr: "192.168.1.1:8080", ip: "192.168.1.1", port: 8080},
+		{addr: "[::ffff:192.168.1.1]:80", ip: "192.168.1.1", port: 80},
+		{addr: "fd00::1", ip: "fd00::1", port: 80},
+		{addr: "[fd00::1]", ip: "fd00::1", port: 80},
+		{addr: "[fd00::1]:8443", https: true, ip: "fd00::1", port: 8443},
+		{addr: "[fe80::1%eth0]:8080", ip: "fe80::1%eth0", port: 8080},
+		{addr: "fe80::1%eth0", ip: "fe80::1%eth0", port: 80},
+		{addr: "printer.lan", name: "printer.lan", port: 80},
+		{addr: "printer.lan.:81", name: "printer.lan", port: 81},
+		{addr: "my_host", name: "my_host", port: 80},
+
+		{addr: "", err: true},
+		{addr: "192.168.1.1:0", err: true},
+		{addr: "192.168.1.1:65536", err: true},
+		{addr: "192.168.1.1:http", err: true},
+		{addr: "[fd00::1]:", err: true},
+		{addr: "-bad.lan", err: true},
+		{addr: "bad..lan", err: true},
+		{addr: "bad host", err: true},
+		{addr: strings.Repeat("a", 64) + ".lan", err: true},
+		{addr: "[fe80::1%" + strings.Repeat("a", 256) + "]:80", err: true},
+	}
+
+	for _, tt := range tests {
+		d, err := parseHttpProxyDest(tt.addr, tt.https)
+
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: no error", tt.addr)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%q: %v", tt.addr, err)
+			continue
+		}
+
+		ip := ""
+		if d.addr.IsValid() {
+			ip = d.addr.String()
+		}
+
+		if ip != tt.ip || d.name != tt.name || d.port != tt.port || d.https != tt.https {
+			t.Errorf("%q: got ip %q name %q port %d https %v, want ip %q name %q port %d https %v",
+				tt.addr, ip, d.name, d.port, d.https, tt.ip, tt.name, tt.port, tt.https)
+		}
+	}
+}
+
+func TestHttpProxyDestEncode(t *testing.T) {
+	tests := []struct {
+		addr string
+		caps uint8
+		want []byte
+		err  error
+	}{
+		// Legacy devices
+		{"192.168.1.1:8080", 0, []byte{192, 168, 1, 1, 0x1f, 0x90}, nil},
+		{"[fd00::1]:80", 0, nil, errHttpProxyDestUnsupported},
+		{"printer.lan", 0, nil, errHttpProxyNameUnsupported},
+
+		// Devices with the address type
+		{"192.168.1.1:8080", DevCapHttpDestAddr, []byte{1, 192, 168, 1, 1, 0x1f, 0x90}, nil},
+		{"[::ffff:10.0.0.1]:80", DevCapHttpDestAddr, []byte{1, 10, 0, 0, 1, 0, 80}, nil},
+		{"[fd00::1]:80", DevCapHttpDestAddr,
+			[]byte{2, 0xfd, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 80}, nil},
+		{"[fe80::1%eth0]:443", DevCapHttpDestAddr,
+			[]byte{2, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 4, 'e', 't', 'h', '0', 1, 0xbb}, nil},
+		{"printer.lan", DevCapHttpDestAddr, nil, errHttpProxyNameUnsupported},
+
+		// Devices resolving hostnames
+		{"printer.lan.:8080", DevCapHttpDestAddr | DevCapHttpDestName,
+			[]byte{3, 11, 'p', 'r', 'i', 'n', 't', 'e', 'r', '.', 'l', 'a', 'n', 0x1f, 0x90}, nil},
+		{"192.168.1.1", DevCapHttpDestAddr | DevCapHttpDestName, []byte{1, 192, 168, 1, 1, 0, 80}, nil},
+		{"printer.lan", DevCapHttpDestName, []byte{3, 11, 'p', 'r', 'i', 'n', 't', 'e', 'r', '.', 'l', 'a', 'n', 0, 80}, nil},
+	}
+
+	for _, tt := range tests {
+		d, err := parseHttpProxyDest(tt.addr, false)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.addr, err)
+		}
+
+		b, err := d.encode(tt.caps)
+		if err != tt.err {
+			t.Errorf("%q caps %d: error %v, want %v", tt.addr, tt.caps, err, tt.err)
+			continue
+		}
+
+		if !bytes.Equal(b, tt.want) {
+			t.Errorf("%q caps %d: got %v, want %v", tt.addr, tt.caps, b, tt.want)
+		}
+	}
+}
+
+func TestHttpProxyDestHost(t *testing.T) {
+	tests := []struct {
+		addr  string
+		https bool
+		want  string
+	}{
+		{"192.168.1.1", false, "192.168.1.1"},
+		{"192.168.1.1:80", false, "192.168.1.1"},
+		{"192.168.1.1:443", false, "192.168.1.1:443"},
+		{"192.168.1.1:443", true, "192.168.1.1"},
+		{"[fe80::1%eth0]:8080", false, "[fe80::1]:8080"},
+		{"fd00::1", false, "[fd00::1]"},
+		{"printer.lan.", false, "printer.lan"},
+	}
+
+	for _, tt := range tests {
+		d, err := parseHttpProxyDest(tt.addr, tt.https)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.addr, err)
+		}
+
+		if got := d.host(); got != tt.want {
+			t.Errorf("%q: host %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ package log
 
 import (
 	"path/filepath"
+	"runtime/debug"
 	"strconv"
 
 	"github.com/dwdcth/consoleEx"
@@ -31,3 +32,28 @@ func init() {
 func Verbose() {
 	log.Logger = log.Logger.With().Caller().Logger()
 }
+
+// SetLevel sets the global log level: debug, info, warn or error.
+// Unknown levels fall back to info.
+func SetLevel(level string) {
+	switch level {
+	case "debug":
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case "warn":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	case "error":
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	default:
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
+
+// LogPanic must be called directly with defer. It recovers from the
+// panic and logs its value along with the stack, so a panic in a
+// connection ends the goroutine rather than the process embedding rttys.
+func LogPanic() {
+	if r := recover(); r != nil {
+		log.Error().Msgf("%v", r)
+		log.Error().Msg(string(debug.Stack()))
+	}
+}
@@ -0,0 +1,607 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	xlog "github.com/zhaojh329/rttys/v5/log"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Path prefix of the HTTP proxy in path mode, followed by the session id
+const httpProxyPathPrefix = "/proxy/"
+
+var errHttpProxyDevOffline = errors.New("device offline")
+
+var errDeviceConnIDs = errors.New("too many connections to the device from the client")
+
+type httpProxyClientAddrKey struct{}
+
+// serveHttpProxyPath serves the HTTP proxy in path mode, /proxy/:sid/*path
+// on the http-proxy listener. The device pages get their own origin, so
+// they can't call the API with the cookie of the user.
+func (srv *RttyServer) serveHttpProxyPath(w http.ResponseWriter, r *http.Request) {
+	sid, path, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, httpProxyPathPrefix), "/")
+	if !strings.HasPrefix(r.URL.Path, httpProxyPathPrefix) || sid == "" {
+		if !srv.proxyReferer(w, r) {
+			writeHTTPErrorPage(w, "unauthorized")
+		}
+		return
+	}
+
+	if !ok {
+		u := *r.URL
+		u.Path += "/"
+		http.Redirect(w, r, u.RequestURI(), http.StatusFound)
+		return
+	}
+
+	srv.serveHttpProxy(w, r, sid, httpProxyPathPrefix+sid, "/"+path)
+}
+
+// proxySubdomain serves the HTTP proxy in subdomain mode for requests
+// to <sid>.<http-proxy.domain>.
+func (a *APIServer) proxySubdomain(c *gin.Context) {
+	cfg := a.srv.config()
+
+	if cfg.HttpProxy.Mode != HttpProxyModeSubdomain {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		host = c.Request.Host
+	}
+
+	sid, ok := strings.CutSuffix(host, "."+cfg.HttpProxy.Domain)
+	if !ok || sid == "" || strings.Contains(sid, ".") {
+		return
+	}
+
+	a.checkClientAddr(c)
+	if c.IsAborted() {
+		return
+	}
+
+	c.Abort()
+
+	a.srv.serveHttpProxy(c.Writer, c.Request, sid, "", c.Request.URL.Path)
+}
+
+// rejectProxyOrigin refuses the requests from the device pages served by
+// the HTTP proxy. They are on the same site as the API, so the browser
+// sends the cookie of the user along, e.g. to open a terminal.
+func (a *APIServer) rejectProxyOrigin(c *gin.Context) {
+	origin := c.GetHeader("Origin")
+	if origin == "" || !a.srv.isProxyOrigin(origin) {
+		return
+	}
+
+	log.Warn().Msgf("%s %s from http proxy origin %s denied", c.Request.Method, c.Request.URL.Path, origin)
+	c.AbortWithStatus(http.StatusForbidden)
+}
+
+// isProxyOrigin reports whether the origin is the one of the HTTP proxy
+func (srv *RttyServer) isProxyOrigin(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	cfg := srv.config()
+
+	if cfg.HttpProxy.Mode == HttpProxyModeSubdomain {
+		return strings.HasSuffix(u.Hostname(), "."+cfg.HttpProxy.Domain)
+	}
+
+	if redir, err := url.Parse(cfg.HttpProxy.RedirURL); err == nil && redir.Host != "" {
+		if redir.Scheme == u.Scheme && redir.Host == u.Host {
+			return true
+		}
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	return port == strconv.Itoa(int(srv.httpProxyPort.Load()))
+}
+
+// proxyReferer redirects requests for absolute paths from a page served
+// in path mode back under the prefix of its session, e.g. "/css/app.css"
+// referred by "/proxy/<sid>/index.html".
+func (srv *RttyServer) proxyReferer(w http.ResponseWriter, r *http.Request) bool {
+	ref, err := url.Parse(r.Referer())
+	if err != nil || (ref.Host != "" && ref.Host != r.Host) {
+		return false
+	}
+
+	sid, _, ok := strings.Cut(strings.TrimPrefix(ref.Path, httpProxyPathPrefix), "/")
+	if !ok || !strings.HasPrefix(ref.Path, httpProxyPathPrefix) {
+		return false
+	}
+
+	if _, ok := srv.httpProxySessions.Load(sid); !ok {
+		return false
+	}
+
+	http.Redirect(w, r, httpProxyPathPrefix+sid+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+
+	return true
+}
+
+// serveHttpProxy forwards the request to the destination of the session
+// with the sid. prefix is the path prefix of the session on the client
+// side, which is added to the Location headers and cookie paths of the
+// response.
+func (srv *RttyServer) serveHttpProxy(w http.ResponseWriter, r *http.Request, sid, prefix, path string) {
+	v, ok := srv.httpProxySessions.Load(sid)
+	if !ok {
+		log.Debug().Msgf(`not found httpProxySession "%s"`, sid)
+		writeHTTPErrorPage(w, "unauthorized")
+		return
+	}
+
+	ses := v.(*HttpProxySession)
+
+	if !ses.allowed(srv, r.RemoteAddr) {
+		log.Warn().Msgf(`httpProxySession "%s" of %s used from %s`, ses.id, ses.clientIP, r.RemoteAddr)
+		writeHTTPErrorPage(w, "unauthorized")
+		return
+	}
+
+	dev := srv.GetDevice(ses.group, ses.devid)
+	if dev == nil {
+		log.Debug().Msgf(`device "%s" group "%s" offline`, ses.devid, ses.group)
+		writeHTTPErrorPage(w, "offline")
+		return
+	}
+
+	if _, err := ses.dest.encode(dev.caps); err != nil {
+		log.Debug().Msgf("http proxy to %s: %v", ses.destaddr, err)
+		errorType := "unsupported"
+		if err == errHttpProxyNameUnsupported {
+			errorType = "hostname"
+		}
+		writeHTTPErrorPage(w, errorType)
+		return
+	}
+
+	// Upgraded connections, e.g. websockets, carry data both ways
+	if ses.readOnly && ((r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Upgrade") != "") {
+		log.Debug().Msgf(`%s denied for read-only httpProxySession "%s"`, r.Method, ses.id)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	ses.Expire()
+
+	if path == "" {
+		path = "/"
+	}
+
+	lw := &accessLogWriter{ResponseWriter: w}
+	body := &accessLogBody{ReadCloser: r.Body}
+	start := time.Now()
+	uri := path
+
+	r.Body = body
+
+	defer func() {
+		cfg := srv.config()
+
+		srv.accessLog.write(&cfg.HttpProxy, &accessLogEntry{
+			Time:      start,
+			ClientIP:  remoteIP(r.RemoteAddr),
+			Username:  ses.username,
+			Session:   ses.id,
+			Group:     ses.group,
+			Devid:     ses.devid,
+			Dest:      ses.destaddr,
+			Method:    r.Method,
+			URI:       uri,
+			Proto:     r.Proto,
+			Status:    lw.status,
+			Tx:        body.size,
+			Rx:        lw.size,
+			Duration:  time.Since(start).Milliseconds(),
+			Referer:   r.Referer(),
+			UserAgent: r.UserAgent(),
+		})
+	}()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			host := ses.dest.host()
+
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = host
+			r.Out.Host = host
+
+			if r.Out.URL.Path != path {
+				r.Out.URL.Path = path
+				r.Out.URL.RawPath = ""
+			}
+
+			removeCookies(r.Out.Header, "sid", "rtty-http-sid")
+
+			uri = r.Out.URL.RequestURI()
+		},
+		Transport: ses.httpTransport(srv),
+		ModifyResponse: func(resp *http.Response) error {
+			rewriteProxyResponse(resp, ses.dest, prefix)
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Debug().Msgf("http proxy to %s for device '%s': %v", ses.destaddr, ses.devid, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	ctx := context.WithValue(r.Context(), httpProxyClientAddrKey{}, r.RemoteAddr)
+
+	proxy.ServeHTTP(lw, r.WithContext(ctx))
+}
+
+// httpTransport returns the transport of the session, which connects
+// to the destination through the device.
+func (ses *HttpProxySession) httpTransport(srv *RttyServer) *http.Transport {
+	ses.transportOnce.Do(func() {
+		ses.transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return ses.dialDevice(srv, ctx)
+			},
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+		}
+
+		go func() {
+			<-ses.ctx.Done()
+			ses.transport.CloseIdleConnections()
+		}()
+	})
+
+	return ses.transport
+}
+
+// dialDevice returns a connection to the destination of the session
+// through the device.
+func (ses *HttpProxySession) dialDevice(srv *RttyServer, ctx context.Context) (net.Conn, error) {
+	dev := srv.GetDevice(ses.group, ses.devid)
+	if dev == nil {
+		return nil, errHttpProxyDevOffline
+	}
+
+	clientAddr, _ := ctx.Value(httpProxyClientAddrKey{}).(string)
+
+	conn, err := dev.dial(srv, ses.dest, clientAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	pc := &httpProxyConn{
+		Conn:   conn,
+		ses:    ses,
+		closed: make(chan struct{}),
+	}
+
+	go func() {
+		select {
+		case <-ses.ctx.Done():
+			conn.Close()
+		case <-pc.closed:
+		}
+	}()
+
+	return pc, nil
+}
+
+// httpProxyConn keeps the session alive while the client sends data,
+// e.g. on an upgraded websocket connection, counts the bytes of the
+// session and limits the ones sent to the device.
+type httpProxyConn struct {
+	net.Conn
+	ses       *HttpProxySession
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Read is not limited: the device sends the responses without flow
+// control, so delaying them here would not spare its uplink
+func (c *httpProxyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.ses.rx.Add(uint64(n))
+	return n, err
+}
+
+func (c *httpProxyConn) Write(b []byte) (int, error) {
+	c.ses.Expire()
+	if err := c.ses.limiter.wait(c.ses.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	n, err := c.Conn.Write(b)
+	c.ses.tx.Add(uint64(n))
+	return n, err
+}
+
+func (c *httpProxyConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// Data from the device queued for a connection. A client reading slower
+// than the device sends is disconnected past it, as the HTTP messages have
+// no flow control and the device must not wait for it.
+const deviceConnQueueSize = 16 * 1024 * 1024
+
+// deviceConn is the device side of a connection dialed through the device.
+// The data from the device are written to it by a goroutine, so that the
+// device never waits for the client.
+type deviceConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	data   [][]byte
+	queued int
+	ready  chan struct{}
+}
+
+// queue queues the data from the device, empty data to close the
+// connection once the data queued before are written.
+func (c *deviceConn) queue(data []byte) {
+	c.mu.Lock()
+
+	c.queued += len(data)
+	if c.queued > deviceConnQueueSize {
+		c.mu.Unlock()
+		log.Error().Msgf("http conn %s: client too slow, closed", c.RemoteAddr())
+		c.Close()
+		return
+	}
+
+	c.data = append(c.data, bytes.Clone(data))
+
+	c.mu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (c *deviceConn) writer(done chan struct{}) {
+	for {
+		select {
+		case <-c.ready:
+		case <-done:
+			return
+		}
+
+		c.mu.Lock()
+		data := c.data
+		c.data = nil
+		c.mu.Unlock()
+
+		for _, b := range data {
+			if len(b) == 0 {
+				c.Close()
+				return
+			}
+
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+
+			c.mu.Lock()
+			c.queued -= len(b)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// dial returns a connection whose data are carried by the HTTP messages
+// of the device, like the connections of the HTTP proxy port. The device
+// connects to dest and relays the data as is, so it's also used for raw
+// TCP streams. The connection is closed when the device disconnects.
+func (dev *Device) dial(srv *RttyServer, dest *httpProxyDest, clientAddr string) (net.Conn, error) {
+	destAddr, err := dest.encode(dev.caps)
+	if err != nil {
+		return nil, err
+	}
+
+	var srcAddr [18]byte
+
+	if addr, err := net.ResolveTCPAddr("tcp", clientAddr); err == nil {
+		copy(srcAddr[2:], addr.IP.To16())
+	}
+
+	conn, pipe := net.Pipe()
+
+	devConn := &deviceConn{
+		Conn:  pipe,
+		ready: make(chan struct{}, 1),
+	}
+
+	// The port identifies the connection, as several connections may
+	// be opened for the same client connection. The ids wrap around,
+	// skipping the ones still in use.
+	for i := 0; ; i++ {
+		if i == 1<<16 {
+			conn.Close()
+			pipe.Close()
+			return nil, errDeviceConnIDs
+		}
+
+		binary.BigEndian.PutUint16(srcAddr[:2], uint16(srv.httpProxyConnID.Add(1)))
+
+		if _, loaded := dev.https.LoadOrStore(srcAddr, devConn); !loaded {
+			break
+		}
+	}
+
+	go func() {
+		defer xlog.LogPanic()
+
+		done := make(chan struct{})
+		defer close(done)
+
+		go devConn.writer(done)
+
+		go func() {
+			select {
+			case <-dev.ctx.Done():
+				devConn.Close()
+			case <-done:
+			}
+		}()
+
+		hb := httpBufPool.Get().(*HttpBuf)
+		defer httpBufPool.Put(hb)
+
+		for {
+			n, err := devConn.Read(hb.buf)
+			if err != nil {
+				break
+			}
+			sendHttpReq(dev, dest.https, srcAddr[:], destAddr, hb.buf[:n])
+		}
+
+		devConn.Close()
+		dev.https.CompareAndDelete(srcAddr, devConn)
+		sendHttpReq(dev, dest.https, srcAddr[:], destAddr, nil)
+	}()
+
+	return conn, nil
+}
+
+// rewriteProxyResponse rewrites the Location header and the cookies of
+// the response, so they point to the proxy instead of the destination.
+func rewriteProxyResponse(resp *http.Response, dest *httpProxyDest, prefix string) {
+	if loc := resp.Header.Get("Location"); loc != "" {
+		resp.Header.Set("Location", rewriteProxyLocation(loc, dest, prefix))
+	}
+
+	cookies := resp.Header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+
+	resp.Header.Del("Set-Cookie")
+
+	for _, line := range cookies {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil {
+			continue
+		}
+
+		cookie.Domain = ""
+
+		if prefix != "" {
+			if cookie.Path == "" || !strings.HasPrefix(cookie.Path, "/") {
+				cookie.Path = "/"
+			}
+			cookie.Path = prefix + cookie.Path
+		}
+
+		resp.Header.Add("Set-Cookie", cookie.String())
+	}
+}
+
+func rewriteProxyLocation(loc string, dest *httpProxyDest, prefix string) string {
+	u, err := url.Parse(loc)
+	if err != nil {
+		return loc
+	}
+
+	if u.Host != "" {
+		host := u.Hostname()
+
+		if dest.name != "" {
+			if !strings.EqualFold(host, dest.name) {
+				return loc
+			}
+		} else if host != dest.addr.WithZone("").String() {
+			return loc
+		}
+
+		u.Scheme = ""
+		u.Host = ""
+	} else if !strings.HasPrefix(u.Path, "/") {
+		return loc
+	}
+
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	u.Path = prefix + u.Path
+	u.RawPath = ""
+
+	return u.String()
+}
+
+// removeCookies removes the cookies with the given names from the
+// Cookie headers.
+func removeCookies(h http.Header, names ...string) {
+	lines := h.Values("Cookie")
+	if len(lines) == 0 {
+		return
+	}
+
+	h.Del("Cookie")
+
+	for _, line := range lines {
+		cookies, err := http.ParseCookie(line)
+		if err != nil {
+			continue
+		}
+
+		kept := make([]string, 0, len(cookies))
+
+		for _, cookie := range cookies {
+			if !slices.Contains(names, cookie.Name) {
+				kept = append(kept, cookie.String())
+			}
+		}
+
+		if len(kept) > 0 {
+			h.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
+
+// requestScheme returns the scheme used by the client, taking the
+// X-Forwarded-Proto header of a reverse proxy into account.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "https" || proto == "http" {
+		return proto
+	}
+
+	return "http"
+}
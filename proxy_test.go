@@ -0,0 +1,167 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestRewriteProxyLocation(t *testing.T) {
+	tests := []struct {
+		dest   string
+		loc    string
+		prefix string
+		want   string
+	}{
+		{"192.168.1.1:8080", "/login", "/p", "/p/login"},
+		{"192.168.1.1:8080", "/login?next=/a#top", "/p", "/p/login?next=/a#top"},
+		{"192.168.1.1:8080", "http://192.168.1.1:8080/x", "/p", "/p/x"},
+		{"192.168.1.1:8080", "https://192.168.1.1/x?a=1", "/p", "/p/x?a=1"},
+		{"192.168.1.1:8080", "http://192.168.1.1", "/p", "/p/"},
+		{"192.168.1.1:8080", "//192.168.1.1/x", "/p", "/p/x"},
+		{"192.168.1.1:8080", "http://192.168.1.1/x", "", "/x"},
+		{"192.168.1.1:8080", "/x", "", "/x"},
+		{"192.168.1.1:8080", "https://example.com/x", "/p", "https://example.com/x"},
+		{"192.168.1.1:8080", "http://192.168.1.2/x", "/p", "http://192.168.1.2/x"},
+		{"192.168.1.1:8080", "login", "/p", "login"},
+		{"192.168.1.1:8080", ":bad", "/p", ":bad"},
+		{"[fd00::1]:8080", "http://[fd00::1]:8080/x", "/p", "/p/x"},
+		{"[fd00::1]:8080", "http://[fd00::2]/x", "/p", "http://[fd00::2]/x"},
+		{"printer.lan", "http://PRINTER.lan/x", "/p", "/p/x"},
+		{"printer.lan", "http://192.168.1.1/x", "/p", "http://192.168.1.1/x"},
+	}
+
+	for _, tt := range tests {
+		dest, err := parseHttpProxyDest(tt.dest, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := rewriteProxyLocation(tt.loc, dest, tt.prefix); got != tt.want {
+			t.Errorf("%s %q prefix %q: got %q, want %q", tt.dest, tt.loc, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteProxyCookies(t *testing.T) {
+	dest, _ := parseHttpProxyDest("192.168.1.1", false)
+
+	tests := []struct {
+		prefix  string
+		cookies []string
+		want    []string
+	}{
+		{"/p", []string{"id=1; Path=/app; Domain=192.168.1.1"}, []string{"id=1; Path=/p/app"}},
+		{"/p", []string{"id=1"}, []string{"id=1; Path=/p/"}},
+		{"/p", []string{"id=1; Path=app; HttpOnly"}, []string{"id=1; Path=/p/; HttpOnly"}},
+		{"", []string{"id=1; Path=/app; Domain=192.168.1.1"}, []string{"id=1; Path=/app"}},
+		{"/p", []string{"=bad", "a=1", "b=2; Max-Age=60"}, []string{"a=1; Path=/p/", "b=2; Path=/p/; Max-Age=60"}},
+		{"/p", nil, nil},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{}}
+
+		for _, c := range tt.cookies {
+			resp.Header.Add("Set-Cookie", c)
+		}
+
+		rewriteProxyResponse(resp, dest, tt.prefix)
+
+		if got := resp.Header.Values("Set-Cookie"); !slices.Equal(got, tt.want) {
+			t.Errorf("%q prefix %q: got %q, want %q", tt.cookies, tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveCookies(t *testing.T) {
+	tests := []struct {
+		lines []string
+		want  []string
+	}{
+		{nil, nil},
+		{[]string{"a=1"}, []string{"a=1"}},
+		{[]string{"sid=1; a=2"}, []string{"a=2"}},
+		{[]string{"sid=1"}, nil},
+		{[]string{"sid=1; rtty-http-sid=2"}, nil},
+		{[]string{"a=1; rtty-http-sid=2", "sid=3; b=4"}, []string{"a=1", "b=4"}},
+		{[]string{"a=1; sidx=2; SID=3"}, []string{"a=1; sidx=2; SID=3"}},
+	}
+
+	for _, tt := range tests {
+		h := http.Header{}
+
+		for _, line := range tt.lines {
+			h.Add("Cookie", line)
+		}
+
+		removeCookies(h, "sid", "rtty-http-sid")
+
+		if got := h.Values("Cookie"); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.lines, got, tt.want)
+		}
+	}
+}
+
+func deviceConnKey(id uint16, ip string) [18]byte {
+	var key [18]byte
+	binary.BigEndian.PutUint16(key[:2], id)
+	copy(key[2:], net.ParseIP(ip).To16())
+	return key
+}
+
+func TestDeviceDialConnID(t *testing.T) {
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{})
+
+	dev, peer := newTestDevice(t, "dev1", 4)
+	go io.Copy(io.Discard, peer)
+
+	dest, _ := parseHttpProxyDest("192.168.1.1", false)
+
+	// The ids wrap around, skipping the ones in use
+	used := &deviceConn{}
+	dev.https.Store(deviceConnKey(65535, "10.0.0.1"), used)
+	dev.https.Store(deviceConnKey(0, "10.0.0.1"), used)
+
+	srv.httpProxyConnID.Store(65534)
+
+	c, err := dev.dial(srv, dest, "10.0.0.1:1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, id := range []uint16{65535, 0} {
+		if v, _ := dev.https.Load(deviceConnKey(id, "10.0.0.1")); v != used {
+			t.Errorf("id %d in use replaced", id)
+		}
+	}
+
+	if v, _ := dev.https.Load(deviceConnKey(1, "10.0.0.1")); v == nil || v == used {
+		t.Error("id 1 not used")
+	}
+
+	// All the ids of the client in use
+	for id := range 1 << 16 {
+		dev.https.LoadOrStore(deviceConnKey(uint16(id), "10.0.0.2"), used)
+	}
+
+	if _, err := dev.dial(srv, dest, "10.0.0.2:1234"); err != errDeviceConnIDs {
+		t.Errorf("all ids in use: error %v, want %v", err, errDeviceConnIDs)
+	}
+
+	c, err = dev.dial(srv, dest, "10.0.0.3:1234")
+	if err != nil {
+		t.Fatalf("other client: %v", err)
+	}
+	c.Close()
+}
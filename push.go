@@ -0,0 +1,593 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	xlog "github.com/zhaojh329/rttys/v5/log"
+	"github.com/zhaojh329/rttys/v5/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// PushJob uploads one stored file to a set of devices. The devices which
+// are offline are tried again when they register, the failed ones are
+// retried a few times. A job is removed with its file once finished for
+// pushRetention, or pushExpire after it's created, e.g. when devices
+// never come back online.
+type PushJob struct {
+	id        string
+	group     string
+	path      string
+	overwrite bool
+	username  string
+	owner     string
+	created   time.Time
+
+	// The stored file
+	file string
+	size int64
+	sum  string
+
+	// Credentials to log in the devices
+	devUsername string
+	devPassword string
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Limits the concurrent transfers
+	sem chan struct{}
+
+	mu      sync.Mutex
+	targets map[string]*pushTarget
+}
+
+// States of the devices of a push job
+const (
+	pushPending  = "pending"
+	pushRunning  = "running"
+	pushSuccess  = "success"
+	pushOffline  = "offline"
+	pushFailed   = "failed"
+	pushAborted  = "aborted"
+	pushCanceled = "canceled"
+)
+
+const (
+	pushMaxAttempts = 3
+	pushRetryDelay  = 10 * time.Second
+	pushConcurrency = 8
+
+	pushRetention     = time.Hour
+	pushExpire        = 24 * time.Hour
+	pushCheckInterval = time.Minute
+)
+
+type pushTarget struct {
+	devid    string
+	state    string
+	attempts int
+	err      string
+	updated  time.Time
+	transfer *FileTransfer
+	retry    *time.Timer
+}
+
+type PushTargetInfo struct {
+	Devid       string `json:"devid"`
+	State       string `json:"state"`
+	Attempts    int    `json:"attempts"`
+	Err         string `json:"err,omitempty"`
+	Transferred int64  `json:"transferred"`
+	Updated     int64  `json:"updated"`
+}
+
+type PushJobInfo struct {
+	ID        string            `json:"id"`
+	Group     string            `json:"group"`
+	Path      string            `json:"path"`
+	Overwrite bool              `json:"overwrite"`
+	Username  string            `json:"username"`
+	Size      int64             `json:"size"`
+	Sha256    string            `json:"sha256"`
+	Created   int64             `json:"created"`
+	States    map[string]int    `json:"states"`
+	Targets   []*PushTargetInfo `json:"targets,omitempty"`
+}
+
+var errPushNoTarget = errors.New("no target device")
+
+// Queries of the job creation
+var pushJobQueries = []string{"group", "devices", "path", "overwrite"}
+
+func (job *PushJob) Info(targets bool) *PushJobInfo {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	info := &PushJobInfo{
+		ID:        job.id,
+		Group:     job.group,
+		Path:      job.path,
+		Overwrite: job.overwrite,
+		Username:  job.username,
+		Size:      job.size,
+		Sha256:    job.sum,
+		Created:   job.created.Unix(),
+		States:    map[string]int{},
+	}
+
+	for _, tgt := range job.targets {
+		info.States[tgt.state]++
+
+		if !targets {
+			continue
+		}
+
+		ti := &PushTargetInfo{
+			Devid:    tgt.devid,
+			State:    tgt.state,
+			Attempts: tgt.attempts,
+			Err:      tgt.err,
+			Updated:  tgt.updated.Unix(),
+		}
+
+		if tgt.state == pushSuccess {
+			ti.Transferred = job.size
+		} else if tgt.transfer != nil {
+			ti.Transferred = tgt.transfer.transferred.Load()
+		}
+
+		info.Targets = append(info.Targets, ti)
+	}
+
+	slices.SortFunc(info.Targets, func(a, b *PushTargetInfo) int {
+		return strings.Compare(a.Devid, b.Devid)
+	})
+
+	return info
+}
+
+// PushJobs returns all push jobs
+func (srv *RttyServer) PushJobs() []*PushJob {
+	jobs := make([]*PushJob, 0)
+
+	srv.pushJobs.Range(func(key, value any) bool {
+		jobs = append(jobs, value.(*PushJob))
+		return true
+	})
+
+	return jobs
+}
+
+// NewPushJob stores the data of r to be uploaded to dst on the devices
+// of the group. All online devices of the group are the targets if
+// devids is empty.
+func (srv *RttyServer) NewPushJob(r io.Reader, group string, devids []string, dst string,
+	overwrite bool, username, owner string) (*PushJob, error) {
+	if len(devids) == 0 {
+		if g := srv.GetGroup(group, false); g != nil {
+			g.devices.Range(func(key, value any) bool {
+				devids = append(devids, key.(string))
+				return true
+			})
+		}
+	}
+
+	if len(devids) == 0 {
+		return nil, errPushNoTarget
+	}
+
+	f, err := os.CreateTemp("", "rttys-push-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(r, fileSizeLimit+1))
+	if err == nil && size > fileSizeLimit {
+		err = errors.New("file too large")
+	}
+	if err == nil {
+		policy := srv.filePolicy(group)
+		err = policy.check(true, path.Base(dst), size)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	job := &PushJob{
+		id:        utils.GenUniqueID(),
+		group:     group,
+		path:      dst,
+		overwrite: overwrite,
+		username:  username,
+		owner:     owner,
+		created:   time.Now(),
+		file:      f.Name(),
+		size:      size,
+		sum:       hex.EncodeToString(h.Sum(nil)),
+		sem:       make(chan struct{}, pushConcurrency),
+		targets:   map[string]*pushTarget{},
+	}
+
+	job.ctx, job.cancel = context.WithCancel(srv.ctx)
+
+	for _, devid := range devids {
+		job.targets[devid] = &pushTarget{
+			devid:   devid,
+			state:   pushPending,
+			updated: job.created,
+		}
+	}
+
+	return job, nil
+}
+
+// StartPushJob starts to push the file to all devices of the job
+func (srv *RttyServer) StartPushJob(job *PushJob) {
+	srv.pushJobs.Store(job.id, job)
+
+	log.Info().Msgf("push job '%s': '%s' (%d bytes) to %d devices of group '%s'",
+		job.id, job.path, job.size, len(job.targets), job.group)
+
+	for devid := range job.targets {
+		go job.push(srv, devid)
+	}
+
+	go job.expire(srv)
+}
+
+// finished returns when the last device of the job finished, zero if
+// some are still to be tried
+func (job *PushJob) finished() time.Time {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	var last time.Time
+
+	for _, tgt := range job.targets {
+		if tgt.retry != nil {
+			return time.Time{}
+		}
+
+		switch tgt.state {
+		case pushPending, pushRunning, pushOffline:
+			return time.Time{}
+		}
+
+		if tgt.updated.After(last) {
+			last = tgt.updated
+		}
+	}
+
+	return last
+}
+
+// expire removes the job once finished for pushRetention, or once
+// pushExpire passed, and when the server stops.
+func (job *PushJob) expire(srv *RttyServer) {
+	ticker := time.NewTicker(pushCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-job.ctx.Done():
+			srv.DeletePushJob(job.id)
+			return
+
+		case <-ticker.C:
+			if time.Since(job.created) >= pushExpire {
+				log.Info().Msgf("push job '%s' expired", job.id)
+				srv.DeletePushJob(job.id)
+				return
+			}
+
+			if last := job.finished(); !last.IsZero() && time.Since(last) >= pushRetention {
+				log.Info().Msgf("push job '%s' finished, removed", job.id)
+				srv.DeletePushJob(job.id)
+				return
+			}
+		}
+	}
+}
+
+// DeletePushJob cancels the push job and removes its file
+func (srv *RttyServer) DeletePushJob(id string) bool {
+	v, loaded := srv.pushJobs.LoadAndDelete(id)
+	if !loaded {
+		return false
+	}
+
+	job := v.(*PushJob)
+
+	job.cancel()
+
+	job.mu.Lock()
+	for _, tgt := range job.targets {
+		if tgt.retry != nil {
+			tgt.retry.Stop()
+		}
+		if tgt.state != pushSuccess {
+			tgt.state = pushCanceled
+		}
+	}
+	job.mu.Unlock()
+
+	os.Remove(job.file)
+
+	return true
+}
+
+// resumePushJobs pushes the files of the jobs to the device, which was
+// offline when tried.
+func (srv *RttyServer) resumePushJobs(dev *Device) {
+	srv.pushJobs.Range(func(key, value any) bool {
+		job := value.(*PushJob)
+
+		if job.group != dev.group {
+			return true
+		}
+
+		job.mu.Lock()
+		tgt, ok := job.targets[dev.id]
+		resume := ok && tgt.state == pushOffline
+		if resume {
+			tgt.state = pushPending
+		}
+		job.mu.Unlock()
+
+		if resume {
+			go job.push(srv, dev.id)
+		}
+
+		return true
+	})
+}
+
+func (job *PushJob) setState(tgt *pushTarget, state string, err error) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	if job.ctx.Err() != nil {
+		return
+	}
+
+	tgt.state = state
+	tgt.updated = time.Now()
+	tgt.err = ""
+
+	if err != nil {
+		tgt.err = err.Error()
+	}
+}
+
+func (job *PushJob) push(srv *RttyServer, devid string) {
+	defer xlog.LogPanic()
+
+	select {
+	case job.sem <- struct{}{}:
+	case <-job.ctx.Done():
+		return
+	}
+	defer func() { <-job.sem }()
+
+	job.mu.Lock()
+	tgt := job.targets[devid]
+	job.mu.Unlock()
+
+	dev := srv.GetDevice(job.group, devid)
+	if dev == nil {
+		job.setState(tgt, pushOffline, nil)
+		return
+	}
+
+	f, err := os.Open(job.file)
+	if err != nil {
+		job.setState(tgt, pushFailed, err)
+		return
+	}
+	defer f.Close()
+
+	t := srv.newFileTransfer(job.ctx, dev, job.path, true, job.username, job.owner)
+	t.size = job.size
+	t.overwrite = job.overwrite
+	t.via = fileViaPush
+
+	job.mu.Lock()
+	tgt.state = pushRunning
+	tgt.attempts++
+	tgt.transfer = t
+	tgt.updated = time.Now()
+	attempts := tgt.attempts
+	job.mu.Unlock()
+
+	var sum string
+
+	err = t.open(srv, job.devUsername, job.devPassword)
+	if err == nil {
+		sum, err = t.doUpload(f)
+	}
+
+	t.close(srv)
+	t.log(srv, sum, err)
+
+	switch {
+	case err == nil:
+		log.Info().Msgf("push job '%s': device '%s' done", job.id, devid)
+		job.setState(tgt, pushSuccess, nil)
+		return
+
+	case job.ctx.Err() != nil:
+		return
+
+	case dev.ctx.Err() != nil || errors.Is(err, errFileDevOffline):
+		// Tried again on the next registration
+		job.setState(tgt, pushOffline, err)
+		return
+
+	case errors.Is(err, errFileAborted):
+		job.setState(tgt, pushAborted, err)
+
+	default:
+		job.setState(tgt, pushFailed, err)
+	}
+
+	log.Error().Msgf("push job '%s': device '%s' attempt %d fail: %v", job.id, devid, attempts, err)
+
+	job.mu.Lock()
+	defer job.mu.Unlock()
+
+	// Trying again makes no difference
+	if errors.Is(err, errFileExists) || errors.Is(err, errFileLogin) || errors.Is(err, errFileDenied) {
+		return
+	}
+
+	// Waiting for the sessions of the user or device to end is not an
+	// attempt
+	if errors.Is(err, errTermLimit) {
+		tgt.attempts--
+		attempts--
+	}
+
+	if attempts < pushMaxAttempts && job.ctx.Err() == nil {
+		tgt.retry = time.AfterFunc(pushRetryDelay*time.Duration(attempts), func() {
+			job.mu.Lock()
+			tgt.retry = nil
+			if job.ctx.Err() == nil {
+				tgt.state = pushPending
+			}
+			job.mu.Unlock()
+
+			job.push(srv, devid)
+		})
+	}
+}
+
+// handlePushJobCreate stores the request body and pushes it to the path
+// on the devices given by the group and devices (comma separated IDs)
+// queries. An unknown query is rejected rather than ignored, which would
+// push to all the devices of the group.
+func (a *APIServer) handlePushJobCreate(c *gin.Context) {
+	if !a.callUserHookUrl(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	for name := range c.Request.URL.Query() {
+		if !slices.Contains(pushJobQueries, name) {
+			c.JSON(http.StatusBadRequest, gin.H{"err": "unknown query " + name})
+			return
+		}
+	}
+
+	p, err := filePath(c)
+	if err != nil || p == "/" {
+		fileErrResp(c, errFileInvalidPath)
+		return
+	}
+
+	var devids []string
+
+	for devid := range strings.SplitSeq(c.Query("devices"), ",") {
+		if devid = strings.TrimSpace(devid); devid != "" && !slices.Contains(devids, devid) {
+			devids = append(devids, devid)
+		}
+	}
+
+	job, err := a.srv.NewPushJob(c.Request.Body, c.Query("group"), devids, p,
+		c.Query("overwrite") == "1", a.sessionUser(c), a.sessionOwner(c))
+	if errors.Is(err, errFileDenied) {
+		fileErrResp(c, err)
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+
+	job.devUsername = c.GetHeader("X-Device-Username")
+	job.devPassword = c.GetHeader("X-Device-Password")
+
+	a.srv.StartPushJob(job)
+
+	c.JSON(http.StatusOK, job.Info(true))
+}
+
+func (a *APIServer) pushJob(c *gin.Context) *PushJob {
+	v, ok := a.srv.pushJobs.Load(c.Param("id"))
+	if !ok {
+		return nil
+	}
+
+	job := v.(*PushJob)
+
+	if (!a.isAdmin(c) && job.username != a.sessionUser(c)) || !tokenGroupAllowed(c, job.group) {
+		return nil
+	}
+
+	return job
+}
+
+// handlePushJobs lists the push jobs, all for admins and the own jobs
+// for the others.
+func (a *APIServer) handlePushJobs(c *gin.Context) {
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	infos := make([]*PushJobInfo, 0)
+
+	for _, job := range a.srv.PushJobs() {
+		if (admin || job.username == username) && tokenGroupAllowed(c, job.group) {
+			infos = append(infos, job.Info(false))
+		}
+	}
+
+	slices.SortFunc(infos, func(a, b *PushJobInfo) int {
+		return int(a.Created - b.Created)
+	})
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handlePushJob(c *gin.Context) {
+	job := a.pushJob(c)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, job.Info(true))
+}
+
+func (a *APIServer) handlePushJobDelete(c *gin.Context) {
+	job := a.pushJob(c)
+	if job == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	a.srv.DeletePushJob(job.id)
+
+	c.Status(http.StatusOK)
+}
@@ -0,0 +1,97 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPushJobFinished(t *testing.T) {
+	t1 := time.Unix(1000, 0)
+	t2 := time.Unix(2000, 0)
+
+	tests := []struct {
+		name    string
+		targets []*pushTarget
+		want    time.Time
+	}{
+		{"done", []*pushTarget{
+			{devid: "d1", state: pushSuccess, updated: t2},
+			{devid: "d2", state: pushFailed, updated: t1},
+			{devid: "d3", state: pushAborted, updated: t1},
+		}, t2},
+		{"canceled", []*pushTarget{
+			{devid: "d1", state: pushCanceled, updated: t1},
+		}, t1},
+		{"pending", []*pushTarget{
+			{devid: "d1", state: pushSuccess, updated: t1},
+			{devid: "d2", state: pushPending, updated: t1},
+		}, time.Time{}},
+		{"running", []*pushTarget{
+			{devid: "d1", state: pushRunning, updated: t1},
+		}, time.Time{}},
+		{"offline", []*pushTarget{
+			{devid: "d1", state: pushOffline, updated: t1},
+		}, time.Time{}},
+		{"retrying", []*pushTarget{
+			{devid: "d1", state: pushFailed, updated: t1, retry: time.NewTimer(time.Hour)},
+		}, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		job := &PushJob{targets: map[string]*pushTarget{}}
+
+		for _, tgt := range tt.targets {
+			job.targets[tgt.devid] = tgt
+		}
+
+		if got := job.finished(); !got.Equal(tt.want) {
+			t.Errorf("%s: finished %v, want %v", tt.name, got, tt.want)
+		}
+
+		for _, tgt := range tt.targets {
+			if tgt.retry != nil {
+				tgt.retry.Stop()
+			}
+		}
+	}
+}
+
+func TestPushJobCreateQuery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{})
+
+	a := &APIServer{srv: srv}
+	r := gin.New()
+	r.POST("/push-jobs", a.handlePushJobCreate)
+
+	tests := []struct {
+		query string
+		err   string
+	}{
+		{"path=/tmp/a&labels=role%3Dap", "unknown query labels"},
+		{"path=/tmp/a&group=g1&selector=x", "unknown query selector"},
+		{"path=/tmp/a&group=g1&device=dev1", "unknown query device"},
+		{"path=/tmp/a&group=g1&devices=&overwrite=1", errPushNoTarget.Error()},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/push-jobs?"+tt.query, strings.NewReader("data")))
+
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tt.err) {
+			t.Errorf("%s: status %d %s, want %q", tt.query, w.Code, w.Body, tt.err)
+		}
+	}
+}
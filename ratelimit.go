@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket holding up to one second of data. The
+// rate in bytes per second is read on each call, so that a reloaded
+// config takes effect at once. There's no limit if the rate is 0.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   func() int
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate func() int) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait
+// until they are available, without blocking. A message larger than the
+// bucket is let through once the bucket has been refilled.
+func (l *rateLimiter) reserve(n int) time.Duration {
+	if l == nil || n == 0 {
+		return 0
+	}
+
+	rate := l.rate()
+	if rate <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*float64(rate), float64(rate))
+	}
+
+	l.last = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// wait takes n bytes from the bucket and blocks until they are
+// available or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	delay := l.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimits returns the limits for the devices in the group
+func (srv *RttyServer) rateLimits(group string) RateLimits {
+	cfg := srv.config()
+
+	if limits, ok := cfg.RateLimit.Groups[group]; ok {
+		return limits
+	}
+
+	return cfg.RateLimit.Default
+}
@@ -0,0 +1,139 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterNoLimit(t *testing.T) {
+	var nilLimiter *rateLimiter
+
+	if d := nilLimiter.reserve(1 << 20); d != 0 {
+		t.Errorf("nil limiter: delay %v, want 0", d)
+	}
+
+	l := newRateLimiter(func() int { return 0 })
+
+	for range 10 {
+		if d := l.reserve(1 << 20); d != 0 {
+			t.Fatalf("rate 0: delay %v, want 0", d)
+		}
+	}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter(func() int { return 1000 })
+
+	// The bucket starts full with one second of data
+	if d := l.reserve(600); d != 0 {
+		t.Fatalf("first 600 bytes: delay %v, want 0", d)
+	}
+
+	if d := l.reserve(400); d != 0 {
+		t.Fatalf("next 400 bytes: delay %v, want 0", d)
+	}
+
+	// The bucket is empty, 500 bytes more take half a second
+	d := l.reserve(500)
+	if d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("500 bytes over the burst: delay %v, want about 500ms", d)
+	}
+}
+
+func TestRateLimiterLarge(t *testing.T) {
+	l := newRateLimiter(func() int { return 1000 })
+
+	// Larger than the bucket, let through once refilled
+	d := l.reserve(3000)
+	if d < 1900*time.Millisecond || d > 2000*time.Millisecond {
+		t.Fatalf("3000 bytes: delay %v, want about 2s", d)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(func() int { return 1000 })
+
+	l.reserve(1000)
+
+	// Half a second refills half the bucket
+	l.mu.Lock()
+	l.last = l.last.Add(-500 * time.Millisecond)
+	l.mu.Unlock()
+
+	if d := l.reserve(400); d != 0 {
+		t.Fatalf("400 bytes after 500ms: delay %v, want 0", d)
+	}
+
+	// The bucket never holds more than one second of data
+	l.mu.Lock()
+	l.last = l.last.Add(-time.Hour)
+	l.mu.Unlock()
+
+	if d := l.reserve(1000); d != 0 {
+		t.Fatalf("1000 bytes after an hour: delay %v, want 0", d)
+	}
+
+	if d := l.reserve(100); d == 0 {
+		t.Fatal("100 bytes over a full bucket: no delay")
+	}
+}
+
+func TestRateLimiterRateChange(t *testing.T) {
+	rate := 1000
+	l := newRateLimiter(func() int { return rate })
+
+	l.reserve(1000)
+
+	// A reloaded config takes effect at once
+	rate = 0
+
+	if d := l.reserve(1000); d != 0 {
+		t.Fatalf("unlimited: delay %v, want 0", d)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	l := newRateLimiter(func() int { return 10000 })
+
+	if err := l.wait(context.Background(), 10000); err != nil {
+		t.Fatalf("burst: %v", err)
+	}
+
+	start := time.Now()
+
+	if err := l.wait(context.Background(), 1000); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Fatalf("waited %v, want about 100ms", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(func() int { return 1000 })
+
+	l.reserve(1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	// An hour of data, canceled by the context
+	err := l.wait(ctx, 3600*1000)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("wait: %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("canceled wait returned after %v", elapsed)
+	}
+}
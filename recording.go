@@ -0,0 +1,654 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/rs/zerolog/log"
+)
+
+// Longer lines are split, not to keep the output without newlines forever
+const recordingMaxLine = 4096
+
+// recording is the output of a terminal session recorded to <sid>.log in
+// the recording directory, one line of text prefixed with the Unix
+// milliseconds it started at and a tab per line. The info is saved to
+// <sid>.json, with the words of the output once the session is closed.
+type recording struct {
+	Session  string    `json:"session"`
+	Group    string    `json:"group"`
+	Devid    string    `json:"devid"`
+	Username string    `json:"username"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Words    []string  `json:"words"`
+
+	mu   sync.Mutex
+	dir  string
+	file *os.File
+
+	// The index, the lower-cased words of the output
+	words map[string]struct{}
+
+	line     []byte
+	lineTime time.Time
+	esc      int
+	lines    int
+}
+
+// recordingIndex keeps the recordings in the recording directory in
+// memory, to find the ones containing the words searched.
+type recordingIndex struct {
+	mu   sync.RWMutex
+	recs map[string]*recording
+}
+
+type RecordingMatch struct {
+	Group    string    `json:"group"`
+	Devid    string    `json:"devid"`
+	Session  string    `json:"session"`
+	Username string    `json:"username"`
+	Time     time.Time `json:"time"`
+	Line     string    `json:"line"`
+	Before   []string  `json:"before"`
+	After    []string  `json:"after"`
+}
+
+// recordingWords splits the text into lower-cased words
+func recordingWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (idx *recordingIndex) add(r *recording) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.recs == nil {
+		idx.recs = make(map[string]*recording)
+	}
+
+	idx.recs[r.Session] = r
+}
+
+func (idx *recordingIndex) remove(sid string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	delete(idx.recs, sid)
+}
+
+func (idx *recordingIndex) all() []*recording {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	recs := make([]*recording, 0, len(idx.recs))
+	for _, r := range idx.recs {
+		recs = append(recs, r)
+	}
+
+	return recs
+}
+
+// startRecording starts to record the output of the session, it returns
+// nil if recording is disabled or failed.
+func (srv *RttyServer) startRecording(user *User) *recording {
+	dir := srv.config().Recording.Dir
+	if dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Error().Err(err).Msg("create recording dir fail")
+		return nil
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, user.sid+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		log.Error().Err(err).Msgf("create recording of session '%s' fail", user.sid)
+		return nil
+	}
+
+	r := &recording{
+		Session:  user.sid,
+		Group:    user.dev.group,
+		Devid:    user.dev.id,
+		Username: user.username,
+		Start:    time.Now(),
+		dir:      dir,
+		file:     f,
+		words:    make(map[string]struct{}),
+	}
+
+	r.save()
+
+	srv.recordings.add(r)
+
+	return r
+}
+
+// write records the terminal output
+func (r *recording) write(data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	var out []byte
+
+	for len(data) > 0 {
+		c := data[0]
+
+		if r.esc != escNone {
+			data = data[1:]
+
+			switch r.esc {
+			case escStart:
+				switch c {
+				case '[':
+					r.esc = escCSI
+				case ']', 'P', 'X', '^', '_':
+					r.esc = escOSC
+				case '(', ')', '*', '+', '#', '%':
+					r.esc = escSS3
+				default:
+					r.esc = escNone
+				}
+			case escCSI:
+				if c >= 0x40 && c <= 0x7e {
+					r.esc = escNone
+				}
+			case escSS3:
+				r.esc = escNone
+			case escOSC:
+				if c == 0x07 {
+					r.esc = escNone
+				} else if c == 0x1b {
+					r.esc = escOSCEsc
+				}
+			case escOSCEsc:
+				if c == '\\' {
+					r.esc = escNone
+				} else {
+					r.esc = escOSC
+				}
+			}
+
+			continue
+		}
+
+		switch {
+		case c == 0x1b:
+			r.esc = escStart
+		case c == '\n':
+			out = r.endLine(out)
+		case c == '\b':
+			if len(r.line) > 0 {
+				_, n := utf8.DecodeLastRune(r.line)
+				r.line = r.line[:len(r.line)-n]
+			}
+		case c == '\t' || c >= 0x20 && c != 0x7f:
+			if len(r.line) == 0 {
+				r.lineTime = time.Now()
+			}
+			r.line = append(r.line, c)
+			if len(r.line) >= recordingMaxLine {
+				out = r.endLine(out)
+			}
+		}
+
+		data = data[1:]
+	}
+
+	if len(out) > 0 {
+		if _, err := r.file.Write(out); err != nil {
+			log.Error().Err(err).Msgf("write recording of session '%s' fail", r.Session)
+		}
+	}
+}
+
+// endLine appends the current line to out, and adds its words to the
+// index.
+func (r *recording) endLine(out []byte) []byte {
+	line := strings.TrimRightFunc(strings.ToValidUTF8(string(r.line), ""), unicode.IsSpace)
+	r.line = r.line[:0]
+
+	if line == "" {
+		return out
+	}
+
+	for _, w := range recordingWords(line) {
+		r.words[w] = struct{}{}
+	}
+
+	r.lines++
+
+	out = strconv.AppendInt(out, r.lineTime.UnixMilli(), 10)
+	out = append(out, '\t')
+	out = append(out, line...)
+
+	return append(out, '\n')
+}
+
+// close ends the recording. A recording without output is removed.
+func (r *recording) close(srv *RttyServer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if out := r.endLine(nil); len(out) > 0 {
+		r.file.Write(out)
+	}
+
+	r.file.Close()
+	r.file = nil
+
+	if r.lines == 0 {
+		srv.recordings.remove(r.Session)
+		os.Remove(filepath.Join(r.dir, r.Session+".log"))
+		os.Remove(filepath.Join(r.dir, r.Session+".json"))
+		return
+	}
+
+	r.End = time.Now()
+	r.save()
+}
+
+// save writes the info of the recording with the lock held
+func (r *recording) save() {
+	r.Words = make([]string, 0, len(r.words))
+	for w := range r.words {
+		r.Words = append(r.Words, w)
+	}
+
+	slices.Sort(r.Words)
+
+	b, _ := jsoniter.Marshal(r)
+
+	r.Words = nil
+
+	if err := os.WriteFile(filepath.Join(r.dir, r.Session+".json"), b, 0600); err != nil {
+		log.Error().Err(err).Msgf("save recording of session '%s' fail", r.Session)
+	}
+}
+
+// loadRecordings loads the index of the recordings in the directory. The
+// ones not closed, as the server was stopped unexpectedly, are indexed
+// again from the output.
+func (srv *RttyServer) loadRecordings(dir string) {
+	infos, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return
+	}
+
+	for _, name := range infos {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+
+		r := &recording{dir: dir, words: make(map[string]struct{})}
+
+		if err := jsoniter.Unmarshal(b, r); err != nil || r.Session == "" {
+			log.Error().Msgf("invalid recording info '%s'", name)
+			continue
+		}
+
+		srv.recordings.mu.RLock()
+		_, ok := srv.recordings.recs[r.Session]
+		srv.recordings.mu.RUnlock()
+
+		// Being recorded
+		if ok {
+			continue
+		}
+
+		for _, w := range r.Words {
+			r.words[w] = struct{}{}
+		}
+		r.Words = nil
+
+		if r.End.IsZero() {
+			fi, err := os.Stat(filepath.Join(dir, r.Session+".log"))
+			if err != nil {
+				continue
+			}
+
+			r.End = fi.ModTime()
+
+			r.scan(func(t time.Time, line string) bool {
+				for _, w := range recordingWords(line) {
+					r.words[w] = struct{}{}
+				}
+				return true
+			})
+
+			r.save()
+
+			log.Warn().Msgf("recording of session '%s' not closed, indexed again", r.Session)
+		}
+
+		srv.recordings.add(r)
+	}
+}
+
+// scan calls fn with each line of the output until it returns false
+func (r *recording) scan(fn func(t time.Time, line string) bool) error {
+	f, err := os.Open(filepath.Join(r.dir, r.Session+".log"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), recordingMaxLine*4)
+
+	for sc.Scan() {
+		ms, line, ok := bytes.Cut(sc.Bytes(), []byte{'\t'})
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.ParseInt(string(ms), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if !fn(time.UnixMilli(n), string(line)) {
+			break
+		}
+	}
+
+	return sc.Err()
+}
+
+// cleanRecordings removes the recordings ended before the retention
+func (srv *RttyServer) cleanRecordings() {
+	cfg := srv.config()
+
+	if cfg.Recording.Retention == 0 {
+		return
+	}
+
+	expire := time.Now().AddDate(0, 0, -cfg.Recording.Retention)
+
+	for _, r := range srv.recordings.all() {
+		r.mu.Lock()
+		expired := !r.End.IsZero() && r.End.Before(expire)
+		r.mu.Unlock()
+
+		if !expired {
+			continue
+		}
+
+		srv.recordings.remove(r.Session)
+
+		os.Remove(filepath.Join(r.dir, r.Session+".log"))
+		os.Remove(filepath.Join(r.dir, r.Session+".json"))
+
+		log.Debug().Msgf("recording of session '%s' expired", r.Session)
+	}
+}
+
+func (srv *RttyServer) recordingsClean() {
+	if dir := srv.config().Recording.Dir; dir != "" {
+		srv.loadRecordings(dir)
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		srv.cleanRecordings()
+
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+type recordingQuery struct {
+	words    []string
+	group    string
+	byGroup  bool // group is set, empty for the devices without group
+	devid    string
+	username string
+	since    time.Time
+	until    time.Time
+	context  int
+	limit    int
+}
+
+// match reports whether the recording may have lines matching the query
+func (r *recording) match(q *recordingQuery) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if q.byGroup && r.Group != q.group {
+		return false
+	}
+
+	if q.devid != "" && r.Devid != q.devid {
+		return false
+	}
+
+	if q.username != "" && r.Username != q.username {
+		return false
+	}
+
+	if !q.since.IsZero() && !r.End.IsZero() && r.End.Before(q.since) {
+		return false
+	}
+
+	if !q.until.IsZero() && r.Start.After(q.until) {
+		return false
+	}
+
+	for _, w := range q.words {
+		if _, ok := r.words[w]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// last returns the time of the last line the recording may have
+func (r *recording) last() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.End.IsZero() {
+		return time.Now()
+	}
+
+	return r.End
+}
+
+// search returns the last q.limit lines of the recording containing all
+// the words
+func (r *recording) search(q *recordingQuery) []*RecordingMatch {
+	var matches []*RecordingMatch
+	before := []string{}
+
+	// Matches still waiting for the lines after them
+	var waiting []*RecordingMatch
+
+	r.scan(func(t time.Time, line string) bool {
+		for _, m := range waiting {
+			m.After = append(m.After, line)
+		}
+
+		waiting = slices.DeleteFunc(waiting, func(m *RecordingMatch) bool {
+			return len(m.After) >= q.context
+		})
+
+		if (q.since.IsZero() || !t.Before(q.since)) && (q.until.IsZero() || !t.After(q.until)) {
+			words := recordingWords(line)
+
+			if !slices.ContainsFunc(q.words, func(w string) bool { return !slices.Contains(words, w) }) {
+				m := &RecordingMatch{
+					Group:    r.Group,
+					Devid:    r.Devid,
+					Session:  r.Session,
+					Username: r.Username,
+					Time:     t,
+					Line:     line,
+					Before:   slices.Clone(before),
+					After:    []string{},
+				}
+
+				matches = append(matches, m)
+
+				// Only the newest are returned
+				if len(matches) > q.limit {
+					matches = slices.Delete(matches, 0, 1)
+				}
+
+				if q.context > 0 {
+					waiting = append(waiting, m)
+				}
+			}
+		}
+
+		if q.context > 0 {
+			if len(before) == q.context {
+				before = before[1:]
+			}
+			before = append(before, line)
+		}
+
+		return true
+	})
+
+	return matches
+}
+
+// searchRecordings returns the recorded lines containing all the words of
+// the query, the newest first.
+func (srv *RttyServer) searchRecordings(q *recordingQuery) []*RecordingMatch {
+	matches := []*RecordingMatch{}
+
+	if q.limit == 0 {
+		return matches
+	}
+
+	type candidate struct {
+		r    *recording
+		last time.Time
+	}
+
+	var cands []candidate
+
+	for _, r := range srv.recordings.all() {
+		if r.match(q) {
+			cands = append(cands, candidate{r, r.last()})
+		}
+	}
+
+	// The newest recordings first, which are scanned until the older
+	// ones can't have newer lines than the matches collected
+	slices.SortFunc(cands, func(a, b candidate) int {
+		return b.last.Compare(a.last)
+	})
+
+	for _, cand := range cands {
+		if len(matches) == q.limit && cand.last.Before(matches[q.limit-1].Time) {
+			break
+		}
+
+		matches = append(matches, cand.r.search(q)...)
+
+		slices.SortStableFunc(matches, func(a, b *RecordingMatch) int {
+			return b.Time.Compare(a.Time)
+		})
+
+		if len(matches) > q.limit {
+			matches = matches[:q.limit]
+		}
+	}
+
+	return matches
+}
+
+func (a *APIServer) handleRecordingSearch(c *gin.Context) {
+	if a.srv.config().Recording.Dir == "" {
+		c.JSON(http.StatusNotFound, gin.H{"err": "recording disabled"})
+		return
+	}
+
+	q := &recordingQuery{
+		words:   recordingWords(c.Query("q")),
+		devid:   c.Query("devid"),
+		context: 2,
+		limit:   100,
+	}
+
+	// A device is given by its group and id. A token limited to some
+	// groups has been checked to give one of them.
+	q.group, q.byGroup = c.GetQuery("group")
+
+	if t := apiToken(c); q.devid != "" || (t != nil && len(t.Groups) > 0) {
+		q.byGroup = true
+	}
+
+	if len(q.words) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"err": "q is required"})
+		return
+	}
+
+	for name, t := range map[string]*time.Time{"since": &q.since, "until": &q.until} {
+		if v := c.Query(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"err": "invalid " + name})
+				return
+			}
+		}
+	}
+
+	for name, n := range map[string]*int{"context": &q.context, "limit": &q.limit} {
+		if v := c.Query(name); v != "" {
+			var err error
+			if *n, err = strconv.Atoi(v); err != nil || *n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"err": "invalid " + name})
+				return
+			}
+		}
+	}
+
+	q.context = min(q.context, 10)
+	q.limit = min(q.limit, 1000)
+
+	// Users only search the output of their own sessions
+	if !a.isAdmin(c) {
+		q.username = a.sessionUser(c)
+	}
+
+	c.JSON(http.StatusOK, a.srv.searchRecordings(q))
+}
@@ -0,0 +1,289 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	jsoniter "github.com/json-iterator/go"
+)
+
+func TestRecordingWords(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{"ls -l /tmp", []string{"ls", "l", "tmp"}},
+		{"Hello, World!", []string{"hello", "world"}},
+		{"eth0: 192.168.1.1/24", []string{"eth0", "192", "168", "1", "1", "24"}},
+		{"ÜBER straße", []string{"über", "straße"}},
+		{"中文 test", []string{"中文", "test"}},
+		{"a_b-c.d", []string{"a", "b", "c", "d"}},
+	}
+
+	for _, tt := range tests {
+		if got := recordingWords(tt.s); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestRecordingMatch(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+
+	r := &recording{
+		Group:    "g1",
+		Devid:    "dev1",
+		Username: "alice",
+		Start:    start,
+		End:      end,
+		words:    map[string]struct{}{"reboot": {}, "now": {}},
+	}
+
+	tests := []struct {
+		name string
+		q    recordingQuery
+		want bool
+	}{
+		{"word", recordingQuery{words: []string{"reboot"}}, true},
+		{"all words", recordingQuery{words: []string{"reboot", "now"}}, true},
+		{"missing word", recordingQuery{words: []string{"reboot", "later"}}, false},
+		{"device", recordingQuery{words: []string{"now"}, group: "g1", byGroup: true, devid: "dev1"}, true},
+		{"other device", recordingQuery{words: []string{"now"}, group: "g1", byGroup: true, devid: "dev2"}, false},
+		{"other group", recordingQuery{words: []string{"now"}, byGroup: true, devid: "dev1"}, false},
+		{"group", recordingQuery{words: []string{"now"}, group: "g1", byGroup: true}, true},
+		{"group only other", recordingQuery{words: []string{"now"}, group: "g2", byGroup: true}, false},
+		{"no group", recordingQuery{words: []string{"now"}, byGroup: true}, false},
+		{"any group", recordingQuery{words: []string{"now"}}, true},
+		{"user", recordingQuery{words: []string{"now"}, username: "alice"}, true},
+		{"other user", recordingQuery{words: []string{"now"}, username: "bob"}, false},
+		{"since", recordingQuery{words: []string{"now"}, since: end}, true},
+		{"since end", recordingQuery{words: []string{"now"}, since: end.Add(time.Second)}, false},
+		{"until", recordingQuery{words: []string{"now"}, until: start}, true},
+		{"until start", recordingQuery{words: []string{"now"}, until: start.Add(-time.Second)}, false},
+	}
+
+	for _, tt := range tests {
+		if got := r.match(&tt.q); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// A recording in progress may have newer lines
+	r.End = time.Time{}
+
+	if !r.match(&recordingQuery{words: []string{"now"}, since: end.Add(time.Hour)}) {
+		t.Error("in progress: no match since its last line")
+	}
+}
+
+// newTestRecording writes the lines, one per second from start
+func newTestRecording(t *testing.T, dir, sid string, start time.Time, lines []string) *recording {
+	b := &strings.Builder{}
+
+	for i, line := range lines {
+		fmt.Fprintf(b, "%d\t%s\n", start.Add(time.Duration(i)*time.Second).UnixMilli(), line)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, sid+".log"), []byte(b.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return &recording{
+		Session: sid,
+		Start:   start,
+		End:     start.Add(time.Duration(len(lines)) * time.Second),
+		dir:     dir,
+	}
+}
+
+func TestRecordingSearch(t *testing.T) {
+	r := newTestRecording(t, t.TempDir(), "s1", time.Unix(1000, 0), []string{
+		"l0", "l1 hit", "l2", "l3", "l4 hit", "l5 hit", "l6", "l7",
+	})
+
+	tests := []struct {
+		name    string
+		context int
+		limit   int
+		lines   []string
+		before  [][]string
+		after   [][]string
+	}{
+		{"no context", 0, 10,
+			[]string{"l1 hit", "l4 hit", "l5 hit"},
+			[][]string{{}, {}, {}},
+			[][]string{{}, {}, {}}},
+		{"context", 2, 10,
+			[]string{"l1 hit", "l4 hit", "l5 hit"},
+			[][]string{{"l0"}, {"l2", "l3"}, {"l3", "l4 hit"}},
+			[][]string{{"l2", "l3"}, {"l5 hit", "l6"}, {"l6", "l7"}}},
+		{"context beyond the end", 3, 10,
+			[]string{"l1 hit", "l4 hit", "l5 hit"},
+			[][]string{{"l0"}, {"l1 hit", "l2", "l3"}, {"l2", "l3", "l4 hit"}},
+			[][]string{{"l2", "l3", "l4 hit"}, {"l5 hit", "l6", "l7"}, {"l6", "l7"}}},
+		{"limit", 1, 2,
+			[]string{"l4 hit", "l5 hit"},
+			[][]string{{"l3"}, {"l4 hit"}},
+			[][]string{{"l5 hit"}, {"l6"}}},
+	}
+
+	for _, tt := range tests {
+		q := &recordingQuery{words: []string{"hit"}, context: tt.context, limit: tt.limit}
+
+		matches := r.search(q)
+
+		if len(matches) != len(tt.lines) {
+			t.Errorf("%s: %d matches, want %d", tt.name, len(matches), len(tt.lines))
+			continue
+		}
+
+		for i, m := range matches {
+			if m.Line != tt.lines[i] || !slices.Equal(m.Before, tt.before[i]) || !slices.Equal(m.After, tt.after[i]) {
+				t.Errorf("%s: match %d is %q before %q after %q, want %q before %q after %q", tt.name, i,
+					m.Line, m.Before, m.After, tt.lines[i], tt.before[i], tt.after[i])
+			}
+		}
+	}
+
+	// Lines out of the time range are not matched, but kept as context
+	q := &recordingQuery{words: []string{"hit"}, context: 1, limit: 10, since: time.Unix(1002, 0)}
+
+	matches := r.search(q)
+	if len(matches) != 2 || matches[0].Line != "l4 hit" || !slices.Equal(matches[0].Before, []string{"l3"}) {
+		t.Errorf("since: got %d matches, want l4 hit and l5 hit", len(matches))
+	}
+}
+
+func TestSearchRecordings(t *testing.T) {
+	dir := t.TempDir()
+	srv := &RttyServer{}
+
+	old := newTestRecording(t, dir, "old", time.Unix(1000, 0), []string{"a hit", "b hit"})
+	mid := newTestRecording(t, dir, "mid", time.Unix(1500, 0), []string{"c hit", "d"})
+	cur := newTestRecording(t, dir, "cur", time.Unix(2000, 0), []string{"e hit", "f hit"})
+
+	for _, r := range []*recording{old, mid, cur} {
+		r.words = map[string]struct{}{"hit": {}}
+		srv.recordings.add(r)
+	}
+
+	tests := []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{}},
+		{1, []string{"f hit"}},
+		{3, []string{"f hit", "e hit", "c hit"}},
+		{10, []string{"f hit", "e hit", "c hit", "b hit", "a hit"}},
+	}
+
+	for _, tt := range tests {
+		lines := []string{}
+
+		for _, m := range srv.searchRecordings(&recordingQuery{words: []string{"hit"}, limit: tt.limit}) {
+			lines = append(lines, m.Line)
+		}
+
+		if !slices.Equal(lines, tt.want) {
+			t.Errorf("limit %d: got %q, want %q", tt.limit, lines, tt.want)
+		}
+	}
+
+	// The older recordings aren't scanned once enough newer lines are
+	// found: a line of the oldest one, out of its time range, would be
+	// the first if it were
+	newTestRecording(t, dir, "old", time.Unix(3000, 0), []string{"z hit"})
+
+	if m := srv.searchRecordings(&recordingQuery{words: []string{"hit"}, limit: 3}); m[0].Line != "f hit" {
+		t.Errorf("limit 3: the oldest recording scanned, got %q first", m[0].Line)
+	}
+
+	if m := srv.searchRecordings(&recordingQuery{words: []string{"hit"}, limit: 10}); m[0].Line != "z hit" {
+		t.Errorf("limit 10: the oldest recording not scanned, got %q first", m[0].Line)
+	}
+}
+
+func TestRecordingSearchGroup(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	dir := t.TempDir()
+
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{Recording: RecordingConfig{Dir: dir}})
+
+	for i, dev := range []struct{ group, devid string }{{"g1", "dev1"}, {"g2", "dev1"}, {"", "dev2"}} {
+		r := newTestRecording(t, dir, fmt.Sprintf("s%d", i), time.Unix(int64(1000*(i+1)), 0),
+			[]string{fmt.Sprintf("%s %s hit", dev.group, dev.devid)})
+		r.Group = dev.group
+		r.Devid = dev.devid
+		r.words = map[string]struct{}{"hit": {}}
+		srv.recordings.add(r)
+	}
+
+	a := &APIServer{srv: srv}
+	router := gin.New()
+
+	var token *APIToken
+
+	router.GET("/recordings/search", func(c *gin.Context) {
+		if token != nil {
+			c.Set("apiToken", token)
+		}
+		a.handleRecordingSearch(c)
+	})
+
+	tests := []struct {
+		query  string
+		groups []string
+		want   []string
+	}{
+		{"", nil, []string{" dev2 hit", "g2 dev1 hit", "g1 dev1 hit"}},
+		{"&group=g1", nil, []string{"g1 dev1 hit"}},
+		{"&group=g2", nil, []string{"g2 dev1 hit"}},
+		{"&group=", nil, []string{" dev2 hit"}},
+		{"&group=g1&devid=dev1", nil, []string{"g1 dev1 hit"}},
+		{"&devid=dev1", nil, []string{}},
+		{"&devid=dev2", nil, []string{" dev2 hit"}},
+
+		// A token limited to groups only searches the given one
+		{"&group=g1", []string{"g1"}, []string{"g1 dev1 hit"}},
+		{"", []string{""}, []string{" dev2 hit"}},
+	}
+
+	for _, tt := range tests {
+		token = nil
+		if tt.groups != nil {
+			token = &APIToken{Groups: tt.groups}
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/recordings/search?q=hit"+tt.query, nil))
+
+		var matches []*RecordingMatch
+		jsoniter.Unmarshal(w.Body.Bytes(), &matches)
+
+		lines := []string{}
+		for _, m := range matches {
+			lines = append(lines, m.Line)
+		}
+
+		if !slices.Equal(lines, tt.want) {
+			t.Errorf("%q groups %q: got %q, want %q", tt.query, tt.groups, lines, tt.want)
+		}
+	}
+}
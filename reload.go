@@ -0,0 +1,178 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+
+	xlog "github.com/zhaojh329/rttys/v5/log"
+
+	"github.com/rs/zerolog/log"
+)
+
+type ReloadResult struct {
+	// Options which have been applied
+	Changed []string `json:"changed"`
+	// Options which changed but need a restart to take effect
+	Restart []string `json:"restart"`
+}
+
+// Options which can't be changed at runtime
+var restartRequiredOpts = map[string]bool{
+	"device.addr":     true,
+	"user.addr":       true,
+	"http-proxy.addr": true,
+	"pprof":           true,
+	"recording.dir":   true,
+
+	"user.api-token-file": true,
+}
+
+// Options whose values are not logged
+var secretOpts = map[string]bool{
+	"device.tokens": true,
+	"user.password": true,
+	"user.users":    true,
+}
+
+var deviceTLSOpts = []string{"device.ssl.cert", "device.ssl.key", "device.ssl.cacert"}
+
+// SetConfigLoader sets the function used by ReloadConfig to load
+// the new config, usually by re-reading the config file.
+func (srv *RttyServer) SetConfigLoader(loader func() (Config, error)) {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+
+	srv.cfgLoader = loader
+}
+
+// ReloadConfig loads the config with the loader set by SetConfigLoader
+// and applies it.
+func (srv *RttyServer) ReloadConfig() (*ReloadResult, error) {
+	srv.reloadMu.Lock()
+	loader := srv.cfgLoader
+	srv.reloadMu.Unlock()
+
+	if loader == nil {
+		return nil, errors.New("config reload not supported")
+	}
+
+	cfg, err := loader()
+	if err != nil {
+		log.Error().Err(err).Msg("reload config fail")
+		return nil, err
+	}
+
+	return srv.ApplyConfig(cfg), nil
+}
+
+// ApplyConfig applies the options of cfg which can be changed safely at
+// runtime. The other options keep their current values and are reported
+// in ReloadResult.Restart if they differ.
+func (srv *RttyServer) ApplyConfig(cfg Config) *ReloadResult {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+
+	old := srv.config()
+
+	res := &ReloadResult{
+		Changed: []string{},
+		Restart: []string{},
+	}
+
+	oldFields := old.fields()
+	newFields := cfg.fields()
+
+	changed := func(name string) bool {
+		return !reflect.DeepEqual(newFields[name].Interface(), oldFields[name].Interface())
+	}
+
+	keep := func(name string) {
+		newFields[name].Set(oldFields[name])
+	}
+
+	restart := func(name string) {
+		if changed(name) {
+			res.Restart = append(res.Restart, name)
+			keep(name)
+		}
+	}
+
+	tlsOn := func(cfg *Config) bool { return cfg.Device.SSL.Cert != "" && cfg.Device.SSL.Key != "" }
+
+	tlsChanged := cfg.Device.SSL != old.Device.SSL
+
+	if tlsChanged {
+		if tlsOn(old) != tlsOn(&cfg) {
+			// The listener is only wrapped with TLS on start
+			for _, name := range deviceTLSOpts {
+				restart(name)
+			}
+		} else if tlsOn(&cfg) {
+			config, err := loadDeviceTLSConfig(&cfg)
+			if err != nil {
+				log.Error().Err(err).Msg("reload SSL/TLS for device fail, keep the old one")
+				for _, name := range deviceTLSOpts {
+					keep(name)
+				}
+			} else {
+				srv.devTLS.Store(config)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(newFields))
+	for name := range newFields {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if restartRequiredOpts[name] {
+			restart(name)
+		}
+	}
+
+	for _, name := range names {
+		if !changed(name) {
+			continue
+		}
+
+		oldVal := oldFields[name].Interface()
+		newVal := newFields[name].Interface()
+
+		res.Changed = append(res.Changed, name)
+
+		if secretOpts[name] {
+			log.Info().Msgf("config '%s' changed", name)
+		} else {
+			log.Info().Msgf("config '%s' changed: '%v' -> '%v'", name, oldVal, newVal)
+		}
+	}
+
+	slices.Sort(res.Restart)
+
+	for _, name := range res.Restart {
+		log.Warn().Msgf("config '%s' changed, but need restart to take effect", name)
+	}
+
+	if cfg.LogLevel != old.LogLevel {
+		xlog.SetLevel(cfg.LogLevel)
+	}
+
+	srv.cfg.Store(&cfg)
+
+	// Let the log files be rotated by a reload
+	srv.accessLog.reopen()
+	srv.fileLog.reopen()
+	srv.cmdLog.reopen()
+
+	log.Info().Msgf("config reloaded, %d changed, %d need restart", len(res.Changed), len(res.Restart))
+
+	return res
+}
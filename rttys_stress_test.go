@@ -3,7 +3,7 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
 	"context"
@@ -38,11 +38,11 @@ func TestRttysStress(t *testing.T) {
 	}
 
 	cfg := Config{
-		AddrDev:  ":5912",
-		AddrUser: ":5913",
+		Device: DeviceConfig{Addr: ":5912"},
+		User:   UserConfig{Addr: ":5913"},
 	}
 
-	srv := &RttyServer{cfg: cfg}
+	srv := NewServer(cfg)
 
 	go func() {
 		err := srv.Run()
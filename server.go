@@ -3,22 +3,71 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+// Package rttys implements the server side of rtty. It is used by the
+// rttys command and can also be embedded into other Go programs.
+package rttys
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
+	"net/http/pprof"
+	"os"
 	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
 )
 
 type RttyServer struct {
 	mu            sync.RWMutex
 	groups        sync.Map
-	cfg           Config
-	httpProxyPort int
+	cfg           atomic.Pointer[Config]
+	httpProxyPort atomic.Int32
+
+	cfgLoader func() (Config, error)
+	reloadMu  sync.Mutex
+	devTLS    atomic.Pointer[tls.Config]
+
+	api *APIServer
+
+	httpProxySessions sync.Map
+	httpProxyConnID   atomic.Uint32
+	accessLog         accessLog
+
+	fileTransfers sync.Map
+	fileLog       accessLog
+	cmdLog        accessLog
+	recordings    recordingIndex
+	pushJobs      sync.Map
+
+	shares   sync.Map
+	shareKey []byte
+
+	apiTokens apiTokens
+
+	tunnels   sync.Map
+	tunnelsMu sync.Mutex
+
+	terms   termCounter
+	termsMu sync.Mutex
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	draining atomic.Bool
+	shutdown atomic.Bool
+
+	lnMu        sync.Mutex
+	listeners   []net.Listener
+	servers     []*http.Server
+	lnDev       net.Listener
+	lnUser      net.Listener
+	lnHttpProxy net.Listener
 }
 
 type DeviceGroup struct {
@@ -26,26 +75,351 @@ type DeviceGroup struct {
 	count   atomic.Int32
 }
 
+// NewServer creates a server with the given config.
+// Nothing is listened until Start, Run or one of the Serve methods is called.
+func NewServer(cfg Config) *RttyServer {
+	srv := &RttyServer{}
+
+	srv.cfg.Store(&cfg)
+	srv.shareKey = newShareKey()
+	srv.loadAPITokens(cfg.User.APITokenFile)
+
+	srv.ctx, srv.cancel = context.WithCancel(context.Background())
+	srv.api = newAPIServer(srv)
+
+	go srv.httpProxySessionsClean()
+	go srv.recordingsClean()
+
+	return srv
+}
+
+// Run starts all listeners and blocks until the server is stopped.
 func (srv *RttyServer) Run() error {
-	log.Debug().Msgf("%+v", srv.cfg)
+	if err := srv.Start(); err != nil {
+		return err
+	}
+
+	srv.Wait()
+
+	return nil
+}
+
+// Wait blocks until the server is stopped.
+func (srv *RttyServer) Wait() {
+	<-srv.ctx.Done()
+}
+
+// Start listens on the device, user and HTTP proxy addresses from the
+// config and serves them in the background.
+func (srv *RttyServer) Start() error {
+	cfg := srv.config()
+
+	lnDev, err := net.Listen("tcp", cfg.Device.Addr)
+	if err != nil {
+		return err
+	}
+
+	lnHttpProxy, err := net.Listen("tcp", cfg.HttpProxy.Addr)
+	if err != nil {
+		lnDev.Close()
+		return err
+	}
+
+	lnUser, err := net.Listen("tcp", cfg.User.Addr)
+	if err != nil {
+		lnDev.Close()
+		lnHttpProxy.Close()
+		return err
+	}
+
+	return srv.StartWithListeners(lnDev, lnUser, lnHttpProxy)
+}
+
+// StartWithListeners is like Start, but serves on the given listeners
+// instead of the addresses from the config, e.g. listeners inherited
+// from another process.
+func (srv *RttyServer) StartWithListeners(lnDev, lnUser, lnHttpProxy net.Listener) error {
+	cfg := srv.config()
+
+	log.Debug().Msgf("%+v", *cfg)
+
+	srv.lnMu.Lock()
+	srv.lnDev = lnDev
+	srv.lnUser = lnUser
+	srv.lnHttpProxy = lnHttpProxy
+	srv.lnMu.Unlock()
+
+	lnDev, err := srv.wrapDeviceListener(lnDev)
+	if err != nil {
+		lnDev.Close()
+		lnUser.Close()
+		lnHttpProxy.Close()
+		return err
+	}
 
-	if srv.cfg.PprofAddr != "" {
+	if cfg.Pprof != "" {
 		go srv.ListenPprof()
 	}
 
-	go srv.ListenDevices()
-	go srv.ListenHttpProxy()
+	go srv.serveDevices(lnDev)
+	go srv.ServeHttpProxy(lnHttpProxy)
+	go srv.ServeAPI(lnUser)
+
+	return nil
+}
+
+// ListenerFiles returns duplicated files of the device, user and HTTP proxy
+// listeners, in that order, which can be passed to a new process.
+// The caller is responsible for closing them.
+func (srv *RttyServer) ListenerFiles() ([]*os.File, error) {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+
+	files := make([]*os.File, 0, 3)
+
+	for _, ln := range []net.Listener{srv.lnDev, srv.lnUser, srv.lnHttpProxy} {
+		var err error
+
+		if fl, ok := ln.(interface{ File() (*os.File, error) }); ok {
+			var f *os.File
+
+			f, err = fl.File()
+			if err == nil {
+				files = append(files, f)
+				continue
+			}
+		} else {
+			err = errors.New("listener not started or does not support file")
+		}
+
+		for _, f := range files {
+			f.Close()
+		}
+
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// Handover stops accepting new connections but keeps serving the existing
+// ones. Each device is disconnected once it has no terminal sessions, HTTP
+// proxy connections or commands in flight, so that it reconnects to the
+// process which took over the listeners. The server is stopped after all
+// devices are gone.
+//
+// The listeners of the tunnels and pprof are closed for the new process
+// to bind, where the tunnels have to be opened again. Share links are not
+// handed over.
+func (srv *RttyServer) Handover() {
+	srv.draining.Store(true)
+
+	log.Info().Msg("Handover, stop accepting new devices and users")
+
+	for _, hs := range srv.closeListeners() {
+		go hs.Shutdown(context.Background())
+	}
+
+	srv.closeTunnelListeners()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		remain := 0
+
+		srv.RangeDevices(func(dev *Device) bool {
+			if dev.idle() {
+				log.Debug().Msgf("device '%s' is idle, disconnect it for handover", dev.id)
+				dev.Close(srv)
+			} else {
+				remain++
+			}
+			return true
+		})
+
+		if remain == 0 {
+			break
+		}
+
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+
+	srv.Stop()
+
+	log.Info().Msg("Handover complete")
+}
+
+// Stop closes all listeners and disconnects all devices immediately.
+func (srv *RttyServer) Stop() {
+	srv.draining.Store(true)
+
+	for _, hs := range srv.closeListeners() {
+		hs.Close()
+	}
+
+	srv.RangeDevices(func(dev *Device) bool {
+		dev.Close(srv)
+		return true
+	})
+
+	for _, job := range srv.PushJobs() {
+		srv.DeletePushJob(job.id)
+	}
+
+	srv.cancel()
+}
+
+// Shutdown gracefully stops the server. It stops accepting new devices
+// and users, closes the terminal sessions with a close reason, waits for
+// the commands in flight to finish and then disconnects all devices.
+//
+// The wait is bounded by both ctx and the configured drain timeout.
+func (srv *RttyServer) Shutdown(ctx context.Context) error {
+	if !srv.shutdown.CompareAndSwap(false, true) {
+		return errors.New("server is already shutting down")
+	}
+
+	srv.draining.Store(true)
+
+	log.Info().Msg("Shutting down, stop accepting new devices and users")
+
+	if drain := srv.config().DrainTimeout; drain > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(drain)*time.Second)
+		defer cancel()
+	}
+
+	servers := srv.closeListeners()
+
+	srv.RangeDevices(func(dev *Device) bool {
+		dev.closeUsers(websocket.CloseGoingAway, "server shutting down")
+		return true
+	})
+
+	wg := sync.WaitGroup{}
+
+	for _, hs := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			hs.Shutdown(ctx)
+		}()
+	}
+
+	err := srv.waitCommands(ctx)
+
+	wg.Wait()
+
+	srv.Stop()
+
+	log.Info().Msg("Shutdown complete")
+
+	return err
+}
+
+// closeListeners closes all listeners and returns the HTTP servers,
+// which need to be closed by the caller.
+func (srv *RttyServer) closeListeners() []*http.Server {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+
+	for _, ln := range srv.listeners {
+		ln.Close()
+	}
+
+	servers := srv.servers
+
+	srv.listeners = nil
+	srv.servers = nil
 
-	return srv.ListenAPI()
+	return servers
 }
 
+func (srv *RttyServer) waitCommands(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		pending := 0
+
+		srv.RangeDevices(func(dev *Device) bool {
+			dev.commands.Range(func(key, value any) bool {
+				pending++
+				return true
+			})
+			return true
+		})
+
+		if pending == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Warn().Msgf("drain timeout, %d commands still in flight", pending)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func (srv *RttyServer) trackListener(ln net.Listener) bool {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+
+	if srv.draining.Load() {
+		ln.Close()
+		return false
+	}
+
+	srv.listeners = append(srv.listeners, ln)
+
+	return true
+}
+
+func (srv *RttyServer) trackServer(hs *http.Server) bool {
+	srv.lnMu.Lock()
+	defer srv.lnMu.Unlock()
+
+	if srv.draining.Load() {
+		return false
+	}
+
+	srv.servers = append(srv.servers, hs)
+
+	return true
+}
+
+// Time to wait for the address of pprof, held by the old process until
+// it hands over
+const pprofListenRetry = 30 * time.Second
+
 func (srv *RttyServer) ListenPprof() {
-	ln, err := net.Listen("tcp", srv.cfg.PprofAddr)
+	ln, err := net.Listen("tcp", srv.config().Pprof)
+
+	for start := time.Now(); errors.Is(err, syscall.EADDRINUSE) && time.Since(start) < pprofListenRetry; {
+		select {
+		case <-srv.ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+
+		ln, err = net.Listen("tcp", srv.config().Pprof)
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msgf("Failed to start pprof server")
 		return
 	}
-	defer ln.Close()
+
+	if !srv.trackListener(ln) {
+		return
+	}
 
 	addr := ln.Addr().(*net.TCPAddr)
 	log.Info().Msgf("Starting pprof server on: %s", addr)
@@ -56,12 +430,23 @@ func (srv *RttyServer) ListenPprof() {
 	}
 	log.Info().Msgf("Access pprof at: http://%s:%d/debug/pprof/", host, addr.Port)
 
-	err = http.Serve(ln, nil)
-	if err != nil {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	err = http.Serve(ln, mux)
+	if err != nil && !srv.draining.Load() {
 		log.Error().Err(err).Msgf("pprof server failed")
 	}
 }
 
+func (srv *RttyServer) config() *Config {
+	return srv.cfg.Load()
+}
+
 func (srv *RttyServer) GetDevice(group, id string) *Device {
 	srv.mu.RLock()
 	defer srv.mu.RUnlock()
@@ -121,3 +506,62 @@ func (srv *RttyServer) GetGroup(group string, create bool) *DeviceGroup {
 		return val.(*DeviceGroup)
 	}
 }
+
+// Groups returns the names of all groups which have devices online.
+// The default group "" is always included.
+func (srv *RttyServer) Groups() []string {
+	groups := []string{""}
+
+	srv.groups.Range(func(key, value any) bool {
+		if key != "" {
+			groups = append(groups, key.(string))
+		}
+		return true
+	})
+
+	return groups
+}
+
+// DeviceCount returns the number of devices online in all groups.
+func (srv *RttyServer) DeviceCount() int {
+	count := 0
+
+	srv.groups.Range(func(key, value any) bool {
+		count += int(value.(*DeviceGroup).count.Load())
+		return true
+	})
+
+	return count
+}
+
+// Devices returns the devices online in the group.
+func (srv *RttyServer) Devices(group string) []*Device {
+	devs := make([]*Device, 0)
+
+	g := srv.GetGroup(group, false)
+	if g == nil {
+		return devs
+	}
+
+	g.devices.Range(func(key, value any) bool {
+		devs = append(devs, value.(*Device))
+		return true
+	})
+
+	return devs
+}
+
+// RangeDevices calls f for each device online in all groups.
+// If f returns false, range stops the iteration.
+func (srv *RttyServer) RangeDevices(f func(dev *Device) bool) {
+	srv.groups.Range(func(key, value any) bool {
+		ok := true
+
+		value.(*DeviceGroup).devices.Range(func(key, value any) bool {
+			ok = f(value.(*Device))
+			return ok
+		})
+
+		return ok
+	})
+}
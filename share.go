@@ -0,0 +1,510 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	xlog "github.com/zhaojh329/rttys/v5/log"
+	"github.com/zhaojh329/rttys/v5/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ShareTypeTerm  = "term"
+	ShareTypeProxy = "proxy"
+)
+
+// Used if the expire of a share is not given
+const shareDefaultExpire = 3600
+
+// Messages queued for a watcher, which is dropped if it can't keep up
+const shareWatcherQueue = 256
+
+// Share lets guests watch a terminal session, or view the web UI of an
+// HTTP proxy session, read-only without signing in. For a proxy share,
+// read-only means GET and HEAD requests only. The link is signed
+// with a key generated on startup, so all links are invalid after a
+// restart. They are neither handed over on upgrade: the shares and the
+// sessions shared stay in the old process, while the new one gets the
+// requests.
+type Share struct {
+	id       string
+	typ      string
+	group    string
+	devid    string
+	session  string
+	username string
+	created  time.Time
+	expire   time.Time
+
+	// The web UI of a proxy share
+	destaddr string
+	dest     *httpProxyDest
+
+	// Canceled on revoke or expire, and with the shared terminal session
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	viewers atomic.Int32
+}
+
+type ShareInfo struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Group    string `json:"group"`
+	Devid    string `json:"devid"`
+	Session  string `json:"session"`
+	Dest     string `json:"dest,omitempty"`
+	Username string `json:"username"`
+	Created  int64  `json:"created"`
+	Expire   int64  `json:"expire"`
+	Viewers  int32  `json:"viewers"`
+	URL      string `json:"url"`
+}
+
+// shareWatcher relays the output of the shared terminal session to a
+// guest. The messages are queued to not block the device.
+type shareWatcher struct {
+	conn *websocket.Conn
+	msgs chan shareWatcherMsg
+}
+
+type shareWatcherMsg struct {
+	typ  int
+	data []byte
+}
+
+func (srv *RttyServer) shareSig(id string, exp int64) string {
+	mac := hmac.New(sha256.New, srv.shareKey)
+	fmt.Fprintf(mac, "%s:%d", id, exp)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Share) Info(srv *RttyServer) *ShareInfo {
+	exp := s.expire.Unix()
+
+	return &ShareInfo{
+		ID:       s.id,
+		Type:     s.typ,
+		Group:    s.group,
+		Devid:    s.devid,
+		Session:  s.session,
+		Dest:     s.destaddr,
+		Username: s.username,
+		Created:  s.created.Unix(),
+		Expire:   exp,
+		Viewers:  s.viewers.Load(),
+		URL:      fmt.Sprintf("/share/%s?exp=%d&sig=%s", s.id, exp, srv.shareSig(s.id, exp)),
+	}
+}
+
+func (s *Share) String() string {
+	return fmt.Sprintf("{type: %s, devid: %s, group: %s, session: %s, user: %s}",
+		s.typ, s.devid, s.group, s.session, s.username)
+}
+
+// addShare starts the share, which ends with the parent context
+func (srv *RttyServer) addShare(s *Share, parent context.Context) {
+	s.ctx, s.cancel = context.WithDeadline(parent, s.expire)
+
+	srv.shares.Store(s.id, s)
+
+	log.Info().Msgf("share '%s' created: %s", s.id, s)
+
+	go func() {
+		<-s.ctx.Done()
+
+		srv.shares.Delete(s.id)
+
+		for _, ses := range srv.HttpProxySessions() {
+			if ses.share == s.id {
+				ses.cancel()
+			}
+		}
+
+		log.Info().Msgf("share '%s' ended", s.id)
+	}()
+}
+
+// Shares returns all the shares
+func (srv *RttyServer) Shares() []*Share {
+	shares := make([]*Share, 0)
+
+	srv.shares.Range(func(key, value any) bool {
+		shares = append(shares, value.(*Share))
+		return true
+	})
+
+	return shares
+}
+
+// getShare returns the share of the link, nil if the signature is invalid
+// or the share is expired or revoked.
+func (srv *RttyServer) getShare(id, exp, sig string) *Share {
+	v, ok := srv.shares.Load(id)
+	if !ok {
+		return nil
+	}
+
+	s := v.(*Share)
+
+	n, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || n != s.expire.Unix() || time.Now().Unix() >= n {
+		return nil
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(srv.shareSig(id, n))) {
+		return nil
+	}
+
+	return s
+}
+
+func (a *APIServer) handleShareCreate(c *gin.Context) {
+	type request struct {
+		Type    string `json:"type"`
+		Group   string `json:"group"`
+		Devid   string `json:"devid"`
+		Session string `json:"session"`
+		Expire  int    `json:"expire"`
+	}
+
+	req := request{}
+
+	if err := c.BindJSON(&req); err != nil || req.Session == "" || req.Expire < 0 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	srv := a.srv
+	cfg := srv.config()
+
+	if cfg.Share.MaxExpire == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"err": "sharing is disabled"})
+		return
+	}
+
+	if req.Expire == 0 {
+		req.Expire = shareDefaultExpire
+	}
+
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	s := &Share{
+		id:       utils.GenUniqueID(),
+		typ:      req.Type,
+		session:  req.Session,
+		username: username,
+		created:  time.Now(),
+	}
+
+	s.expire = s.created.Add(time.Duration(min(req.Expire, cfg.Share.MaxExpire)) * time.Second)
+
+	parent := srv.ctx
+
+	switch req.Type {
+	case ShareTypeTerm:
+		var user *User
+
+		if dev := srv.GetDevice(req.Group, req.Devid); dev != nil {
+			if v, ok := dev.users.Load(req.Session); ok {
+				user = v.(*User)
+			}
+		}
+
+		if user == nil || user.bcast != nil || (!admin && user.username != username) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		s.group = user.dev.group
+		s.devid = user.dev.id
+		parent = user.ctx
+
+	case ShareTypeProxy:
+		ses := srv.getHttpProxySession(req.Session)
+		if ses == nil || ses.readOnly || (!admin && ses.username != username) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		s.group = ses.group
+		s.devid = ses.devid
+		s.destaddr = ses.destaddr
+		s.dest = ses.dest
+
+	default:
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	srv.addShare(s, parent)
+
+	c.JSON(http.StatusOK, s.Info(srv))
+}
+
+// handleShares lists the shares, all for admins and the own shares for
+// the others.
+func (a *APIServer) handleShares(c *gin.Context) {
+	admin := a.isAdmin(c)
+	username := a.sessionUser(c)
+
+	infos := make([]*ShareInfo, 0)
+
+	for _, s := range a.srv.Shares() {
+		if admin || s.username == username {
+			infos = append(infos, s.Info(a.srv))
+		}
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handleShareRevoke(c *gin.Context) {
+	v, ok := a.srv.shares.Load(c.Param("id"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	s := v.(*Share)
+
+	if !a.isAdmin(c) && s.username != a.sessionUser(c) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	log.Info().Msgf("share '%s' revoked", s.id)
+	s.cancel()
+
+	c.Status(http.StatusOK)
+}
+
+// handleShare serves the link of a share to guests
+func (a *APIServer) handleShare(c *gin.Context) {
+	srv := a.srv
+	websocketReq := c.GetHeader("Upgrade") == "websocket"
+
+	s := srv.getShare(c.Param("id"), c.Query("exp"), c.Query("sig"))
+	if s == nil {
+		if websocketReq {
+			c.Status(http.StatusNotFound)
+		} else {
+			c.Redirect(http.StatusFound, "/error/share")
+		}
+		return
+	}
+
+	if s.typ == ShareTypeTerm {
+		if websocketReq {
+			srv.watchShare(s, c)
+		} else {
+			c.Redirect(http.StatusFound, "/shared/"+s.id+"?"+c.Request.URL.RawQuery)
+		}
+		return
+	}
+
+	dev := srv.GetDevice(s.group, s.devid)
+	if dev == nil {
+		c.Redirect(http.StatusFound, "/error/offline")
+		return
+	}
+
+	// A browser coming back keeps its session
+	cookieName := "rtty-share-sid"
+	cookiePath := "/share/" + s.id
+
+	if sid, err := c.Cookie(cookieName); err == nil {
+		if v, ok := srv.httpProxySessions.Load(sid); ok {
+			ses := v.(*HttpProxySession)
+			if ses.share == s.id && ses.ctx.Err() == nil && ses.allowed(srv, c.Request.RemoteAddr) {
+				ses.Expire()
+				httpProxyRedirectSession(srv, c, sid, s.devid, &url.URL{Path: "/"})
+				return
+			}
+		}
+	}
+
+	if !s.addViewer(srv.config().Share.MaxViewers) {
+		log.Warn().Msgf("share '%s' has too many viewers, %s denied", s.id, c.ClientIP())
+		c.Redirect(http.StatusFound, "/error/shareFull")
+		return
+	}
+
+	sid, ses := srv.newHttpProxySession(dev, s.destaddr, s.dest, c.Request.RemoteAddr, s.username, "", s)
+
+	go func() {
+		<-ses.ctx.Done()
+		s.viewers.Add(-1)
+	}()
+
+	log.Info().Msgf(`new httpProxySession "%s" of share '%s' from %s`, sid, s.id, c.ClientIP())
+
+	c.SetCookie(cookieName, sid, 0, cookiePath, "", false, true)
+
+	httpProxyRedirectSession(srv, c, sid, s.devid, &url.URL{Path: "/"})
+}
+
+// addViewer counts a new viewer of the share, unless it has max viewers
+// already, 0 for unlimited.
+func (s *Share) addViewer(max int) bool {
+	for {
+		n := s.viewers.Load()
+		if max > 0 && n >= int32(max) {
+			return false
+		}
+
+		if s.viewers.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// watchShare relays the output of the shared terminal session to the
+// guest, whose messages are all dropped.
+func (srv *RttyServer) watchShare(s *Share, c *gin.Context) {
+	defer xlog.LogPanic()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade to websocket failed")
+		return
+	}
+	defer conn.Close()
+
+	var user *User
+
+	if dev := srv.GetDevice(s.group, s.devid); dev != nil {
+		if v, ok := dev.users.Load(s.session); ok {
+			user = v.(*User)
+		}
+	}
+
+	w := &shareWatcher{conn: conn, msgs: make(chan shareWatcherMsg, shareWatcherQueue)}
+
+	if !s.addViewer(srv.config().Share.MaxViewers) {
+		log.Warn().Msgf("share '%s' has too many viewers, %s denied", s.id, c.ClientIP())
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(LoginErrorLimit, "too many viewers"), time.Now().Add(time.Second))
+		return
+	}
+	defer s.viewers.Add(-1)
+
+	if user == nil || !user.addWatcher(w) {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(LoginErrorOffline, "session closed"), time.Now().Add(time.Second))
+		return
+	}
+
+	log.Info().Msgf("share '%s' watched from %s", s.id, c.ClientIP())
+
+	go w.writeLoop()
+
+	stop := context.AfterFunc(s.ctx, func() {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "share ended"), time.Now().Add(time.Second))
+		conn.Close()
+	})
+	defer stop()
+
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+
+	user.removeWatcher(w)
+
+	log.Info().Msgf("share '%s' watcher from %s left", s.id, c.ClientIP())
+}
+
+func (w *shareWatcher) writeLoop() {
+	for msg := range w.msgs {
+		if err := w.conn.WriteMessage(msg.typ, msg.data); err != nil {
+			w.conn.Close()
+		}
+	}
+}
+
+// send queues the message, or drops the watcher if it's too slow
+func (w *shareWatcher) send(typ int, data []byte) {
+	select {
+	case w.msgs <- shareWatcherMsg{typ, data}:
+	default:
+		w.conn.Close()
+	}
+}
+
+// addWatcher sends the state of the terminal to the watcher, and then
+// the output. It returns false if the session is closed.
+func (user *User) addWatcher(w *shareWatcher) bool {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.closed.Load() {
+		return false
+	}
+
+	w.send(websocket.TextMessage, []byte(`{"type":"login"}`))
+
+	if user.cols > 0 && user.rows > 0 {
+		w.send(websocket.TextMessage, fmt.Appendf(nil, `{"type":"winsize","cols":%d,"rows":%d}`, user.cols, user.rows))
+	}
+
+	if user.scrollback != nil {
+		w.send(websocket.BinaryMessage, append([]byte{0}, user.scrollback.Bytes()...))
+	}
+
+	if user.watchers == nil {
+		user.watchers = make(map[*shareWatcher]struct{})
+	}
+
+	user.watchers[w] = struct{}{}
+
+	return true
+}
+
+func (user *User) removeWatcher(w *shareWatcher) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	delete(user.watchers, w)
+	close(w.msgs)
+}
+
+// notifyWatchers sends the message to the watchers, user.mu is held
+func (user *User) notifyWatchers(typ int, data []byte) {
+	if len(user.watchers) == 0 {
+		return
+	}
+
+	data = append([]byte(nil), data...)
+
+	for w := range user.watchers {
+		w.send(typ, data)
+	}
+}
+
+func newShareKey() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}
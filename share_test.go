@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareSig(t *testing.T) {
+	srv := &RttyServer{shareKey: newShareKey()}
+	other := &RttyServer{shareKey: newShareKey()}
+
+	sig := srv.shareSig("s1", 1000)
+
+	if len(sig) != 64 {
+		t.Errorf("signature %q, want 64 hex digits", sig)
+	}
+
+	if srv.shareSig("s1", 1000) != sig {
+		t.Error("signature not stable")
+	}
+
+	tests := []struct {
+		name string
+		sig  string
+	}{
+		{"other id", srv.shareSig("s2", 1000)},
+		{"other expire", srv.shareSig("s1", 1001)},
+		{"other key", other.shareSig("s1", 1000)},
+	}
+
+	for _, tt := range tests {
+		if tt.sig == sig {
+			t.Errorf("%s: same signature", tt.name)
+		}
+	}
+}
+
+func TestGetShare(t *testing.T) {
+	srv := &RttyServer{shareKey: newShareKey()}
+	other := &RttyServer{shareKey: newShareKey()}
+
+	s := &Share{id: "s1", expire: time.Now().Add(time.Hour).Truncate(time.Second)}
+	srv.shares.Store(s.id, s)
+
+	expired := &Share{id: "s2", expire: time.Now().Add(-time.Second).Truncate(time.Second)}
+	srv.shares.Store(expired.id, expired)
+
+	exp := s.expire.Unix()
+	sig := srv.shareSig(s.id, exp)
+
+	tests := []struct {
+		name string
+		id   string
+		exp  string
+		sig  string
+		want *Share
+	}{
+		{"valid", "s1", strconv.FormatInt(exp, 10), sig, s},
+		{"unknown", "s3", strconv.FormatInt(exp, 10), srv.shareSig("s3", exp), nil},
+		{"no expire", "s1", "", sig, nil},
+		{"bad expire", "s1", "soon", sig, nil},
+		{"other expire", "s1", strconv.FormatInt(exp+1, 10), srv.shareSig(s.id, exp+1), nil},
+		{"no signature", "s1", strconv.FormatInt(exp, 10), "", nil},
+		{"bad signature", "s1", strconv.FormatInt(exp, 10), strings.ToUpper(sig), nil},
+		{"other key", "s1", strconv.FormatInt(exp, 10), other.shareSig(s.id, exp), nil},
+		{"other id", "s1", strconv.FormatInt(exp, 10), srv.shareSig("s2", exp), nil},
+		{"expired", "s2", strconv.FormatInt(expired.expire.Unix(), 10),
+			srv.shareSig("s2", expired.expire.Unix()), nil},
+	}
+
+	for _, tt := range tests {
+		if got := srv.getShare(tt.id, tt.exp, tt.sig); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// The link given to the user is valid
+	u, err := url.Parse(s.Info(srv).URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := srv.getShare(strings.TrimPrefix(u.Path, "/share/"), u.Query().Get("exp"), u.Query().Get("sig")); got != s {
+		t.Errorf("link %s: share not found", u)
+	}
+
+	// Revoked
+	srv.shares.Delete(s.id)
+
+	if srv.getShare(s.id, strconv.FormatInt(exp, 10), sig) != nil {
+		t.Error("revoked: share found")
+	}
+}
+
+func TestShareAddViewer(t *testing.T) {
+	tests := []struct {
+		max  int
+		want int32
+	}{
+		{0, 5},
+		{1, 1},
+		{3, 3},
+	}
+
+	for _, tt := range tests {
+		s := &Share{}
+
+		for range 5 {
+			s.addViewer(tt.max)
+		}
+
+		if n := s.viewers.Load(); n != tt.want {
+			t.Errorf("max %d: %d viewers, want %d", tt.max, n, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"errors"
+	"fmt"
+)
+
+var errTermLimit = errors.New("too many sessions")
+
+// termCounter counts the terminal sessions to enforce the limits
+type termCounter struct {
+	total   int
+	owners  map[string]int
+	devices map[*Device]int
+	pending map[*Device]int
+}
+
+// termSlot is a terminal session counted for the limits, of a user or
+// of a file transfer. Guarded by srv.termsMu.
+type termSlot struct {
+	dev       *Device
+	owner     string
+	counted   bool
+	loggingIn bool
+}
+
+// acquireTerm counts the new session of the owner to the device, which
+// is pending until the device logins, or returns errTermLimit if any
+// limit is reached.
+func (srv *RttyServer) acquireTerm(slot *termSlot, dev *Device, owner string) error {
+	cfg := srv.config()
+
+	srv.termsMu.Lock()
+	defer srv.termsMu.Unlock()
+
+	terms := &srv.terms
+
+	if terms.owners == nil {
+		terms.owners = make(map[string]int)
+		terms.devices = make(map[*Device]int)
+		terms.pending = make(map[*Device]int)
+	}
+
+	switch {
+	case cfg.Term.MaxSessions > 0 && terms.total >= cfg.Term.MaxSessions:
+		return fmt.Errorf("%w on the server", errTermLimit)
+	case cfg.Term.MaxPerDevice > 0 && terms.devices[dev] >= cfg.Term.MaxPerDevice:
+		return fmt.Errorf("%w to the device", errTermLimit)
+	case cfg.Term.MaxPerUser > 0 && terms.owners[owner] >= cfg.Term.MaxPerUser:
+		return fmt.Errorf("%w of the user", errTermLimit)
+	case cfg.Term.MaxPending > 0 && terms.pending[dev] >= cfg.Term.MaxPending:
+		return fmt.Errorf("%w waiting for the device", errTermLimit)
+	}
+
+	terms.total++
+	terms.owners[owner]++
+	terms.devices[dev]++
+	terms.pending[dev]++
+
+	*slot = termSlot{dev: dev, owner: owner, counted: true, loggingIn: true}
+
+	return nil
+}
+
+// termLoggedIn stops counting the session as pending
+func (srv *RttyServer) termLoggedIn(slot *termSlot) {
+	srv.termsMu.Lock()
+	defer srv.termsMu.Unlock()
+
+	if slot.loggingIn {
+		slot.loggingIn = false
+		decCount(srv.terms.pending, slot.dev)
+	}
+}
+
+// releaseTerm stops counting the closed session
+func (srv *RttyServer) releaseTerm(slot *termSlot) {
+	srv.termsMu.Lock()
+	defer srv.termsMu.Unlock()
+
+	if !slot.counted {
+		return
+	}
+
+	terms := &srv.terms
+
+	if slot.loggingIn {
+		decCount(terms.pending, slot.dev)
+	}
+
+	terms.total--
+	decCount(terms.owners, slot.owner)
+	decCount(terms.devices, slot.dev)
+
+	slot.counted = false
+	slot.loggingIn = false
+}
+
+func decCount[K comparable](m map[K]int, key K) {
+	if m[key] <= 1 {
+		delete(m, key)
+	} else {
+		m[key]--
+	}
+}
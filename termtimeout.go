@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// termLimits returns the limits of the sessions of a user with the role
+// to the devices in the group.
+func (srv *RttyServer) termLimits(group string, admin bool) TermLimits {
+	cfg := srv.config()
+
+	role := TermRoleUser
+	if admin {
+		role = TermRoleAdmin
+	}
+
+	g, gok := cfg.Term.Groups[group]
+	r, rok := cfg.Term.Roles[role]
+
+	switch {
+	case gok && rok:
+		return TermLimits{
+			IdleTimeout: shorterTimeout(g.IdleTimeout, r.IdleTimeout),
+			Lifetime:    shorterTimeout(g.Lifetime, r.Lifetime),
+		}
+	case gok:
+		return g
+	case rok:
+		return r
+	}
+
+	return TermLimits{IdleTimeout: cfg.Term.IdleTimeout, Lifetime: cfg.Term.Lifetime}
+}
+
+// shorterTimeout returns the shorter of two timeouts, where 0 is unlimited
+func shorterTimeout(a, b int) int {
+	if a == 0 || b == 0 {
+		return max(a, b)
+	}
+	return min(a, b)
+}
+
+// watchTimeouts closes the session once idle for too long or at the end
+// of its lifetime, after warning the user. The limits are read again on
+// each check to follow a reloaded config.
+func (user *User) watchTimeouts() {
+	var warned time.Time
+
+	for {
+		cfg := user.srv.config()
+		limits := user.srv.termLimits(user.dev.group, user.admin)
+		warning := time.Duration(cfg.Term.Warning) * time.Second
+
+		var deadline time.Time
+		var reason string
+
+		if limits.IdleTimeout > 0 {
+			deadline = time.Unix(0, user.lastInput.Load()).Add(time.Duration(limits.IdleTimeout) * time.Second)
+			reason = "idle"
+		}
+
+		if limits.Lifetime > 0 {
+			end := user.created.Add(time.Duration(limits.Lifetime) * time.Second)
+			if deadline.IsZero() || end.Before(deadline) {
+				deadline = end
+				reason = "lifetime"
+			}
+		}
+
+		now := time.Now()
+		wait := time.Minute
+
+		if !deadline.IsZero() {
+			if !now.Before(deadline) {
+				log.Info().Msgf("close session '%s' of device '%s' for %s timeout", user.sid, user.dev.id, reason)
+				user.SendCloseMsg(SessionErrorExpired, reason+" timeout")
+				user.Close()
+				return
+			}
+
+			if warn := deadline.Add(-warning); warn.After(now) {
+				wait = min(wait, warn.Sub(now))
+			} else {
+				if !deadline.Equal(warned) {
+					warned = deadline
+					user.WriteMsg(websocket.TextMessage, fmt.Appendf(nil,
+						`{"type":"closeWarning","reason":"%s","seconds":%d}`, reason, int(deadline.Sub(now).Round(time.Second).Seconds())))
+				}
+				wait = min(wait, deadline.Sub(now))
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-user.ctx.Done():
+			return
+		}
+	}
+}
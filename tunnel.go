@@ -0,0 +1,559 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	xlog "github.com/zhaojh329/rttys/v5/log"
+	"github.com/zhaojh329/rttys/v5/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// Tunnel forwards the TCP connections accepted on a local listener
+// to a destination behind a device. Only the connections from the
+// client IP which opened the tunnel are accepted. A websocket tunnel has
+// no listener, and forwards the single stream of its websocket.
+type Tunnel struct {
+	id       string
+	devid    string
+	group    string
+	dest     *httpProxyDest
+	destaddr string
+	owner    string
+	clientIP string
+	created  time.Time
+	ln       net.Listener // nil for a websocket tunnel
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	conns      atomic.Int32
+	lastActive atomic.Int64
+	rx         atomic.Uint64
+	tx         atomic.Uint64
+	limiter    *rateLimiter
+}
+
+type TunnelInfo struct {
+	ID        string `json:"id"`
+	Devid     string `json:"devid"`
+	Group     string `json:"group"`
+	Dest      string `json:"dest"`
+	Addr      string `json:"addr"`
+	Websocket bool   `json:"websocket"`
+	Owner     string `json:"owner"`
+	ClientIP  string `json:"clientIP"`
+	Created   int64  `json:"created"`
+	Conns     int32  `json:"conns"`
+	Rx        uint64 `json:"rx"`
+	Tx        uint64 `json:"tx"`
+}
+
+var errTunnelLimit = errors.New("too many tunnels")
+
+// The tunnel listeners bind to the loopback unless configured otherwise
+const defaultTunnelListenHost = "127.0.0.1"
+
+func (t *Tunnel) Info() *TunnelInfo {
+	return &TunnelInfo{
+		ID:        t.id,
+		Devid:     t.devid,
+		Group:     t.group,
+		Dest:      t.destaddr,
+		Addr:      t.addr(),
+		Websocket: t.ln == nil,
+		Owner:     t.owner,
+		ClientIP:  t.clientIP,
+		Created:   t.created.Unix(),
+		Conns:     t.conns.Load(),
+		Rx:        t.rx.Load(),
+		Tx:        t.tx.Load(),
+	}
+}
+
+// addr returns the listen address, empty for a websocket tunnel
+func (t *Tunnel) addr() string {
+	if t.ln == nil {
+		return ""
+	}
+	return t.ln.Addr().String()
+}
+
+// Close closes the listener and all connections of the tunnel.
+func (t *Tunnel) Close() {
+	t.cancel()
+}
+
+func (t *Tunnel) active() {
+	t.lastActive.Store(time.Now().Unix())
+}
+
+// OpenTunnel listens on port (any if 0) and forwards the connections
+// accepted from clientIP to addr behind the device. The tunnel is closed
+// when the device disconnects or there's no traffic for the idle timeout.
+func (srv *RttyServer) OpenTunnel(dev *Device, addr string, port int, owner, clientIP string) (*Tunnel, error) {
+	cfg := srv.config()
+
+	dest, err := parseTunnelDest(dev, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.tunnelsMu.Lock()
+	defer srv.tunnelsMu.Unlock()
+
+	if max := cfg.Tunnel.MaxPerUser; max > 0 && len(srv.userTunnels(owner)) >= max {
+		return nil, errTunnelLimit
+	}
+
+	host := cfg.Tunnel.ListenHost
+	if host == "" {
+		host = defaultTunnelListenHost
+	}
+
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+
+	t := srv.addTunnel(dev, dest, addr, owner, clientIP, ln)
+
+	go srv.serveTunnel(dev, t)
+
+	log.Info().Msgf("tunnel '%s' opened by '%s': %s -> device '%s' %s", t.id, owner, ln.Addr(), t.devid, t.destaddr)
+
+	return t, nil
+}
+
+// addTunnel registers the tunnel, which is removed once closed. The
+// caller holds tunnelsMu and has checked the limit of the owner.
+func (srv *RttyServer) addTunnel(dev *Device, dest *httpProxyDest, addr, owner, clientIP string, ln net.Listener) *Tunnel {
+	ctx, cancel := context.WithCancel(dev.ctx)
+
+	t := &Tunnel{
+		id:       utils.GenUniqueID(),
+		devid:    dev.id,
+		group:    dev.group,
+		dest:     dest,
+		destaddr: addr,
+		owner:    owner,
+		clientIP: clientIP,
+		created:  time.Now(),
+		ln:       ln,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	t.limiter = newRateLimiter(func() int { return srv.rateLimits(t.group).Tunnel })
+	t.active()
+
+	srv.tunnels.Store(t.id, t)
+
+	go func() {
+		<-ctx.Done()
+		if ln != nil {
+			ln.Close()
+		}
+		srv.tunnels.Delete(t.id)
+		log.Info().Msgf("tunnel '%s' closed: %s -> device '%s' %s", t.id, t.addr(), t.devid, t.destaddr)
+	}()
+
+	go t.idleCheck(srv)
+
+	return t
+}
+
+func parseTunnelDest(dev *Device, addr string) (*httpProxyDest, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, errors.New("port is required in addr")
+	}
+
+	dest, err := parseHttpProxyDest(addr, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := dest.encode(dev.caps); err != nil {
+		return nil, err
+	}
+
+	return dest, nil
+}
+
+// Tunnels returns all opened tunnels.
+func (srv *RttyServer) Tunnels() []*Tunnel {
+	tunnels := make([]*Tunnel, 0)
+
+	srv.tunnels.Range(func(key, value any) bool {
+		tunnels = append(tunnels, value.(*Tunnel))
+		return true
+	})
+
+	return tunnels
+}
+
+func (srv *RttyServer) userTunnels(owner string) []*Tunnel {
+	tunnels := make([]*Tunnel, 0)
+
+	for _, t := range srv.Tunnels() {
+		if t.owner == owner {
+			tunnels = append(tunnels, t)
+		}
+	}
+
+	return tunnels
+}
+
+func (srv *RttyServer) GetTunnel(id string) *Tunnel {
+	if t, ok := srv.tunnels.Load(id); ok {
+		return t.(*Tunnel)
+	}
+	return nil
+}
+
+func (srv *RttyServer) serveTunnel(dev *Device, t *Tunnel) {
+	defer xlog.LogPanic()
+
+	for {
+		c, err := t.ln.Accept()
+		if err != nil {
+			// Closed for handover, the connections are still served
+			if !srv.draining.Load() {
+				t.cancel()
+			}
+			return
+		}
+
+		go srv.doTunnel(dev, t, c)
+	}
+}
+
+// closeTunnelListeners stops accepting new tunnel connections, keeping
+// the existing ones
+func (srv *RttyServer) closeTunnelListeners() {
+	for _, t := range srv.Tunnels() {
+		if t.ln != nil {
+			t.ln.Close()
+		}
+	}
+}
+
+func (srv *RttyServer) doTunnel(dev *Device, t *Tunnel, c net.Conn) {
+	defer xlog.LogPanic()
+	defer c.Close()
+
+	if !ipAllowed(srv.config().User.AllowedCIDRs, c.RemoteAddr()) {
+		log.Debug().Msgf("tunnel conn from %s not allowed", c.RemoteAddr())
+		return
+	}
+
+	if remoteIP(c.RemoteAddr().String()) != t.clientIP {
+		log.Warn().Msgf("tunnel '%s' of %s used from %s", t.id, t.clientIP, c.RemoteAddr())
+		return
+	}
+
+	devConn, err := dev.dial(srv, t.dest, c.RemoteAddr().String())
+	if err != nil {
+		log.Error().Msgf("tunnel '%s' dial %s fail: %v", t.id, t.destaddr, err)
+		return
+	}
+	defer devConn.Close()
+
+	log.Debug().Msgf("new tunnel conn %s -> device '%s' %s", c.RemoteAddr(), t.devid, t.destaddr)
+
+	t.pipe(c, devConn)
+
+	log.Debug().Msgf("tunnel conn %s closed", c.RemoteAddr())
+}
+
+// pipe relays a client connection of the tunnel to the device
+func (t *Tunnel) pipe(client io.ReadWriteCloser, devConn net.Conn) {
+	t.conns.Add(1)
+	defer t.conns.Add(-1)
+
+	t.active()
+
+	pipeConns(t.ctx, client, devConn, func(n int) {
+		t.tx.Add(uint64(n))
+		t.active()
+		t.limiter.wait(t.ctx, n)
+	}, func(n int) {
+		// Not limited: the device sends without flow control, so
+		// delaying the data here would not spare its uplink
+		t.rx.Add(uint64(n))
+		t.active()
+	})
+}
+
+// pipeConns copies data between client and device until one side is
+// closed or ctx is done. tx and rx are called with the number of bytes
+// sent to and received from the device.
+func pipeConns(ctx context.Context, client io.ReadWriteCloser, dev io.ReadWriteCloser, tx, rx func(n int)) {
+	var wg sync.WaitGroup
+
+	copyConn := func(dst io.WriteCloser, src io.Reader, count func(n int)) {
+		defer wg.Done()
+		defer dst.Close()
+
+		hb := httpBufPool.Get().(*HttpBuf)
+		defer httpBufPool.Put(hb)
+
+		for {
+			n, err := src.Read(hb.buf)
+			if n > 0 {
+				if _, err := dst.Write(hb.buf[:n]); err != nil {
+					return
+				}
+				count(n)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	wg.Add(2)
+
+	go copyConn(dev, client, tx)
+	go copyConn(client, dev, rx)
+
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			client.Close()
+			dev.Close()
+		case <-done:
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+}
+
+func (t *Tunnel) idleCheck(srv *RttyServer) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		idle := srv.config().Tunnel.IdleTimeout
+		if idle == 0 {
+			continue
+		}
+
+		if time.Now().Unix()-t.lastActive.Load() > int64(idle) {
+			log.Info().Msgf("tunnel '%s' idle for %ds", t.id, idle)
+			t.cancel()
+			return
+		}
+	}
+}
+
+func (a *APIServer) handleTunnelOpen(c *gin.Context) {
+	type request struct {
+		Addr string `json:"addr"`
+		Port int    `json:"port"`
+	}
+
+	req := request{}
+
+	err := c.BindJSON(&req)
+	if err != nil || req.Addr == "" || req.Port < 0 || req.Port > 65535 {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	if !a.callUserHookUrl(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	dev := a.srv.GetDevice(c.Query("group"), c.Param("devid"))
+	if dev == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	t, err := a.srv.OpenTunnel(dev, req.Addr, req.Port, a.sessionOwner(c), remoteIP(c.Request.RemoteAddr))
+	if err != nil {
+		status := http.StatusBadRequest
+		if err == errTunnelLimit {
+			status = http.StatusTooManyRequests
+		}
+		c.JSON(status, gin.H{"err": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, t.Info())
+}
+
+func (a *APIServer) handleTunnels(c *gin.Context) {
+	infos := make([]*TunnelInfo, 0)
+
+	for _, t := range a.srv.userTunnels(a.sessionOwner(c)) {
+		if tokenGroupAllowed(c, t.group) {
+			infos = append(infos, t.Info())
+		}
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+func (a *APIServer) handleTunnelClose(c *gin.Context) {
+	t := a.srv.GetTunnel(c.Param("id"))
+	if t == nil || t.owner != a.sessionOwner(c) || !tokenGroupAllowed(c, t.group) {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	t.Close()
+
+	c.Status(http.StatusOK)
+}
+
+// handleTunnelWs bridges the binary messages of the websocket to a TCP
+// stream to addr behind the device, e.g. for ssh ProxyCommand. The group
+// is "-" for devices without group.
+func (a *APIServer) handleTunnelWs(c *gin.Context) {
+	defer xlog.LogPanic()
+
+	group := c.Param("group")
+	if group == "-" {
+		group = ""
+	}
+
+	devid := c.Param("devid")
+	addr := c.Param("addr")
+
+	if !a.callUserHookUrl(c) {
+		c.Status(http.StatusForbidden)
+		return
+	}
+
+	dev := a.srv.GetDevice(group, devid)
+	if dev == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	dest, err := parseTunnelDest(dev, addr)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+
+	srv := a.srv
+	owner := a.sessionOwner(c)
+
+	srv.tunnelsMu.Lock()
+
+	if max := srv.config().Tunnel.MaxPerUser; max > 0 && len(srv.userTunnels(owner)) >= max {
+		srv.tunnelsMu.Unlock()
+		c.JSON(http.StatusTooManyRequests, gin.H{"err": errTunnelLimit.Error()})
+		return
+	}
+
+	t := srv.addTunnel(dev, dest, addr, owner, remoteIP(c.Request.RemoteAddr), nil)
+
+	srv.tunnelsMu.Unlock()
+
+	// The tunnel lives as long as its websocket
+	defer t.Close()
+
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("upgrade to websocket failed")
+		return
+	}
+	defer conn.Close()
+
+	devConn, err := dev.dial(srv, dest, c.Request.RemoteAddr)
+	if err != nil {
+		log.Error().Msgf("tunnel dial %s fail: %v", addr, err)
+		return
+	}
+	defer devConn.Close()
+
+	log.Info().Msgf("websocket tunnel '%s' opened by '%s': %s -> device '%s' %s",
+		t.id, owner, c.Request.RemoteAddr, devid, addr)
+
+	t.pipe(&wsStream{conn: conn}, devConn)
+}
+
+// wsStream reads and writes a websocket connection as a byte stream
+// of binary messages.
+type wsStream struct {
+	conn *websocket.Conn
+	r    io.Reader
+	wmu  sync.Mutex
+}
+
+func (s *wsStream) Read(b []byte) (int, error) {
+	for {
+		if s.r == nil {
+			typ, r, err := s.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+
+			s.r = r
+		}
+
+		n, err := s.r.Read(b)
+		if err == io.EOF {
+			s.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (s *wsStream) Write(b []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (s *wsStream) Close() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+
+	return s.conn.Close()
+}
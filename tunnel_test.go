@@ -0,0 +1,98 @@
+/* SPDX-License-Identifier: MIT */
+/*
+ * Author: Jianhui Zhao <zhaojh329@gmail.com>
+ */
+
+package rttys
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zhaojh329/rtty-go/proto"
+)
+
+// newTestDevice returns a device whose messages are written to the
+// returned connection
+func newTestDevice(t *testing.T, id string, devProto uint8) (*Device, net.Conn) {
+	conn, peer := net.Pipe()
+
+	dev := &Device{
+		id:    id,
+		proto: devProto,
+		conn:  conn,
+		msg:   proto.NewMsgReaderWriter(proto.RoleRttys, conn),
+	}
+	dev.ctx, dev.cancel = context.WithCancel(context.Background())
+
+	t.Cleanup(func() {
+		dev.cancel()
+		conn.Close()
+		peer.Close()
+	})
+
+	return dev, peer
+}
+
+func countDeviceConns(dev *Device) int {
+	n := 0
+	dev.https.Range(func(key, value any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func TestTunnelClientIP(t *testing.T) {
+	srv := &RttyServer{}
+	srv.cfg.Store(&Config{})
+
+	dev, peer := newTestDevice(t, "dev1", 4)
+	go io.Copy(io.Discard, peer)
+
+	tun, err := srv.OpenTunnel(dev, "192.168.1.1:22", 0, "alice", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+
+	// Another client is disconnected, without reaching the device
+	d := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+
+	other, err := d.Dial("tcp", tun.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	other.SetReadDeadline(time.Now().Add(time.Second))
+
+	if _, err := other.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("other client: read %v, want EOF", err)
+	}
+
+	if n := countDeviceConns(dev); n != 0 {
+		t.Errorf("other client: %d device connections", n)
+	}
+
+	// The client which opened it is relayed to the device
+	c, err := net.Dial("tcp", tun.addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; tun.conns.Load() != 1; i++ {
+		if i == 100 {
+			t.Fatal("client not relayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := countDeviceConns(dev); n != 1 {
+		t.Errorf("client: %d device connections, want 1", n)
+	}
+}
@@ -10,6 +10,7 @@ import Login from '../views/Login.vue'
 import Home from '../views/Home.vue'
 import Rtty from '../views/Rtty.vue'
 import Error from '../views/Error.vue'
+import SharedTerm from '../views/SharedTerm.vue'
 
 const routes = [
   {
@@ -32,7 +33,15 @@ const routes = [
     path: '/error/:err',
     name: 'Error',
     component: Error,
-    props: true
+    props: true,
+    meta: { guest: true }
+  },
+  {
+    path: '/shared/:id',
+    name: 'SharedTerm',
+    component: SharedTerm,
+    props: true,
+    meta: { guest: true }
   }
 ]
 
@@ -42,7 +51,8 @@ const router = createRouter({
 })
 
 router.beforeEach((to, from, next) => {
-  if (to.path !== '/login') {
+  // Guests of share links don't sign in
+  if (to.path !== '/login' && !to.meta.guest) {
     axios.get('/alive').then(() => {
       next()
     }).catch(() => {
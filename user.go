@@ -3,16 +3,18 @@
  * Author: Jianhui Zhao <zhaojh329@gmail.com>
  */
 
-package main
+package rttys
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/zhaojh329/rtty-go/proto"
+	xlog "github.com/zhaojh329/rttys/v5/log"
 	"github.com/zhaojh329/rttys/v5/utils"
 
 	"github.com/gin-gonic/gin"
@@ -22,12 +24,59 @@ import (
 )
 
 type User struct {
-	conn    *websocket.Conn
-	sid     string
-	dev     *Device
-	pending chan bool
-	close   sync.Once
-	closed  atomic.Bool
+	srv      *RttyServer
+	sid      string
+	username string
+	owner    string
+	admin    bool
+	created  time.Time
+	dev      *Device
+	pending  chan bool
+	close    sync.Once
+	closed   atomic.Bool
+	limiter  *rateLimiter
+	file     fileRelay
+	cmd      cmdLine
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// Secret to reattach the session, empty if not detachable
+	token string
+
+	// The broadcast the session is a target of, which relays the messages
+	// instead of conn
+	bcast *broadcast
+
+	// Unix nanoseconds of the last input from the user
+	lastInput atomic.Int64
+
+	// Messages are written by both the device and the user goroutines
+	mu sync.Mutex
+
+	// The websocket, nil while detached
+	conn *websocket.Conn
+
+	// Recent output replayed on reattach
+	scrollback *ringBuffer
+
+	// Nil if not recorded
+	rec *recording
+
+	// Bytes sent to the user, of which the device waits for the ack
+	unacked int
+
+	// File data sent to the user since the last file ack
+	fileUnacked atomic.Int64
+
+	detachTimer *time.Timer
+
+	// Guests watching the session by share links, and the terminal size
+	// told to them
+	watchers   map[*shareWatcher]struct{}
+	cols, rows uint16
+
+	// Counted for the session limits
+	term termSlot
 }
 
 type UserMsg struct {
@@ -37,20 +86,27 @@ type UserMsg struct {
 	Ack  uint16 `json:"ack"`
 	Size uint32 `json:"size"`
 	Name string `json:"name"`
+	Ok   bool   `json:"ok"`
 }
 
 const (
 	LoginErrorOffline = 4000
 	LoginErrorBusy    = 4001
 	LoginErrorTimeout = 4002
+
+	// The session is closed for being idle or reaching its lifetime
+	SessionErrorExpired = 4003
+
+	// Too many sessions to the device, of the user or of the server
+	LoginErrorLimit = 4004
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
-func handleUserConnection(srv *RttyServer, c *gin.Context) {
-	defer logPanic()
+func handleUserConnection(srv *RttyServer, c *gin.Context, username, owner string, admin bool) {
+	defer xlog.LogPanic()
 
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
@@ -65,7 +121,7 @@ func handleUserConnection(srv *RttyServer, c *gin.Context) {
 		return
 	}
 
-	user := &User{conn: conn}
+	user := &User{srv: srv, conn: conn, username: username, owner: owner, admin: admin, created: time.Now()}
 
 	dev := srv.GetDevice(c.Query("group"), devid)
 	if dev == nil {
@@ -74,38 +130,115 @@ func handleUserConnection(srv *RttyServer, c *gin.Context) {
 		return
 	}
 
+	if token := c.Query("token"); token != "" {
+		if user := dev.reattachUser(token, username, conn); user != nil {
+			user.serve(conn)
+			return
+		}
+	}
+
+	if !user.login(dev) {
+		return
+	}
+
+	user.serve(conn)
+}
+
+// login starts the session on the device and waits for the device to
+// login. The session is closed if failed.
+func (user *User) login(dev *Device) bool {
+	srv := user.srv
 	sid := utils.GenUniqueID()
 
 	user.sid = sid
 	user.dev = dev
+
+	if err := srv.acquireTerm(&user.term, dev, user.owner); err != nil {
+		log.Warn().Msgf("reject session of '%s' to device '%s': %v", user.owner, dev.id, err)
+		user.SendCloseMsg(LoginErrorLimit, err.Error())
+		user.Close()
+		return false
+	}
+
 	user.pending = make(chan bool, 1)
+	user.limiter = newRateLimiter(func() int { return srv.rateLimits(dev.group).User })
+	user.ctx, user.cancel = context.WithCancel(dev.ctx)
+
+	if user.bcast != nil {
+		context.AfterFunc(user.bcast.ctx, user.cancel)
+	}
+
+	// The sessions of a broadcast end with it
+	if cfg := srv.config(); cfg.Term.DetachTimeout > 0 && user.bcast == nil {
+		user.token = utils.GenUniqueID()
+		user.scrollback = newRingBuffer(cfg.Term.BufferSize)
+	}
+
+	user.rec = srv.startRecording(user)
 
 	dev.pending.Store(sid, user)
 
-	defer user.Close()
+	go func() {
+		<-user.ctx.Done()
+		user.Close()
+	}()
 
 	if err := dev.WriteMsg(proto.MsgTypeLogin, sid); err != nil {
 		log.Error().Msgf("send login msg to device %s fail: %v", dev.id, err)
-		return
+		user.Close()
+		return false
 	}
 
-	ctx, cancel := context.WithCancel(dev.ctx)
-
-	go func() {
-		<-ctx.Done()
+	if !user.waitForLogin(dev, user.ctx, sid) {
 		user.Close()
-	}()
+		return false
+	}
+
+	srv.termLoggedIn(&user.term)
+
+	user.lastInput.Store(time.Now().UnixNano())
 
-	defer cancel()
+	go user.watchTimeouts()
 
-	if !user.waitForLogin(dev, ctx, sid) {
+	return true
+}
+
+// serve handles the messages from the websocket until it's closed. The
+// session is detached instead if the websocket is lost.
+func (user *User) serve(conn *websocket.Conn) {
+	lost := user.handleMsg(conn)
+
+	user.mu.Lock()
+
+	// Replaced by a reattach
+	if user.conn != conn {
+		user.mu.Unlock()
 		return
 	}
 
-	user.handleMsg()
+	if lost && user.detach() {
+		user.mu.Unlock()
+		return
+	}
+
+	user.mu.Unlock()
+
+	user.Close()
 }
 
 func (user *User) SendCloseMsg(code int, text string) {
+	if user.bcast != nil {
+		user.bcast.setCloseMsg(user.dev.id, code, text)
+		return
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.conn == nil {
+		return
+	}
+
 	user.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
 }
 
@@ -121,16 +254,162 @@ func (user *User) Close() {
 		}
 
 		dev.pending.Delete(sid)
-		user.conn.Close()
+
+		user.mu.Lock()
+		if user.conn != nil {
+			user.conn.Close()
+		}
+		if user.detachTimer != nil {
+			user.detachTimer.Stop()
+		}
+		user.mu.Unlock()
+
+		if user.cancel != nil {
+			user.cancel()
+		}
+
+		user.srv.releaseTerm(&user.term)
+
+		if user.rec != nil {
+			user.rec.close(user.srv)
+		}
+
+		if user.bcast != nil {
+			user.bcast.sessionClosed(user.dev.id)
+		}
 
 		log.Debug().Msgf("user with session '%s' closed", sid)
 	})
 }
 
+// closeUsers closes all the terminal sessions of the device, including
+// the pending ones, with the given websocket close code and reason.
+func (dev *Device) closeUsers(code int, text string) {
+	for _, users := range []*sync.Map{&dev.users, &dev.pending} {
+		users.Range(func(key, value any) bool {
+			user := value.(*User)
+			user.SendCloseMsg(code, text)
+			user.Close()
+			return true
+		})
+	}
+}
+
 func (user *User) WriteMsg(typ int, data []byte) error {
+	if user.bcast != nil {
+		// File transfers are not relayed by broadcasts
+		if typ != websocket.TextMessage {
+			return nil
+		}
+		return user.bcast.writeText(user.dev.id, data)
+	}
+
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.conn == nil {
+		return nil
+	}
+
 	return user.conn.WriteMessage(typ, data)
 }
 
+// writeTerm sends the terminal output to the user, data[0] is 0
+func (user *User) writeTerm(data []byte) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	if user.scrollback != nil {
+		user.scrollback.Write(data[1:])
+	}
+
+	if user.rec != nil {
+		user.rec.write(data[1:])
+	}
+
+	user.notifyWatchers(websocket.BinaryMessage, data)
+
+	if user.bcast != nil {
+		user.unacked += len(data) - 1
+		user.bcast.writeTerm(user.dev.id, data[1:])
+		return
+	}
+
+	if user.conn == nil {
+		// Nobody acknowledges while detached
+		user.ackTerm(uint16(len(data) - 1))
+		return
+	}
+
+	user.unacked += len(data) - 1
+	user.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// ack returns the bytes to acknowledge to the device for the ack from
+// the user, which also counts the output replayed on reattach.
+func (user *User) ack(n uint16) uint16 {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	n = uint16(min(int(n), user.unacked))
+	user.unacked -= int(n)
+
+	return n
+}
+
+// sendAck writes the ack of n bytes to the device once they are within
+// the rate limits of the device and the user. The output is charged when
+// acknowledged rather than when read from the device, so the device holds
+// back the output of a session over its rate without stalling the others.
+func (user *User) sendAck(n int, typ byte, data ...any) error {
+	dev := user.dev
+	data = append([]any{user.sid}, data...)
+
+	delay := max(dev.limiter.reserve(n), user.limiter.reserve(n))
+	if delay == 0 {
+		return dev.WriteMsg(typ, data...)
+	}
+
+	time.AfterFunc(delay, func() {
+		if !user.closed.Load() {
+			dev.WriteMsg(typ, data...)
+		}
+	})
+
+	return nil
+}
+
+// ackTerm acknowledges n bytes of terminal output to the device
+func (user *User) ackTerm(n uint16) error {
+	return user.sendAck(int(n), proto.MsgTypeAck, n)
+}
+
+// ackFile acknowledges the file data received by the user to the device
+func (user *User) ackFile() error {
+	n := user.fileUnacked.Swap(0)
+	return user.sendAck(int(n), proto.MsgTypeFile, proto.MsgTypeFileAck)
+}
+
+// resize keeps the terminal size for the watchers, and tells them
+func (user *User) resize(cols, rows uint16) {
+	user.mu.Lock()
+	defer user.mu.Unlock()
+
+	user.cols = cols
+	user.rows = rows
+
+	user.notifyWatchers(websocket.TextMessage, fmt.Appendf(nil, `{"type":"winsize","cols":%d,"rows":%d}`, cols, rows))
+}
+
+// loginMsg returns the message telling the user the terminal is ready,
+// with the session ID to share it
+func (user *User) loginMsg() []byte {
+	if user.token == "" {
+		return fmt.Appendf(nil, `{"type":"login","sid":"%s"}`, user.sid)
+	}
+	return fmt.Appendf(nil, `{"type":"login","sid":"%s","token":"%s"}`, user.sid, user.token)
+}
+
 func (user *User) waitForLogin(dev *Device, ctx context.Context, sid string) bool {
 	for {
 		select {
@@ -150,64 +429,91 @@ func (user *User) waitForLogin(dev *Device, ctx context.Context, sid string) boo
 	}
 }
 
-func (user *User) handleMsg() {
+// handleMsg relays the messages from the websocket to the device. It
+// returns true if the websocket is lost, rather than closed by the user.
+func (user *User) handleMsg(conn *websocket.Conn) bool {
 	dev := user.dev
 	sid := user.sid
 
 	for {
-		msgType, data, err := user.conn.ReadMessage()
+		msgType, data, err := conn.ReadMessage()
 		if err != nil {
-			if !user.closed.Load() {
-				closeError, ok := err.(*websocket.CloseError)
-				if !ok || ignoredWsCloseError(closeError.Code) {
-					log.Error().Msgf("user read fail: %v", err)
-				}
+			closeError, ok := err.(*websocket.CloseError)
+
+			if !user.closed.Load() && (!ok || ignoredWsCloseError(closeError.Code)) {
+				log.Error().Msgf("user read fail: %v", err)
 			}
-			return
+
+			return !ok || closeError.Code != websocket.CloseNormalClosure
 		}
 
 		if msgType == websocket.BinaryMessage {
 			if len(data) < 1 {
 				log.Error().Msgf("invalid msg from user")
-				return
+				return false
 			}
 
+			user.lastInput.Store(time.Now().UnixNano())
+
 			typ := proto.MsgTypeTermData
 			if data[0] == 1 {
 				typ = proto.MsgTypeFile
+
+				if !user.fileInput(data[1:]) {
+					continue
+				}
+
+				data = data[1:]
+			} else if data = user.filterInput(data[1:]); len(data) == 0 {
+				continue
+			}
+
+			if dev.limiter.wait(dev.ctx, len(data)) != nil || user.limiter.wait(dev.ctx, len(data)) != nil {
+				return false
 			}
 
-			err = dev.WriteMsg(typ, sid, data[1:])
+			err = dev.WriteMsg(typ, sid, data)
 		} else {
 			msg := &UserMsg{}
 
 			err = jsoniter.Unmarshal(data, msg)
 			if err != nil {
 				log.Error().Msgf("invalid msg from user")
-				return
+				return false
 			}
 
 			switch msg.Type {
 			case "winsize":
+				user.resize(msg.Cols, msg.Rows)
 				err = dev.WriteMsg(proto.MsgTypeWinsize, sid, msg.Cols, msg.Rows)
 
 			case "ack":
-				err = dev.WriteMsg(proto.MsgTypeAck, sid, msg.Ack)
+				if n := user.ack(msg.Ack); n > 0 {
+					err = user.ackTerm(n)
+				}
 
 			case "fileInfo":
-				err = dev.WriteMsg(proto.MsgTypeFile, sid, proto.MsgTypeFileInfo, msg.Size, msg.Name)
+				if user.fileInfo(msg.Size, msg.Name) {
+					err = dev.WriteMsg(proto.MsgTypeFile, sid, proto.MsgTypeFileInfo, msg.Size, msg.Name)
+				}
 
 			case "fileCanceled":
+				user.fileCanceled()
 				err = dev.WriteMsg(proto.MsgTypeFile, sid, proto.MsgTypeFileAbort)
 
 			case "fileAck":
-				err = dev.WriteMsg(proto.MsgTypeFile, sid, proto.MsgTypeFileAck)
+				err = user.ackFile()
+
+			case "commandConfirm":
+				if b := user.confirmCommand(msg.Ok); len(b) > 0 {
+					err = dev.WriteMsg(proto.MsgTypeTermData, sid, b)
+				}
 			}
 		}
 
 		if err != nil {
 			log.Error().Msgf("write msg to device '%s' fail: %v", dev.id, err)
-			return
+			return false
 		}
 	}
 }